@@ -0,0 +1,187 @@
+package metafora
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// AdmissionDenyDelay is how long the Consumer skips a task after a
+	// predicate denies it to give other nodes a chance to claim it (see #93).
+	AdmissionDenyDelay = time.Second
+
+	// AdmissionDeferDelay is how long the Consumer skips a task after a
+	// predicate defers it before evaluating the predicates again.
+	AdmissionDeferDelay = 5 * time.Second
+)
+
+// Decision is the result of an admission Predicate.
+type Decision int
+
+const (
+	// Allow the task to be claimed if every other predicate allows it.
+	Allow Decision = iota
+
+	// Deny claiming the task on this node. Other nodes may claim it.
+	Deny
+
+	// Defer claiming the task until later, such as when a downstream
+	// dependency is unhealthy.
+	Defer
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	case Defer:
+		return "defer"
+	}
+	return fmt.Sprintf("Decision(%d)", int(d))
+}
+
+// MarshalText encodes a decision as its string.
+func (d Decision) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText decodes "allow", "deny", or "defer".
+func (d *Decision) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "allow":
+		*d = Allow
+	case "deny":
+		*d = Deny
+	case "defer":
+		*d = Defer
+	default:
+		return fmt.Errorf("invalid decision: %q", text)
+	}
+	return nil
+}
+
+// Predicate is consulted by the Consumer after the Balancer's CanClaim and
+// before the Coordinator's Claim. Predicates are evaluated in the order they
+// were added and the first not to allow a task stops evaluation.
+type Predicate interface {
+	// Name identifies the predicate in logs and introspection.
+	Name() string
+
+	// Admit returns whether the task may be claimed and the reason why.
+	Admit(taskID string) (Decision, string)
+}
+
+// NewPredicate creates a Predicate from a function.
+func NewPredicate(name string, admit func(taskID string) (Decision, string)) Predicate {
+	return &funcPredicate{name: name, admit: admit}
+}
+
+type funcPredicate struct {
+	name  string
+	admit func(string) (Decision, string)
+}
+
+func (p *funcPredicate) Name() string                           { return p.name }
+func (p *funcPredicate) Admit(taskID string) (Decision, string) { return p.admit(taskID) }
+
+// PredicateStats counts the decisions made by a Predicate.
+type PredicateStats struct {
+	Name     string `json:"name"`
+	Allowed  uint64 `json:"allowed"`
+	Denied   uint64 `json:"denied"`
+	Deferred uint64 `json:"deferred"`
+
+	// LastTask and LastReason are from the most recent denial or deferral.
+	LastTask   string `json:"last_task,omitempty"`
+	LastReason string `json:"last_reason,omitempty"`
+}
+
+// AddPredicates appends admission predicates to the Consumer. It must be
+// called before Run.
+func (c *Consumer) AddPredicates(preds ...Predicate) {
+	c.admitL.Lock()
+	defer c.admitL.Unlock()
+	for _, p := range preds {
+		c.preds = append(c.preds, p)
+		c.admitStats = append(c.admitStats, PredicateStats{Name: p.Name()})
+	}
+}
+
+// Admission returns the decisions made by each admission predicate.
+func (c *Consumer) Admission() []PredicateStats {
+	c.admitL.Lock()
+	defer c.admitL.Unlock()
+	stats := make([]PredicateStats, len(c.admitStats))
+	copy(stats, c.admitStats)
+	return stats
+}
+
+// admit evaluates the admission predicates for a task and returns true if
+// all allow it. Denied and deferred tasks are skipped without evaluating the
+// predicates until their delay has elapsed.
+func (c *Consumer) admit(taskID string) bool {
+	now := time.Now()
+	c.admitL.Lock()
+	preds := c.preds
+	notBefore, skip := c.admitAfter[taskID]
+	if skip && !now.Before(notBefore) {
+		delete(c.admitAfter, taskID)
+		skip = false
+	}
+	c.admitL.Unlock()
+
+	if skip {
+		Debugf("Skipping task %s until %s", taskID, notBefore)
+		return false
+	}
+
+	for i, p := range preds {
+		d, reason := p.Admit(taskID)
+
+		c.admitL.Lock()
+		stats := &c.admitStats[i]
+		switch d {
+		case Allow:
+			stats.Allowed++
+		case Deny:
+			stats.Denied++
+		default:
+			d = Defer
+			stats.Deferred++
+		}
+		if d != Allow {
+			stats.LastTask, stats.LastReason = taskID, reason
+		}
+		c.admitL.Unlock()
+
+		switch d {
+		case Deny:
+			Infof("Predicate %s denied task %s: %s", p.Name(), taskID, reason)
+			c.skipUntil(taskID, now.Add(AdmissionDenyDelay))
+			return false
+		case Defer:
+			Infof("Predicate %s deferred task %s: %s", p.Name(), taskID, reason)
+			c.skipUntil(taskID, now.Add(AdmissionDeferDelay))
+			return false
+		}
+	}
+	return true
+}
+
+// skipUntil records when a task may be admitted again and forgets tasks
+// whose delay has elapsed.
+func (c *Consumer) skipUntil(taskID string, t time.Time) {
+	c.admitL.Lock()
+	defer c.admitL.Unlock()
+	for id, nb := range c.admitAfter {
+		if !nb.After(time.Now()) {
+			delete(c.admitAfter, id)
+		}
+	}
+	if c.admitAfter == nil {
+		c.admitAfter = make(map[string]time.Time)
+	}
+	c.admitAfter[taskID] = t
+}
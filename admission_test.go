@@ -0,0 +1,78 @@
+package metafora
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAdmission ensures predicates are evaluated in order before claiming,
+// their decisions are counted, and denied tasks are skipped until their delay
+// elapses.
+func TestAdmission(t *testing.T) {
+	defer func(deny, deferral time.Duration) {
+		AdmissionDenyDelay, AdmissionDeferDelay = deny, deferral
+	}(AdmissionDenyDelay, AdmissionDeferDelay)
+	AdmissionDenyDelay = time.Hour
+	AdmissionDeferDelay = time.Hour
+
+	hf, tasksRun := newTestHandlerFunc(t)
+	tc := NewTestCoord()
+	c, _ := NewConsumer(tc, hf, &DumbBalancer{})
+	c.AddPredicates(
+		NewPredicate("flags", func(id string) (Decision, string) {
+			if id == "disabled" {
+				return Deny, "flag off"
+			}
+			return Allow, ""
+		}),
+		NewPredicate("downstream", func(id string) (Decision, string) {
+			if id == "later" {
+				return Defer, "unhealthy"
+			}
+			return Allow, ""
+		}),
+	)
+	go c.Run()
+	defer c.Shutdown()
+
+	tc.Tasks <- "disabled"
+	tc.Tasks <- "later"
+	tc.Tasks <- "disabled"
+	tc.Tasks <- "ok"
+
+	// Wait for the handler to be running before checking stats or shutting
+	// down
+	select {
+	case run := <-tasksRun:
+		if run != "ok" {
+			t.Fatalf("Expected only ok to run but %s ran", run)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Task didn't run in a timely fashion")
+	}
+
+	expected := []PredicateStats{
+		{Name: "flags", Allowed: 2, Denied: 1, LastTask: "disabled", LastReason: "flag off"},
+		{Name: "downstream", Allowed: 1, Deferred: 1, LastTask: "later", LastReason: "unhealthy"},
+	}
+	stats := c.Admission()
+	if len(stats) != len(expected) {
+		t.Fatalf("Expected %v but found %v", expected, stats)
+	}
+	for i := range expected {
+		if stats[i] != expected[i] {
+			t.Errorf("Expected %+v but found %+v", expected[i], stats[i])
+		}
+	}
+
+	// Once the delay elapses the predicates are evaluated again
+	c.admitL.Lock()
+	c.admitAfter["disabled"] = time.Now().Add(-time.Second)
+	c.admitL.Unlock()
+	if c.admit("disabled") {
+		t.Fatal("Expected disabled to be denied again")
+	}
+	if denied := c.Admission()[0].Denied; denied != 2 {
+		t.Fatalf("Expected 2 denials after the delay elapsed but found %d", denied)
+	}
+}
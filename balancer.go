@@ -1,6 +1,7 @@
 package metafora
 
 import (
+	"errors"
 	"math"
 	"math/rand"
 	"time"
@@ -20,6 +21,92 @@ type BalancerContext interface {
 	Tasks() []Task
 }
 
+// ClusterContext is an optional interface BalancerContexts may implement to
+// expose the cluster and Consumer state. The Consumer implements it.
+type ClusterContext interface {
+	BalancerContext
+
+	// Cluster returns a snapshot of the cluster from the Coordinator or
+	// ErrNoClusterView if the Coordinator doesn't implement
+	// ClusterCoordinator.
+	Cluster() (ClusterView, error)
+
+	// Frozen returns true if the Consumer is frozen and not claiming tasks.
+	Frozen() bool
+}
+
+// SleepContext is an optional interface BalancerContexts may implement to
+// control how Balancers delay claims in CanClaim. Simulations implement it to
+// advance a virtual clock instead of sleeping.
+type SleepContext interface {
+	BalancerContext
+
+	// Sleep delays the current claim by d.
+	Sleep(d time.Duration)
+}
+
+// sleep delays a claim by d via the context if it implements SleepContext or
+// time.Sleep otherwise.
+func sleep(ctx BalancerContext, d time.Duration) {
+	if sc, ok := ctx.(SleepContext); ok {
+		sc.Sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// PropsContext is an optional interface BalancerContexts may implement to
+// expose the properties of tasks which haven't been claimed yet. The Consumer
+// implements it.
+type PropsContext interface {
+	BalancerContext
+
+	// Props returns the properties stored with a task or the zero value if
+	// the Coordinator doesn't implement PropsCoordinator.
+	Props(taskID string) TaskProps
+}
+
+// ctxProps returns a task's properties via the context if it implements
+// PropsContext or the zero value otherwise.
+func ctxProps(ctx BalancerContext, taskID string) TaskProps {
+	if pc, ok := ctx.(PropsContext); ok {
+		return pc.Props(taskID)
+	}
+	return TaskProps{}
+}
+
+// ErrNoClusterView is returned by ClusterContext.Cluster when the
+// Coordinator doesn't implement ClusterCoordinator.
+var ErrNoClusterView = errors.New("coordinator doesn't provide a cluster view")
+
+// clusterView returns the context's ClusterView or ErrNoClusterView if it
+// doesn't implement ClusterContext.
+func clusterView(ctx BalancerContext) (ClusterView, error) {
+	if cc, ok := ctx.(ClusterContext); ok {
+		return cc.Cluster()
+	}
+	return ClusterView{}, ErrNoClusterView
+}
+
+// ClusterView is a snapshot of the cluster provided by Coordinators which
+// implement ClusterCoordinator so Balancers work the same on every backend.
+type ClusterView struct {
+	// NodeID of this node.
+	NodeID string
+
+	// Nodes is the list of live nodes.
+	Nodes []string
+
+	// NodeTasks is the number of tasks claimed by each live node.
+	NodeTasks map[string]int
+
+	// Backlog is the number of unclaimed tasks.
+	Backlog int
+
+	// BacklogPriority is the highest priority of any unclaimed task.
+	BacklogPriority int
+}
+
 // Balancer is the core task balancing interface. Without a master Metafora
 // clusters are cooperatively balanced -- meaning each node needs to know how
 // to balance itself.
@@ -76,6 +163,16 @@ func NewDefaultFairBalancerWithThreshold(nodeid string, cs ClusterState, thresho
 	}
 }
 
+// NewFairBalancer creates a new FairBalancer which uses the ClusterView
+// provided by the Coordinator through BalancerContext instead of a
+// ClusterState.
+func NewFairBalancer() Balancer {
+	return &FairBalancer{
+		releaseThreshold: defaultThreshold,
+		lastreleased:     map[string]bool{},
+	}
+}
+
 // An implementation of Balancer which attempts to randomly release tasks in
 // the case when the count of those currently running on this node is greater
 // than some percentage of the cluster average (default 120%).
@@ -91,6 +188,9 @@ type FairBalancer struct {
 	releaseThreshold float64
 
 	lastreleased map[string]bool
+
+	// task counts from the last Balance updated by handoffs
+	lastcounts map[string]int
 }
 
 func (e *FairBalancer) Init(s BalancerContext) {
@@ -101,7 +201,7 @@ func (e *FairBalancer) Init(s BalancerContext) {
 // released tasks in order to give other nodes a chance to claim them first
 func (e *FairBalancer) CanClaim(taskid string) bool {
 	if e.lastreleased[taskid] {
-		time.Sleep(500 * time.Millisecond)
+		sleep(e.bc, 500*time.Millisecond)
 	}
 	return true
 }
@@ -110,22 +210,28 @@ func (e *FairBalancer) CanClaim(taskid string) bool {
 // node in the cluster.
 func (e *FairBalancer) Balance() []string {
 	e.lastreleased = map[string]bool{}
-	current, err := e.clusterstate.NodeTaskCount()
+	current, err := e.nodeTaskCount()
 	if err != nil {
 		Warnf("Error retrieving cluster state: %v", err)
 		return nil
 	}
 
+	e.lastcounts = current
+
 	releasetasks := []string{}
 	shouldrelease := current[e.nodeid] - e.desiredCount(current)
 	if shouldrelease < 1 {
 		return nil
 	}
 
+	// Pick distinct tasks so each released task can be handed off
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
 	nodetasks := e.bc.Tasks()
-	for len(releasetasks) < shouldrelease {
-		tid := nodetasks[random.Intn(len(nodetasks))].ID()
+	for _, i := range random.Perm(len(nodetasks)) {
+		if len(releasetasks) == shouldrelease {
+			break
+		}
+		tid := nodetasks[i].ID()
 		releasetasks = append(releasetasks, tid)
 		e.lastreleased[tid] = true
 	}
@@ -133,6 +239,42 @@ func (e *FairBalancer) Balance() []string {
 	return releasetasks
 }
 
+// nodeTaskCount returns tasks per node from the ClusterState if one was
+// given or the BalancerContext's ClusterView otherwise.
+func (e *FairBalancer) nodeTaskCount() (map[string]int, error) {
+	if e.clusterstate != nil {
+		return e.clusterstate.NodeTaskCount()
+	}
+	view, err := clusterView(e.bc)
+	if err != nil {
+		return nil, err
+	}
+	e.nodeid = view.NodeID
+	return view.NodeTasks, nil
+}
+
+// Handoff nominates the least loaded node as of the last Balance to claim a
+// released task.
+func (e *FairBalancer) Handoff(taskid string) string {
+	if !e.lastreleased[taskid] {
+		return ""
+	}
+	target := ""
+	for node, n := range e.lastcounts {
+		if node == e.nodeid {
+			continue
+		}
+		if target == "" || n < e.lastcounts[target] || (n == e.lastcounts[target] && node < target) {
+			target = node
+		}
+	}
+	if target != "" {
+		// Count the handoff so multiple releases are spread across nodes
+		e.lastcounts[target]++
+	}
+	return target
+}
+
 // Retrieve the desired maximum count, based on current cluster state
 func (e *FairBalancer) desiredCount(current map[string]int) int {
 	total := 0
@@ -0,0 +1,98 @@
+package metafora
+
+import "time"
+
+var (
+	// AffinityRejectDelay is how long AffinityBalancer sleeps before rejecting
+	// a task. Until #93 is fixed rejected tasks may be immediately offered
+	// again by the Coordinator, so sleep to prevent a tight loop.
+	AffinityRejectDelay = time.Second
+
+	// AffinityPreferredDelay is how long AffinityBalancer sleeps before
+	// claiming a task per preferred label this node lacks.
+	AffinityPreferredDelay = 100 * time.Millisecond
+)
+
+// AffinityState provides AffinityBalancer with this node's labels and the
+// constraints of tasks it hasn't claimed yet.
+type AffinityState interface {
+	// Labels returns this node's current labels.
+	Labels() map[string]string
+
+	// Props returns the properties stored with a task.
+	Props(taskID string) TaskProps
+}
+
+// AffinityBalancer enforces task Constraints. It only claims tasks whose
+// required labels match this node's labels and which don't share an
+// anti-affinity group with a running task. Tasks which violate their
+// constraints -- for example after this node's labels change -- are released.
+type AffinityBalancer struct {
+	ctx   BalancerContext
+	state AffinityState
+}
+
+// NewAffinityBalancer creates a new AffinityBalancer.
+func NewAffinityBalancer(state AffinityState) Balancer {
+	return &AffinityBalancer{state: state}
+}
+
+// Init is called by the Consumer.
+func (b *AffinityBalancer) Init(ctx BalancerContext) { b.ctx = ctx }
+
+// CanClaim returns false if the task's constraints aren't satisfied by this
+// node and delays claiming tasks whose preferred labels are missing.
+func (b *AffinityBalancer) CanClaim(taskID string) bool {
+	c := b.state.Props(taskID).Constraints
+	labels := b.state.Labels()
+	if !c.Satisfied(labels) {
+		Infof("Task %s requires labels %v; node has %v", taskID, c.Required, labels)
+		sleep(b.ctx, AffinityRejectDelay)
+		return false
+	}
+	if c.AntiAffinity != "" {
+		for _, t := range b.ctx.Tasks() {
+			if taskProps(t).Constraints.AntiAffinity == c.AntiAffinity {
+				Infof("Task %s conflicts with running task %s in anti-affinity group %s",
+					taskID, t.ID(), c.AntiAffinity)
+				sleep(b.ctx, AffinityRejectDelay)
+				return false
+			}
+		}
+	}
+	if n := missing(c.Preferred, labels); n > 0 {
+		sleep(b.ctx, time.Duration(n)*AffinityPreferredDelay)
+	}
+	return true
+}
+
+// Balance releases tasks whose required labels are no longer satisfied and
+// all but the oldest task in each anti-affinity group.
+func (b *AffinityBalancer) Balance() []string {
+	labels := b.state.Labels()
+	release := []string{}
+	oldest := map[string]Task{}
+	for _, t := range b.ctx.Tasks() {
+		c := taskProps(t).Constraints
+		if !c.Satisfied(labels) {
+			Infof("Releasing task %s: requires labels %v; node has %v", t.ID(), c.Required, labels)
+			release = append(release, t.ID())
+			continue
+		}
+		if c.AntiAffinity == "" {
+			continue
+		}
+		prev, ok := oldest[c.AntiAffinity]
+		if !ok {
+			oldest[c.AntiAffinity] = t
+			continue
+		}
+		if t.Started().Before(prev.Started()) {
+			t, oldest[c.AntiAffinity] = prev, t
+		}
+		Infof("Releasing task %s: anti-affinity group %s conflicts with task %s",
+			t.ID(), c.AntiAffinity, oldest[c.AntiAffinity].ID())
+		release = append(release, t.ID())
+	}
+	return release
+}
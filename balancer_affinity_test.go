@@ -0,0 +1,62 @@
+package metafora
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type affinityState struct {
+	labels map[string]string
+	props  map[string]TaskProps
+}
+
+func (s *affinityState) Labels() map[string]string     { return s.labels }
+func (s *affinityState) Props(taskID string) TaskProps { return s.props[taskID] }
+
+type affinityCtx []Task
+
+func (ctx affinityCtx) Tasks() []Task { return ctx }
+
+func TestAffinityBalancer(t *testing.T) {
+	AffinityRejectDelay = 0
+	AffinityPreferredDelay = 0
+	defer func() {
+		AffinityRejectDelay = time.Second
+		AffinityPreferredDelay = 100 * time.Millisecond
+	}()
+
+	state := &affinityState{
+		labels: map[string]string{"dc": "east", "disk": "large"},
+		props: map[string]TaskProps{
+			"east":   {Constraints: Constraints{Required: map[string]string{"dc": "east"}}},
+			"west":   {Constraints: Constraints{Required: map[string]string{"dc": "west"}}},
+			"cache":  {Constraints: Constraints{Preferred: map[string]string{"cache": "warm"}}},
+			"cache2": {Constraints: Constraints{AntiAffinity: "cache"}},
+		},
+	}
+	running := newTask("running", 0, TaskProps{Constraints: Constraints{AntiAffinity: "cache"}}, nil)
+	bal := NewAffinityBalancer(state)
+	bal.Init(affinityCtx{running})
+
+	for task, expected := range map[string]bool{"east": true, "west": false, "cache": true, "cache2": false, "none": true} {
+		if ok := bal.CanClaim(task); ok != expected {
+			t.Errorf("Expected CanClaim(%q) to be %t", task, expected)
+		}
+	}
+	if release := bal.Balance(); len(release) > 0 {
+		t.Errorf("Expected no tasks to be released but found %v", release)
+	}
+
+	// Change labels and run conflicting tasks
+	east := newTask("east", 0, state.props["east"], nil)
+	late := newTask("late", 0, TaskProps{Constraints: Constraints{AntiAffinity: "cache"}}, nil)
+	late.started = running.started.Add(time.Second)
+	bal.Init(affinityCtx{late, east, running})
+	state.labels = map[string]string{"dc": "west"}
+
+	expected := []string{"east", "late"}
+	if release := bal.Balance(); !reflect.DeepEqual(release, expected) {
+		t.Errorf("Expected %v to be released but found %v", expected, release)
+	}
+}
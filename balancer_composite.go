@@ -0,0 +1,145 @@
+package metafora
+
+// ClaimMode determines how a CompositeBalancer combines the CanClaim results
+// of its balancers.
+type ClaimMode int
+
+const (
+	// ClaimAll only claims tasks every balancer can claim.
+	ClaimAll ClaimMode = iota
+
+	// ClaimAny claims tasks any balancer can claim.
+	ClaimAny
+)
+
+// ReleaseMode determines how a CompositeBalancer merges the release lists of
+// its balancers.
+type ReleaseMode int
+
+const (
+	// ReleaseUnion interleaves release lists so that when the per-round cap is
+	// reached every balancer has had a fair share of its tasks released.
+	ReleaseUnion ReleaseMode = iota
+
+	// ReleasePriority releases tasks in the order balancers were given, so
+	// earlier balancers' tasks are released before later balancers' when the
+	// per-round cap is reached.
+	ReleasePriority
+)
+
+// CompositeBalancer chains multiple balancers together. For example
+// combining a ResourceBalancer and FairBalancer with ClaimAll only claims
+// tasks when resources are available and the node has fewer than the average
+// number of tasks.
+type CompositeBalancer struct {
+	balancers  []Balancer
+	claim      ClaimMode
+	release    ReleaseMode
+	maxRelease int
+}
+
+// NewCompositeBalancer creates a new CompositeBalancer. At most maxRelease
+// tasks will be released per call to Balance unless maxRelease is 0.
+func NewCompositeBalancer(claim ClaimMode, release ReleaseMode, maxRelease int, balancers ...Balancer) Balancer {
+	return &CompositeBalancer{
+		balancers:  balancers,
+		claim:      claim,
+		release:    release,
+		maxRelease: maxRelease,
+	}
+}
+
+// Init initializes all balancers with the context.
+func (b *CompositeBalancer) Init(ctx BalancerContext) {
+	for _, bal := range b.balancers {
+		bal.Init(ctx)
+	}
+}
+
+// CanClaim calls each balancer's CanClaim in order. Calls short circuit, so
+// with ClaimAll balancers after the first to reject a task aren't called and
+// with ClaimAny balancers after the first to accept a task aren't called.
+func (b *CompositeBalancer) CanClaim(taskID string) bool {
+	for _, bal := range b.balancers {
+		ok := bal.CanClaim(taskID)
+		if b.claim == ClaimAll && !ok {
+			return false
+		}
+		if b.claim == ClaimAny && ok {
+			return true
+		}
+	}
+
+	// All accepted when ClaimAll and none accepted when ClaimAny. No balancers
+	// means there's nothing to reject the task.
+	return b.claim == ClaimAll || len(b.balancers) == 0
+}
+
+// Balance calls every balancer's Balance and returns the merged list of
+// tasks to release without duplicates.
+func (b *CompositeBalancer) Balance() []string {
+	lists := make([][]string, len(b.balancers))
+	for i, bal := range b.balancers {
+		lists[i] = bal.Balance()
+	}
+
+	merged := b.merge(lists)
+	if len(merged) > 0 {
+		Infof("Composite balancer releasing %d tasks: %v", len(merged), merged)
+	}
+	return merged
+}
+
+// Handoff returns the first node nominated by a balancer which implements
+// HandoffBalancer or "" if none nominate one.
+func (b *CompositeBalancer) Handoff(taskID string) string {
+	for _, bal := range b.balancers {
+		if hb, ok := bal.(HandoffBalancer); ok {
+			if node := hb.Handoff(taskID); node != "" {
+				return node
+			}
+		}
+	}
+	return ""
+}
+
+// merge release lists according to the ReleaseMode and cap.
+func (b *CompositeBalancer) merge(lists [][]string) []string {
+	merged := []string{}
+	seen := map[string]bool{}
+	add := func(taskID string) bool {
+		if !seen[taskID] {
+			seen[taskID] = true
+			merged = append(merged, taskID)
+		}
+		return b.maxRelease == 0 || len(merged) < b.maxRelease
+	}
+
+	switch b.release {
+	case ReleasePriority:
+		for _, list := range lists {
+			for _, taskID := range list {
+				if !add(taskID) {
+					return merged
+				}
+			}
+		}
+	default:
+		for i := 0; ; i++ {
+			more := false
+			for _, list := range lists {
+				if i >= len(list) {
+					continue
+				}
+				more = true
+				if !add(list[i]) {
+					return merged
+				}
+			}
+			if !more {
+				break
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,69 @@
+package metafora
+
+import (
+	"reflect"
+	"testing"
+)
+
+type fakeBalancer struct {
+	claim   bool
+	release []string
+	calls   int
+}
+
+func (b *fakeBalancer) Init(BalancerContext) {}
+func (b *fakeBalancer) CanClaim(string) bool {
+	b.calls++
+	return b.claim
+}
+func (b *fakeBalancer) Balance() []string { return b.release }
+
+func TestCompositeBalancerClaim(t *testing.T) {
+	t.Parallel()
+	yes := &fakeBalancer{claim: true}
+	no := &fakeBalancer{claim: false}
+
+	if NewCompositeBalancer(ClaimAll, ReleaseUnion, 0, yes, no).CanClaim("t") {
+		t.Error("ClaimAll claimed a task one balancer rejected")
+	}
+	if !NewCompositeBalancer(ClaimAll, ReleaseUnion, 0, yes, yes).CanClaim("t") {
+		t.Error("ClaimAll rejected a task every balancer accepted")
+	}
+	if !NewCompositeBalancer(ClaimAny, ReleaseUnion, 0, no, yes).CanClaim("t") {
+		t.Error("ClaimAny rejected a task one balancer accepted")
+	}
+	if NewCompositeBalancer(ClaimAny, ReleaseUnion, 0, no, no).CanClaim("t") {
+		t.Error("ClaimAny claimed a task every balancer rejected")
+	}
+
+	// Short circuiting
+	first, second := &fakeBalancer{claim: false}, &fakeBalancer{claim: true}
+	NewCompositeBalancer(ClaimAll, ReleaseUnion, 0, first, second).CanClaim("t")
+	if first.calls != 1 || second.calls != 0 {
+		t.Errorf("Expected ClaimAll to stop at first rejection: %d %d", first.calls, second.calls)
+	}
+}
+
+func TestCompositeBalancerRelease(t *testing.T) {
+	t.Parallel()
+	a := &fakeBalancer{release: []string{"1", "2", "3"}}
+	b := &fakeBalancer{release: []string{"2", "4"}}
+
+	tests := []struct {
+		mode     ReleaseMode
+		max      int
+		expected []string
+	}{
+		{ReleaseUnion, 0, []string{"1", "2", "4", "3"}},
+		{ReleaseUnion, 2, []string{"1", "2"}},
+		{ReleaseUnion, 3, []string{"1", "2", "4"}},
+		{ReleasePriority, 0, []string{"1", "2", "3", "4"}},
+		{ReleasePriority, 3, []string{"1", "2", "3"}},
+	}
+	for _, test := range tests {
+		bal := NewCompositeBalancer(ClaimAll, test.mode, test.max, a, b)
+		if release := bal.Balance(); !reflect.DeepEqual(release, test.expected) {
+			t.Errorf("mode=%d max=%d expected %v but found %v", test.mode, test.max, test.expected, release)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package metafora
+
+import "time"
+
+var (
+	// PreemptRejectDelay is how long PreemptiveBalancer sleeps before
+	// rejecting a task while at capacity. Until #93 is fixed rejected tasks
+	// may be immediately offered again by the Coordinator, so sleep to prevent
+	// a tight loop.
+	PreemptRejectDelay = time.Second
+
+	// PreemptReclaimDelay is how long PreemptiveBalancer sleeps before
+	// claiming a task it just preempted to give higher priority tasks a chance
+	// to be claimed first.
+	PreemptReclaimDelay = 500 * time.Millisecond
+)
+
+// PreemptiveBalancer wraps a Balancer to make room for high priority tasks.
+// When the node is running at capacity and the Coordinator's ClusterView
+// reports unclaimed tasks with a higher priority than a running task, the
+// lowest priority running task is released so a higher priority task may be
+// claimed in its place.
+//
+// Only one task is preempted per Balance call to avoid releasing more tasks
+// than necessary. Coordinators must implement ClusterCoordinator and store
+// priorities in TaskProps for preemption to occur.
+//
+// While at capacity only tasks with a higher priority than the lowest
+// priority running task are claimed. Preempted tasks aren't reclaimed until
+// PreemptReclaimDelay has passed.
+type PreemptiveBalancer struct {
+	Balancer
+
+	ctx      BalancerContext
+	capacity int
+
+	preempted map[string]bool
+}
+
+// NewPreemptiveBalancer wraps a Balancer so that low priority tasks are
+// preempted when this node is running at least capacity tasks.
+func NewPreemptiveBalancer(b Balancer, capacity int) Balancer {
+	return &PreemptiveBalancer{Balancer: b, capacity: capacity, preempted: map[string]bool{}}
+}
+
+// Init initializes the wrapped balancer.
+func (b *PreemptiveBalancer) Init(ctx BalancerContext) {
+	b.ctx = ctx
+	b.Balancer.Init(ctx)
+}
+
+// CanClaim delays claiming tasks preempted by the last Balance and rejects
+// tasks while at capacity unless their priority is higher than the lowest
+// priority running task. Otherwise the wrapped balancer decides.
+func (b *PreemptiveBalancer) CanClaim(taskID string) bool {
+	if b.preempted[taskID] {
+		sleep(b.ctx, PreemptReclaimDelay)
+	}
+
+	var running []Task
+	for _, t := range b.ctx.Tasks() {
+		if t.Stopped().IsZero() {
+			running = append(running, t)
+		}
+	}
+	if len(running) >= b.capacity {
+		lowest := lowestPriority(running)
+		if lowest == nil || ctxProps(b.ctx, taskID).Priority <= taskProps(lowest).Priority {
+			sleep(b.ctx, PreemptRejectDelay)
+			return false
+		}
+	}
+	return b.Balancer.CanClaim(taskID)
+}
+
+// Balance returns the wrapped balancer's releases plus the lowest priority
+// running task if the node is still full and higher priority tasks are
+// waiting.
+func (b *PreemptiveBalancer) Balance() []string {
+	b.preempted = map[string]bool{}
+	release := b.Balancer.Balance()
+
+	released := make(map[string]bool, len(release))
+	for _, id := range release {
+		released[id] = true
+	}
+	var running []Task
+	for _, t := range b.ctx.Tasks() {
+		if t.Stopped().IsZero() && !released[t.ID()] {
+			running = append(running, t)
+		}
+	}
+	if len(running) < b.capacity {
+		return release
+	}
+
+	view, err := clusterView(b.ctx)
+	if err != nil {
+		if err != ErrNoClusterView {
+			Warnf("Error retrieving cluster view: %v", err)
+		}
+		return release
+	}
+	if view.Backlog == 0 {
+		return release
+	}
+
+	victim := lowestPriority(running)
+	if victim == nil || taskProps(victim).Priority >= view.BacklogPriority {
+		return release
+	}
+	Infof("Preempting task %s (priority %d) for waiting tasks with priority %d",
+		victim.ID(), taskProps(victim).Priority, view.BacklogPriority)
+	b.preempted[victim.ID()] = true
+	return append(release, victim.ID())
+}
+
+// lowestPriority returns the task with the lowest priority, preferring the
+// most recently started to lose the least work, or nil if there are none.
+func lowestPriority(tasks []Task) Task {
+	var task Task
+	for _, t := range tasks {
+		if task == nil {
+			task = t
+			continue
+		}
+		p, tp := taskProps(t).Priority, taskProps(task).Priority
+		if p < tp || (p == tp && t.Started().After(task.Started())) {
+			task = t
+		}
+	}
+	return task
+}
@@ -0,0 +1,116 @@
+package metafora
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type priorityCtx struct {
+	usageCtx
+	view  ClusterView
+	props map[string]TaskProps
+	slept *time.Duration
+}
+
+func (ctx priorityCtx) Cluster() (ClusterView, error) { return ctx.view, nil }
+func (priorityCtx) Frozen() bool                      { return false }
+func (ctx priorityCtx) Props(id string) TaskProps     { return ctx.props[id] }
+func (ctx priorityCtx) Sleep(d time.Duration)         { *ctx.slept += d }
+
+func TestPreemptiveBalancer(t *testing.T) {
+	t.Parallel()
+
+	low := newTask("low", 0, TaskProps{Priority: 1}, nil)
+	low.started = time.Now().Add(-time.Hour)
+	newLow := newTask("newlow", 0, TaskProps{Priority: 1}, nil)
+	high := newTask("high", 0, TaskProps{Priority: 5}, nil)
+	ctx := priorityCtx{
+		usageCtx: usageCtx{low, newLow, high},
+		view:     ClusterView{Backlog: 1, BacklogPriority: 3},
+		slept:    new(time.Duration),
+	}
+
+	// Below capacity nothing is preempted
+	bal := NewPreemptiveBalancer(&DumbBalancer{}, 4)
+	bal.Init(ctx)
+	if release := bal.Balance(); len(release) > 0 {
+		t.Fatalf("Expected nothing to be released below capacity but found %v", release)
+	}
+
+	// At capacity the newest lowest priority task is preempted
+	bal = NewPreemptiveBalancer(&DumbBalancer{}, 3)
+	bal.Init(ctx)
+	expected := []string{"newlow"}
+	if release := bal.Balance(); !reflect.DeepEqual(release, expected) {
+		t.Fatalf("Expected %v to be released but found %v", expected, release)
+	}
+
+	// Waiting tasks without a higher priority don't preempt
+	ctx.view.BacklogPriority = 1
+	bal.Init(ctx)
+	if release := bal.Balance(); len(release) > 0 {
+		t.Fatalf("Expected nothing to be released for equal priority but found %v", release)
+	}
+
+	// Releases by the wrapped balancer make room
+	ctx.view.BacklogPriority = 3
+	bal = NewPreemptiveBalancer(&fakeBalancer{release: []string{"high"}}, 3)
+	bal.Init(ctx)
+	expected = []string{"high"}
+	if release := bal.Balance(); !reflect.DeepEqual(release, expected) {
+		t.Fatalf("Expected %v to be released but found %v", expected, release)
+	}
+
+	// Preempted tasks are reclaimed after a delay
+	bal = NewPreemptiveBalancer(&fakeBalancer{claim: true}, 3)
+	bal.Init(ctx)
+	bal.Balance()
+	ctx.usageCtx = usageCtx{low, high}
+	bal.Init(ctx)
+	if !bal.CanClaim("newlow") || *ctx.slept != PreemptReclaimDelay {
+		t.Fatalf("Expected preempted task to be claimed after %s but slept %s", PreemptReclaimDelay, *ctx.slept)
+	}
+}
+
+func TestPreemptiveBalancerCanClaim(t *testing.T) {
+	t.Parallel()
+
+	low := newTask("low", 0, TaskProps{Priority: 1}, nil)
+	high := newTask("high", 0, TaskProps{Priority: 5}, nil)
+	ctx := priorityCtx{
+		usageCtx: usageCtx{low, high},
+		props:    map[string]TaskProps{"mid": {Priority: 3}, "equal": {Priority: 1}},
+		slept:    new(time.Duration),
+	}
+
+	// Below capacity the wrapped balancer decides
+	fb := &fakeBalancer{claim: true}
+	bal := NewPreemptiveBalancer(fb, 3)
+	bal.Init(ctx)
+	if !bal.CanClaim("equal") || fb.calls != 1 {
+		t.Fatalf("Expected claim below capacity to be delegated")
+	}
+
+	// At capacity only tasks with a higher priority than the lowest running
+	// task are claimed
+	fb = &fakeBalancer{claim: true}
+	bal = NewPreemptiveBalancer(fb, 2)
+	bal.Init(ctx)
+	if bal.CanClaim("equal") || bal.CanClaim("unknown") {
+		t.Fatalf("Expected tasks without a higher priority to be rejected at capacity")
+	}
+	if *ctx.slept != 2*PreemptRejectDelay {
+		t.Fatalf("Expected rejections to sleep %s but slept %s", 2*PreemptRejectDelay, *ctx.slept)
+	}
+	if !bal.CanClaim("mid") || fb.calls != 1 {
+		t.Fatalf("Expected higher priority task to be delegated at capacity")
+	}
+
+	// Stopped tasks don't count towards capacity
+	low.stopped = time.Now()
+	bal.Init(ctx)
+	if !bal.CanClaim("equal") {
+		t.Fatalf("Expected stopped tasks to be ignored")
+	}
+}
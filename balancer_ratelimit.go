@@ -0,0 +1,111 @@
+package metafora
+
+import (
+	"sync"
+	"time"
+)
+
+// ReleaseLimiter limits the number of tasks released by balancing per
+// interval. Implementations backed by a broker limit releases cluster-wide.
+type ReleaseLimiter interface {
+	// Acquire requests permission to release n tasks and returns the number of
+	// releases permitted in the current interval.
+	Acquire(n int) (int, error)
+}
+
+// NewReleaseLimiter creates a ReleaseLimiter which permits max releases per
+// interval by this process only.
+func NewReleaseLimiter(max int, interval time.Duration) ReleaseLimiter {
+	return &localLimiter{max: max, interval: interval}
+}
+
+type localLimiter struct {
+	max      int
+	interval time.Duration
+
+	mu     sync.Mutex
+	window int64 // current interval
+	used   int   // releases in the current interval
+}
+
+func (l *localLimiter) Acquire(n int) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w := time.Now().UnixNano() / int64(l.interval); w != l.window {
+		l.window, l.used = w, 0
+	}
+	if n > l.max-l.used {
+		n = l.max - l.used
+	}
+	l.used += n
+	return n, nil
+}
+
+// RateLimitedBalancer wraps a Balancer to smooth rebalancing. Tasks younger
+// than a minimum age are never released so tasks don't bounce between nodes,
+// and the number of releases is limited by a ReleaseLimiter so a node joining
+// doesn't cause a flood of releases.
+type RateLimitedBalancer struct {
+	Balancer
+
+	ctx     BalancerContext
+	limiter ReleaseLimiter
+	minAge  time.Duration
+}
+
+// NewRateLimitedBalancer wraps a Balancer with a ReleaseLimiter and minimum
+// task age.
+func NewRateLimitedBalancer(b Balancer, limiter ReleaseLimiter, minAge time.Duration) Balancer {
+	return &RateLimitedBalancer{Balancer: b, limiter: limiter, minAge: minAge}
+}
+
+// Init initializes the wrapped balancer.
+func (b *RateLimitedBalancer) Init(ctx BalancerContext) {
+	b.ctx = ctx
+	b.Balancer.Init(ctx)
+}
+
+// Balance returns the wrapped balancer's releases which are old enough, up to
+// the number permitted by the ReleaseLimiter. If the limiter returns an error
+// nothing is released.
+func (b *RateLimitedBalancer) Balance() []string {
+	release := b.Balancer.Balance()
+	if len(release) == 0 {
+		return nil
+	}
+
+	started := map[string]time.Time{}
+	for _, t := range b.ctx.Tasks() {
+		started[t.ID()] = t.Started()
+	}
+	old := make([]string, 0, len(release))
+	for _, id := range release {
+		if s, ok := started[id]; ok && time.Since(s) < b.minAge {
+			Debugf("Not releasing task %s: started %s which is less than %s ago", id, s, b.minAge)
+			continue
+		}
+		old = append(old, id)
+	}
+	if len(old) == 0 {
+		return nil
+	}
+
+	n, err := b.limiter.Acquire(len(old))
+	if err != nil {
+		Warnf("Error acquiring permission to release %d tasks: %v", len(old), err)
+		return nil
+	}
+	if n < len(old) {
+		Infof("Rate limited releases from %d to %d tasks", len(old), n)
+	}
+	return old[:n]
+}
+
+// Handoff returns the node nominated by the wrapped balancer if it implements
+// HandoffBalancer.
+func (b *RateLimitedBalancer) Handoff(taskID string) string {
+	if hb, ok := b.Balancer.(HandoffBalancer); ok {
+		return hb.Handoff(taskID)
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+package metafora
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedBalancer(t *testing.T) {
+	t.Parallel()
+
+	old := newTask("old", 0, TaskProps{}, nil)
+	old.started = time.Now().Add(-time.Hour)
+	old2 := newTask("old2", 0, TaskProps{}, nil)
+	old2.started = time.Now().Add(-time.Hour)
+	young := newTask("young", 0, TaskProps{}, nil)
+
+	inner := &fakeBalancer{release: []string{"young", "old", "old2"}}
+	limiter := NewReleaseLimiter(3, time.Hour)
+	bal := NewRateLimitedBalancer(inner, limiter, time.Minute)
+	bal.Init(usageCtx{old, old2, young})
+
+	// Young tasks aren't released
+	expected := []string{"old", "old2"}
+	if release := bal.Balance(); !reflect.DeepEqual(release, expected) {
+		t.Fatalf("Expected %v to be released but found %v", expected, release)
+	}
+
+	// Only one release is left in this interval
+	expected = []string{"old"}
+	if release := bal.Balance(); !reflect.DeepEqual(release, expected) {
+		t.Fatalf("Expected %v to be released but found %v", expected, release)
+	}
+	if release := bal.Balance(); len(release) > 0 {
+		t.Fatalf("Expected nothing to be released but found %v", release)
+	}
+}
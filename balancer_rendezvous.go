@@ -0,0 +1,130 @@
+package metafora
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// RendezvousDelay is how long RendezvousBalancer sleeps before claiming a task
+// hashed to another node to give that node a chance to claim it first.
+var RendezvousDelay = 500 * time.Millisecond
+
+// NodeLister provides the set of live nodes. Client implementations satisfy
+// it.
+type NodeLister interface {
+	Nodes() ([]string, error)
+}
+
+// RendezvousBalancer assigns tasks to nodes by rendezvous (highest random
+// weight) hashing over the live node set, so tasks stay on the same node as
+// long as it's alive. This is useful for tasks with warm local caches.
+//
+// CanClaim claims tasks hashed to this node immediately and delays claiming
+// others. Balance only releases tasks hashed to this node before the node
+// set changed which are now hashed to another node, so when a node joins
+// only the tasks it now owns move and tasks claimed on behalf of other nodes
+// aren't bounced around.
+type RendezvousBalancer struct {
+	nodeid string
+	nodes  NodeLister
+	ctx    BalancerContext
+
+	// node set as of the last Balance
+	last []string
+}
+
+// NewRendezvousBalancer creates a new RendezvousBalancer.
+func NewRendezvousBalancer(nodeid string, nodes NodeLister) Balancer {
+	return &RendezvousBalancer{nodeid: nodeid, nodes: nodes}
+}
+
+// Init is called by the Consumer.
+func (b *RendezvousBalancer) Init(ctx BalancerContext) {
+	b.ctx = ctx
+	b.last, _ = b.liveNodes()
+}
+
+// CanClaim always returns true but sleeps before claiming tasks hashed to
+// other nodes.
+func (b *RendezvousBalancer) CanClaim(taskID string) bool {
+	nodes, err := b.liveNodes()
+	if err != nil {
+		Warnf("Error retrieving nodes: %v", err)
+		return true
+	}
+	if owner := rendezvousOwner(nodes, taskID); owner != b.nodeid {
+		Debugf("Task %s hashed to node %s; sleeping %s before claiming", taskID, owner, RendezvousDelay)
+		sleep(b.ctx, RendezvousDelay)
+	}
+	return true
+}
+
+// Balance releases tasks which were hashed to this node before the node set
+// changed and are now hashed to another node.
+func (b *RendezvousBalancer) Balance() []string {
+	nodes, err := b.liveNodes()
+	if err != nil {
+		Warnf("Error retrieving nodes: %v", err)
+		return nil
+	}
+	last := b.last
+	b.last = nodes
+	if last == nil {
+		return nil
+	}
+
+	release := []string{}
+	for _, t := range b.ctx.Tasks() {
+		if rendezvousOwner(last, t.ID()) != b.nodeid {
+			continue
+		}
+		if owner := rendezvousOwner(nodes, t.ID()); owner != b.nodeid {
+			Infof("Releasing task %s now hashed to node %s", t.ID(), owner)
+			release = append(release, t.ID())
+		}
+	}
+	return release
+}
+
+// liveNodes returns the node set including this node even if it hasn't
+// registered yet.
+func (b *RendezvousBalancer) liveNodes() ([]string, error) {
+	nodes, err := b.nodes.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if n == b.nodeid {
+			return nodes, nil
+		}
+	}
+	return append(nodes, b.nodeid), nil
+}
+
+// rendezvousOwner returns the node with the highest hash for the task.
+func rendezvousOwner(nodes []string, taskID string) string {
+	owner := ""
+	var max uint64
+	for _, n := range nodes {
+		if score := rendezvousHash(n, taskID); owner == "" || score > max || (score == max && n < owner) {
+			owner, max = n, score
+		}
+	}
+	return owner
+}
+
+// rendezvousHash hashes a node and task with FNV-1a followed by a 64 bit
+// finalizer to spread similar IDs across the whole range.
+func rendezvousHash(node, taskID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(node))
+	h.Write([]byte{0})
+	h.Write([]byte(taskID))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,50 @@
+package metafora
+
+import (
+	"fmt"
+	"testing"
+)
+
+type fakeNodes []string
+
+func (n *fakeNodes) Nodes() ([]string, error) { return *n, nil }
+
+func TestRendezvousBalancer(t *testing.T) {
+	t.Parallel()
+	nodes := &fakeNodes{"node1", "node2"}
+
+	// Run every task hashed to node1
+	ctx := &TestConsumerState{}
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("task%d", i)
+		if rendezvousOwner(*nodes, id) == "node1" {
+			ctx.Current = append(ctx.Current, id)
+		}
+	}
+	if len(ctx.Current) < 25 || len(ctx.Current) > 75 {
+		t.Fatalf("Poorly distributed tasks: node1 owns %d of 100", len(ctx.Current))
+	}
+
+	bal := NewRendezvousBalancer("node1", nodes)
+	bal.Init(ctx)
+	if release := bal.Balance(); len(release) > 0 {
+		t.Fatalf("Released tasks without membership changes: %v", release)
+	}
+
+	// Adding a node should only move tasks to the new node
+	*nodes = append(*nodes, "node3")
+	release := bal.Balance()
+	if len(release) == 0 {
+		t.Fatal("Expected some tasks to move to node3")
+	}
+	for _, id := range release {
+		if owner := rendezvousOwner(*nodes, id); owner != "node3" {
+			t.Errorf("Released task %s which is owned by %s", id, owner)
+		}
+	}
+
+	// Tasks already moved aren't released again
+	if release := bal.Balance(); len(release) > 0 {
+		t.Fatalf("Released tasks twice: %v", release)
+	}
+}
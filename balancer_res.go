@@ -2,6 +2,7 @@ package metafora
 
 import (
 	"fmt"
+	"sort"
 	"time"
 )
 
@@ -27,10 +28,17 @@ type ResourceReporter interface {
 // Even below the claim limit, claims are delayed by the percent of resources
 // used (in milliseconds) to give less loaded nodes a claim advantage.
 //
-// The balancer releases the oldest tasks first (skipping those who are already
-// stopping) to try to prevent rebalancing the same tasks repeatedly within a
-// cluster.
+// If Name is set and handlers implement UsageHandler to report their usage of
+// the resource under that name, the balancer releases the tasks which bring
+// the node back under the release threshold. Otherwise it releases the oldest
+// tasks first (skipping those who are already stopping) to try to prevent
+// rebalancing the same tasks repeatedly within a cluster.
 type ResourceBalancer struct {
+	// Name of the resource tasks report their usage under. Reporters' String
+	// methods return units which aren't unique (e.g. both memory reporters
+	// return "kB"), so usage is only considered if Name is set.
+	Name string
+
 	ctx      BalancerContext
 	reporter ResourceReporter
 
@@ -72,13 +80,13 @@ func (b *ResourceBalancer) CanClaim(string) bool {
 		dur := time.Duration(100+(threshold-b.claimLimit)) * time.Millisecond
 		Infof("%d is over the claim limit of %d. Used %d of %d %s. Sleeping %s before claiming.",
 			threshold, b.claimLimit, used, total, b.reporter, dur)
-		time.Sleep(dur)
+		sleep(b.ctx, dur)
 		return true
 	}
 
 	// Always sleep based on resource usage to give less loaded nodes an advantage
 	dur := time.Duration(threshold) * time.Millisecond
-	time.Sleep(dur)
+	sleep(b.ctx, dur)
 	return true
 }
 
@@ -90,20 +98,199 @@ func (b *ResourceBalancer) Balance() []string {
 		return nil
 	}
 
-	// Release the oldest task that isn't already stopping
+	release := []string{}
+	tasks, usage := releaseByUsage(b.ctx.Tasks(), b.Name, used, total, b.releaseLimit)
+	for _, task := range tasks {
+		Infof("Releasing task %s (started %s, using %d %s) because %d > %d (%d of %d %s used)",
+			task.ID(), task.Started(), usage[task.ID()], b.reporter,
+			threshold, b.releaseLimit, used, total, b.reporter)
+		release = append(release, task.ID())
+	}
+	return release
+}
+
+// releaseByUsage returns the running tasks to release to bring used under
+// limit percent of total based on the usage tasks report for the resource.
+// A single task freeing enough is preferred, using the smallest such task.
+// Otherwise the heaviest tasks are released until enough is freed.
+//
+// If the resource is unnamed or no running tasks report usage of it, the
+// oldest task is released.
+//
+// Each task's usage is read once and returned by task ID as handlers may be
+// slow to report it.
+func releaseByUsage(tasks []Task, resource string, used, total uint64, limit int) ([]Task, map[string]uint64) {
+	candidates := byUsage{usage: map[string]uint64{}}
+	for _, t := range tasks {
+		if resource == "" || !t.Stopped().IsZero() {
+			continue
+		}
+		if u := taskUsage(t)[resource]; u > 0 {
+			candidates.tasks = append(candidates.tasks, t)
+			candidates.usage[t.ID()] = u
+		}
+	}
+	if len(candidates.tasks) == 0 {
+		if task := oldestTask(tasks); task != nil {
+			return []Task{task}, candidates.usage
+		}
+		return nil, candidates.usage
+	}
+	sort.Sort(candidates)
+
+	var need uint64 = 1
+	if allowed := uint64(limit) * total / 100; used > allowed {
+		need = used - allowed + 1
+	}
+	for _, t := range candidates.tasks {
+		if candidates.usage[t.ID()] >= need {
+			return []Task{t}, candidates.usage
+		}
+	}
+
+	release := []Task{}
+	var freed uint64
+	for i := len(candidates.tasks) - 1; i >= 0 && freed < need; i-- {
+		release = append(release, candidates.tasks[i])
+		freed += candidates.usage[candidates.tasks[i].ID()]
+	}
+	return release, candidates.usage
+}
+
+// byUsage sorts tasks by ascending usage, read once per task, and then by ID.
+type byUsage struct {
+	tasks []Task
+	usage map[string]uint64 // by task ID
+}
+
+func (b byUsage) Len() int      { return len(b.tasks) }
+func (b byUsage) Swap(i, j int) { b.tasks[i], b.tasks[j] = b.tasks[j], b.tasks[i] }
+func (b byUsage) Less(i, j int) bool {
+	ui, uj := b.usage[b.tasks[i].ID()], b.usage[b.tasks[j].ID()]
+	if ui != uj {
+		return ui < uj
+	}
+	return b.tasks[i].ID() < b.tasks[j].ID()
+}
+
+// oldestTask returns the oldest task that isn't already stopping or nil if
+// there are none.
+func oldestTask(tasks []Task) Task {
 	var task Task
-	for _, t := range b.ctx.Tasks() {
+	for _, t := range tasks {
 		if t.Stopped().IsZero() && (task == nil || task.Started().After(t.Started())) {
 			task = t
 		}
 	}
+	return task
+}
 
-	// No tasks or all tasks are stopping, don't bother rebalancing
-	if task == nil {
-		return nil
+// ResourceLimit is a resource and its thresholds used by
+// MultiResourceBalancer. Limits are percentages like ResourceBalancer's.
+type ResourceLimit struct {
+	// Name of the resource tasks report their usage under and used when
+	// logging. If empty the reporter's String() is logged and usage isn't
+	// considered when releasing tasks.
+	Name string
+
+	Reporter     ResourceReporter
+	ClaimLimit   int
+	ReleaseLimit int
+}
+
+func (l ResourceLimit) String() string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return l.Reporter.String()
+}
+
+// usage returns the percent of the resource used.
+func (l ResourceLimit) usage() (threshold int, used, total uint64) {
+	used, total = l.Reporter.Used()
+	if total == 0 {
+		return 0, used, total
+	}
+	return int(float32(used) / float32(total) * 100), used, total
+}
+
+// MultiResourceBalancer is like ResourceBalancer but balances on multiple
+// resources, each with their own limits. Tasks are only claimed while every
+// resource is under its claim limit, and tasks are released when any resource
+// is over its release limit.
+//
+// Like ResourceBalancer, claims are delayed by the highest percent of
+// resources used (in milliseconds) to give less loaded nodes a claim
+// advantage.
+type MultiResourceBalancer struct {
+	ctx    BalancerContext
+	limits []ResourceLimit
+}
+
+// NewMultiResourceBalancer creates a new MultiResourceBalancer or returns an
+// error if any limits are invalid.
+func NewMultiResourceBalancer(limits ...ResourceLimit) (*MultiResourceBalancer, error) {
+	if len(limits) == 0 {
+		return nil, fmt.Errorf("At least one resource limit is required.")
+	}
+	for _, l := range limits {
+		if l.ClaimLimit < 1 || l.ClaimLimit > 100 || l.ReleaseLimit < 1 || l.ReleaseLimit > 100 {
+			return nil, fmt.Errorf("%s limits must be between 1 and 100. claim=%d release=%d", l, l.ClaimLimit, l.ReleaseLimit)
+		}
+		if l.ClaimLimit >= l.ReleaseLimit {
+			return nil, fmt.Errorf("%s claim threshold must be < release threshold. claim=%d >= release=%d", l, l.ClaimLimit, l.ReleaseLimit)
+		}
+	}
+	return &MultiResourceBalancer{limits: limits}, nil
+}
+
+func (b *MultiResourceBalancer) Init(ctx BalancerContext) {
+	b.ctx = ctx
+}
+
+// CanClaim returns false if any resource is over its claim limit. Since
+// rejected tasks may be offered again immediately (see #93), it sleeps before
+// rejecting.
+func (b *MultiResourceBalancer) CanClaim(string) bool {
+	max := 0
+	for _, l := range b.limits {
+		threshold, used, total := l.usage()
+		if threshold >= l.ClaimLimit {
+			dur := time.Duration(100+(threshold-l.ClaimLimit)) * time.Millisecond
+			Infof("%s %d is over the claim limit of %d. Used %d of %d. Sleeping %s before rejecting.",
+				l, threshold, l.ClaimLimit, used, total, dur)
+			sleep(b.ctx, dur)
+			return false
+		}
+		if threshold > max {
+			max = threshold
+		}
+	}
+
+	// Always sleep based on resource usage to give less loaded nodes an advantage
+	sleep(b.ctx, time.Duration(max)*time.Millisecond)
+	return true
+}
+
+// Balance releases tasks if any resource is over its release limit. Tasks
+// are chosen by their reported usage of that resource like ResourceBalancer.
+func (b *MultiResourceBalancer) Balance() []string {
+	for _, l := range b.limits {
+		threshold, used, total := l.usage()
+		if threshold < l.ReleaseLimit {
+			continue
+		}
+
+		release := []string{}
+		tasks, usage := releaseByUsage(b.ctx.Tasks(), l.Name, used, total, l.ReleaseLimit)
+		for _, task := range tasks {
+			Infof("Releasing task %s (started %s, using %d) because %s %d > %d (%d of %d used)",
+				task.ID(), task.Started(), usage[task.ID()], l, threshold, l.ReleaseLimit, used, total)
+			release = append(release, task.ID())
+		}
+		return release
 	}
 
-	Infof("Releasing task %s (started %s) because %d > %d (%d of %d %s used)",
-		task.ID(), task.Started(), threshold, b.releaseLimit, used, total, b.reporter)
-	return []string{task.ID()}
+	// We're below every limit! Don't release anything.
+	return nil
 }
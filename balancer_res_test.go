@@ -1,6 +1,10 @@
 package metafora
 
-import "testing"
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
 
 type fakeReporter struct {
 	used  uint64
@@ -54,3 +58,134 @@ func TestResourceBalancer(t *testing.T) {
 		t.Errorf("Until #93 is fixed, CanClaim should always return true")
 	}
 }
+
+func TestMultiResourceBalancer(t *testing.T) {
+	t.Parallel()
+
+	mem := &fakeReporter{used: 10, total: 100}
+	fds := &fakeReporter{used: 10, total: 100}
+	_, err := NewMultiResourceBalancer(
+		ResourceLimit{Name: "mem", Reporter: mem, ClaimLimit: 80, ReleaseLimit: 90},
+		ResourceLimit{Name: "fds", Reporter: fds, ClaimLimit: 90, ReleaseLimit: 80},
+	)
+	if err == nil {
+		t.Fatal("Expected an error: release threshold was lower than claim.")
+	}
+
+	bal, err := NewMultiResourceBalancer(
+		ResourceLimit{Name: "mem", Reporter: mem, ClaimLimit: 80, ReleaseLimit: 90},
+		ResourceLimit{Name: "fds", Reporter: fds, ClaimLimit: 50, ReleaseLimit: 60},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error creating resource balancer: %v", err)
+	}
+	bal.Init(&TestConsumerState{Current: []string{"1", "2"}})
+
+	if !bal.CanClaim("t") {
+		t.Error("Expected claim while all resources are under their limits")
+	}
+	if release := bal.Balance(); len(release) > 0 {
+		t.Errorf("Released tasks when we were well below limits! %v", release)
+	}
+
+	// Only one resource must trip to stop claiming and release
+	fds.used = 55
+	if bal.CanClaim("t") {
+		t.Error("Expected claim to be rejected when fds are over their claim limit")
+	}
+	if release := bal.Balance(); len(release) > 0 {
+		t.Errorf("Released tasks when below release limits! %v", release)
+	}
+	fds.used = 61
+	if release := bal.Balance(); len(release) != 1 {
+		t.Errorf("Expected 1 released task but found: %v", release)
+	}
+}
+
+type usageHandler struct {
+	simpleHandler
+	usage  map[string]uint64
+	calls  int
+	panics bool
+}
+
+func (h *usageHandler) Usage() map[string]uint64 {
+	h.calls++
+	if h.panics {
+		panic("usage")
+	}
+	return h.usage
+}
+
+type usageCtx []Task
+
+func (ctx usageCtx) Tasks() []Task { return ctx }
+
+func TestResourceBalancerUsage(t *testing.T) {
+	t.Parallel()
+
+	fr := &fakeReporter{used: 950, total: 1000}
+	bal, err := NewResourceBalancer(fr, 80, 90)
+	if err != nil {
+		t.Fatalf("Unexpected error creating resource balancer: %v", err)
+	}
+	newUsageTask := func(id string, used uint64) Task {
+		return newTask(id, 0, TaskProps{}, &usageHandler{usage: map[string]uint64{"fakes": used}})
+	}
+	bal.Init(usageCtx{
+		newUsageTask("small", 10),
+		newUsageTask("enough", 60),
+		newUsageTask("huge", 500),
+		newTask("unknown", 0, TaskProps{}, nil),
+	})
+
+	// Usage is ignored unless the resource is named
+	if release := bal.Balance(); len(release) != 1 || release[0] != "small" {
+		t.Errorf("Expected oldest task to be released but found: %v", release)
+	}
+	bal.Name = "fakes"
+
+	// 51 must be freed to get under 90%; enough is the smallest task to do so
+	if release := bal.Balance(); len(release) != 1 || release[0] != "enough" {
+		t.Errorf("Expected enough to be released but found: %v", release)
+	}
+
+	// No single task frees enough so release the heaviest
+	fr.used = 1000
+	bal.Init(usageCtx{newUsageTask("a", 40), newUsageTask("b", 30), newUsageTask("c", 50)})
+	expected := []string{"c", "a", "b"}
+	if release := bal.Balance(); !reflect.DeepEqual(release, expected) {
+		t.Errorf("Expected %v to be released but found: %v", expected, release)
+	}
+}
+
+// TestResourceBalancerUsageOnce ensures usage is read once per task per
+// Balance and handlers panicking in Usage don't crash the balancer.
+func TestResourceBalancerUsageOnce(t *testing.T) {
+	t.Parallel()
+
+	bal, err := NewResourceBalancer(&fakeReporter{used: 1000, total: 1000}, 80, 90)
+	if err != nil {
+		t.Fatalf("Unexpected error creating resource balancer: %v", err)
+	}
+	bal.Name = "fakes"
+	handlers := []*usageHandler{}
+	tasks := usageCtx{}
+	for i, used := range []uint64{40, 30, 50, 20, 10} {
+		h := &usageHandler{usage: map[string]uint64{"fakes": used}}
+		handlers = append(handlers, h)
+		tasks = append(tasks, newTask(fmt.Sprintf("t%d", i), 0, TaskProps{}, h))
+	}
+	handlers[4].panics = true
+	bal.Init(tasks)
+
+	expected := []string{"t2", "t0", "t1"}
+	if release := bal.Balance(); !reflect.DeepEqual(release, expected) {
+		t.Errorf("Expected %v to be released but found: %v", expected, release)
+	}
+	for i, h := range handlers {
+		if h.calls != 1 {
+			t.Errorf("Expected Usage of t%d to be called once but found %d calls", i, h.calls)
+		}
+	}
+}
@@ -34,6 +34,6 @@ func (*SleepBalancer) Balance() []string { return nil }
 // CanClaim sleeps 30ms per claimed task.
 func (b *SleepBalancer) CanClaim(string) bool {
 	num := len(b.ctx.Tasks())
-	time.Sleep(time.Duration(num) * sleepBalLen)
+	sleep(b.ctx, time.Duration(num)*sleepBalLen)
 	return true
 }
@@ -109,7 +109,7 @@ type TestConsumerState struct {
 func (tc *TestConsumerState) Tasks() []Task {
 	tasks := []Task{}
 	for _, id := range tc.Current {
-		tasks = append(tasks, newTask(id, nil))
+		tasks = append(tasks, newTask(id, 0, TaskProps{}, nil))
 	}
 	return tasks
 }
@@ -124,7 +124,7 @@ type sbCtx struct {
 func (ctx *sbCtx) Tasks() []Task {
 	tasks := []Task{}
 	for _, id := range ctx.tasks {
-		tasks = append(tasks, newTask(id, nil))
+		tasks = append(tasks, newTask(id, 0, TaskProps{}, nil))
 	}
 	return tasks
 }
@@ -160,3 +160,38 @@ func TestSleepBalancer(t *testing.T) {
 		t.Fatalf("SleepBalancer went a worrying amount over the expected time: %s > %s", post, minimum)
 	}
 }
+
+type viewCtx struct {
+	TestConsumerState
+	view ClusterView
+}
+
+func (ctx *viewCtx) Cluster() (ClusterView, error) { return ctx.view, nil }
+func (*viewCtx) Frozen() bool                      { return false }
+
+func TestFairBalancerClusterView(t *testing.T) {
+	t.Parallel()
+	ctx := &viewCtx{
+		TestConsumerState: TestConsumerState{[]string{"1", "2", "3", "4", "5"}},
+		view: ClusterView{
+			NodeID:    "node1",
+			Nodes:     []string{"node1", "node2"},
+			NodeTasks: map[string]int{"node1": 10, "node2": 2},
+		},
+	}
+
+	fb := NewFairBalancer()
+	fb.Init(ctx)
+
+	expect := 2
+	rebalance := fb.Balance()
+	if len(rebalance) != expect {
+		t.Fatalf("Expected %d rebalanced tasks, received %d", expect, len(rebalance))
+	}
+
+	// Without a view nothing is released
+	fb.Init(&TestConsumerState{[]string{"1", "2", "3", "4", "5"}})
+	if rebalance := fb.Balance(); len(rebalance) != 0 {
+		t.Fatalf("Expected 0 rebalanced tasks without a cluster view: %v", rebalance)
+	}
+}
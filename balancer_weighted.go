@@ -0,0 +1,133 @@
+package metafora
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// WeightedClusterState is a ClusterState which can also report the summed
+// TaskProps weight of tasks claimed by each node.
+type WeightedClusterState interface {
+	ClusterState
+
+	// NodeTaskWeight returns the summed weight of tasks claimed by each node.
+	NodeTaskWeight() (map[string]float64, error)
+}
+
+// NewWeightedFairBalancer creates a new WeightedFairBalancer with the default
+// 120% release threshold.
+func NewWeightedFairBalancer(nodeid string, cs WeightedClusterState) Balancer {
+	return NewWeightedFairBalancerWithThreshold(nodeid, cs, defaultThreshold)
+}
+
+// NewWeightedFairBalancerWithThreshold allows callers to override
+// WeightedFairBalancer's default 120% weight release threshold.
+func NewWeightedFairBalancerWithThreshold(nodeid string, cs WeightedClusterState, threshold float64) Balancer {
+	return &WeightedFairBalancer{
+		nodeid:           nodeid,
+		clusterstate:     cs,
+		releaseThreshold: threshold,
+		lastreleased:     map[string]bool{},
+	}
+}
+
+// WeightedFairBalancer is like FairBalancer but balances the summed weight
+// of tasks instead of their count. When this node's weight exceeds some
+// percentage of the cluster average (default 120%) it chooses the tasks whose
+// release brings the node's weight closest to that target.
+//
+// Like FairBalancer it claims all tasks but delays claiming tasks it released
+// on the last call to Balance.
+type WeightedFairBalancer struct {
+	nodeid string
+
+	bc           BalancerContext
+	clusterstate WeightedClusterState
+
+	releaseThreshold float64
+
+	lastreleased map[string]bool
+}
+
+func (e *WeightedFairBalancer) Init(s BalancerContext) {
+	e.bc = s
+}
+
+// CanClaim will claim all tasks, but will add a sleep to block claiming
+// released tasks in order to give other nodes a chance to claim them first
+func (e *WeightedFairBalancer) CanClaim(taskid string) bool {
+	if e.lastreleased[taskid] {
+		sleep(e.bc, 500*time.Millisecond)
+	}
+	return true
+}
+
+// Balance releases tasks if this node's weight is greater than 120% of the
+// average node's weight in the cluster.
+func (e *WeightedFairBalancer) Balance() []string {
+	e.lastreleased = map[string]bool{}
+	current, err := e.clusterstate.NodeTaskWeight()
+	if err != nil {
+		Warnf("Error retrieving cluster state: %v", err)
+		return nil
+	}
+
+	excess := current[e.nodeid] - e.desiredWeight(current)
+	if excess <= 0 {
+		return nil
+	}
+
+	releasetasks := chooseWeighted(e.bc.Tasks(), excess)
+	for _, tid := range releasetasks {
+		e.lastreleased[tid] = true
+	}
+	return releasetasks
+}
+
+// Retrieve the desired maximum weight, based on current cluster state
+func (e *WeightedFairBalancer) desiredWeight(current map[string]float64) float64 {
+	if len(current) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, w := range current {
+		total += w
+	}
+	return total / float64(len(current)) * e.releaseThreshold
+}
+
+// chooseWeighted returns the IDs of tasks whose summed weight is near excess.
+// Each round the task which leaves the smallest remaining excess is chosen
+// until no task would bring the remaining excess closer to zero, so a single
+// heavy task isn't released to shed a small excess.
+func chooseWeighted(tasks []Task, excess float64) []string {
+	remaining := make([]Task, len(tasks))
+	copy(remaining, tasks)
+	sort.Sort(byID(remaining))
+
+	release := []string{}
+	for excess > 0 {
+		best := -1
+		bestDiff := excess
+		for i, t := range remaining {
+			if diff := math.Abs(excess - taskProps(t).TaskWeight()); diff < bestDiff {
+				best, bestDiff = i, diff
+			}
+		}
+		if best == -1 {
+			break
+		}
+		release = append(release, remaining[best].ID())
+		excess -= taskProps(remaining[best]).TaskWeight()
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return release
+}
+
+// byID sorts tasks by ID so ties are broken consistently.
+type byID []Task
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byID) Less(i, j int) bool { return b[i].ID() < b[j].ID() }
@@ -0,0 +1,75 @@
+package metafora
+
+import (
+	"reflect"
+	"testing"
+)
+
+var _ WeightedClusterState = (*weightedClusterState)(nil)
+
+type weightedClusterState struct {
+	Current map[string]float64
+}
+
+func (ws *weightedClusterState) NodeTaskCount() (map[string]int, error) {
+	counts := map[string]int{}
+	for node, w := range ws.Current {
+		counts[node] = int(w)
+	}
+	return counts, nil
+}
+
+func (ws *weightedClusterState) NodeTaskWeight() (map[string]float64, error) {
+	return ws.Current, nil
+}
+
+type weightedCtx map[string]float64
+
+func (ctx weightedCtx) Tasks() []Task {
+	tasks := []Task{}
+	for id, w := range ctx {
+		tasks = append(tasks, newTask(id, 0, TaskProps{Weight: w}, nil))
+	}
+	return tasks
+}
+
+func TestWeightedFairBalancer(t *testing.T) {
+	t.Parallel()
+
+	// node1 has 62 weight; the average is 31 so the target is 37.2
+	cs := &weightedClusterState{Current: map[string]float64{"node1": 62, "node2": 0}}
+	ctx := weightedCtx{"heavy": 50, "a": 5, "b": 4, "c": 2, "d": 1}
+
+	bal := NewWeightedFairBalancer("node1", cs)
+	bal.Init(ctx)
+
+	// Releasing heavy would overshoot by more than keeping it
+	expected := []string{"a", "b", "c", "d"}
+	if release := bal.Balance(); !reflect.DeepEqual(release, expected) {
+		t.Fatalf("Expected %v to be released but found: %v", expected, release)
+	}
+
+	// node1 has 100 weight; the average is 50 so the target is 60
+	cs.Current = map[string]float64{"node1": 100, "node2": 0}
+	ctx["heavy2"] = 38
+	expected = []string{"heavy2", "c"}
+	if release := bal.Balance(); !reflect.DeepEqual(release, expected) {
+		t.Fatalf("Expected %v to be released but found: %v", expected, release)
+	}
+
+	// Balanced clusters release nothing
+	cs.Current = map[string]float64{"node1": 100, "node2": 90}
+	if release := bal.Balance(); len(release) != 0 {
+		t.Fatalf("Expected nothing to be released but found: %v", release)
+	}
+}
+
+func TestTaskWeightDefault(t *testing.T) {
+	t.Parallel()
+	if w := (TaskProps{}).TaskWeight(); w != 1 {
+		t.Errorf("Expected unset weight to be 1 but found %f", w)
+	}
+	if w := (TaskProps{Weight: 2.5}).TaskWeight(); w != 2.5 {
+		t.Errorf("Expected weight to be 2.5 but found %f", w)
+	}
+}
@@ -0,0 +1,58 @@
+package metafora
+
+import "errors"
+
+// ErrStaleClaim is returned by Checkpointers when the task has been claimed
+// again since the claim writing the checkpoint.
+var ErrStaleClaim = errors.New("task has been claimed by another owner")
+
+// Checkpointer stores opaque progress with a task in the broker so the next
+// owner of the task can resume where the last left off.
+type Checkpointer interface {
+	// Checkpoint replaces the task's stored checkpoint. It returns
+	// ErrStaleClaim if the task has since been claimed by another owner.
+	Checkpoint(data []byte) error
+
+	// Restore returns the task's last checkpoint or nil if it has none.
+	// Checkpoints survive Release and lost claims but not Done.
+	Restore() ([]byte, error)
+}
+
+// CheckpointTask is an optional interface Tasks may implement to provide
+// handlers with a Checkpointer. The Consumer's Tasks implement it.
+type CheckpointTask interface {
+	Task
+
+	// Checkpointer stores progress with the task or is nil if the Coordinator
+	// doesn't implement CheckpointCoordinator.
+	Checkpointer() Checkpointer
+}
+
+// CheckpointCoordinator is an optional interface Coordinators may implement to
+// provide handlers with a Checkpointer via CheckpointTask.
+type CheckpointCoordinator interface {
+	Coordinator
+
+	// Checkpoint replaces the checkpoint stored with a task if the claim with
+	// the given fencing token still owns it, otherwise it returns
+	// ErrStaleClaim.
+	Checkpoint(taskID string, token uint64, data []byte) error
+
+	// Restore returns the checkpoint stored with a task or nil if it has none.
+	Restore(taskID string) ([]byte, error)
+}
+
+// checkpointer binds a CheckpointCoordinator to a single claim of a task.
+type checkpointer struct {
+	cc     CheckpointCoordinator
+	taskID string
+	token  uint64
+}
+
+func (c *checkpointer) Checkpoint(data []byte) error {
+	return c.cc.Checkpoint(c.taskID, c.token, data)
+}
+
+func (c *checkpointer) Restore() ([]byte, error) {
+	return c.cc.Restore(c.taskID)
+}
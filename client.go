@@ -13,3 +13,25 @@ type Client interface {
 	// Nodes retrieves the current set of registered nodes.
 	Nodes() ([]string, error)
 }
+
+// PropsClient is an optional interface Clients may implement to store
+// TaskProps with submitted tasks.
+type PropsClient interface {
+	Client
+
+	// SubmitTaskProps submits a task with properties to the system. Like
+	// SubmitTask the task id must be unique.
+	SubmitTaskProps(taskId string, props TaskProps) error
+}
+
+// GroupClient is an optional interface Clients may implement to manage group
+// quotas and report their usage.
+type GroupClient interface {
+	Client
+
+	// SetGroupQuota sets the quota enforced for a group's tasks.
+	SetGroupQuota(group string, quota GroupQuota) error
+
+	// Groups returns the quota and usage of every group with a quota or tasks.
+	Groups() (map[string]GroupStatus, error)
+}
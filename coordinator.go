@@ -9,6 +9,12 @@ type CoordinatorContext interface {
 	// Since this implies there is a window of time where the task is executing
 	// more than once, this is a sign of an unhealthy cluster.
 	Lost(taskID string)
+
+	// NodesChanged is called by the Coordinator when a node joins or leaves the
+	// cluster. The Consumer will balance once membership stops changing instead
+	// of waiting for the next periodic balance. Coordinators which can't
+	// detect membership changes needn't call it.
+	NodesChanged()
 }
 
 // Coordinator is the core interface Metafora uses to discover, claim, and
@@ -46,6 +52,40 @@ type Coordinator interface {
 	Close()
 }
 
+// FencingCoordinator is an optional interface Coordinators may implement to
+// generate a fencing token for every successful claim. A task's tokens must
+// increase monotonically so handlers can pass them to downstream stores which
+// reject writes from stale owners with lower tokens.
+//
+// The Consumer calls FencedClaim instead of Claim when it's implemented.
+type FencingCoordinator interface {
+	Coordinator
+
+	// FencedClaim is like Claim but also returns the claim's fencing token.
+	FencedClaim(taskID string) (token uint64, ok bool)
+}
+
+// PropsCoordinator is an optional interface Coordinators may implement to
+// provide the TaskProps stored with tasks.
+type PropsCoordinator interface {
+	Coordinator
+
+	// Props is called by the Consumer after a task is claimed and before its
+	// handler is started. Tasks without properties should return the zero
+	// value.
+	Props(taskID string) TaskProps
+}
+
+// ClusterCoordinator is an optional interface Coordinators may implement to
+// provide Balancers with a view of the cluster via BalancerContext.
+type ClusterCoordinator interface {
+	Coordinator
+
+	// Cluster returns a snapshot of this node's ID, the live nodes, the
+	// number of tasks each has claimed, and the number of unclaimed tasks.
+	Cluster() (ClusterView, error)
+}
+
 type coordinatorContext struct {
 	*Consumer
 }
@@ -56,3 +96,12 @@ func (ctx *coordinatorContext) Lost(taskID string) {
 	Errorf("Lost task %s", taskID)
 	ctx.stopTask(taskID)
 }
+
+// NodesChanged signals the Consumer to balance soon. Calls while a balance is
+// already pending are coalesced.
+func (ctx *coordinatorContext) NodesChanged() {
+	select {
+	case ctx.nodesChanged <- struct{}{}:
+	default:
+	}
+}
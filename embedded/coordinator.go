@@ -8,7 +8,15 @@ import (
 )
 
 func NewEmbeddedCoordinator(nodeid string, taskchan chan string, cmdchan chan *NodeCommand, nodechan chan []string) metafora.Coordinator {
-	e := &EmbeddedCoordinator{inchan: taskchan, cmdchan: cmdchan, stopchan: make(chan struct{}), nodechan: nodechan}
+	e := &EmbeddedCoordinator{
+		nodeid:      nodeid,
+		inchan:      taskchan,
+		cmdchan:     cmdchan,
+		stopchan:    make(chan struct{}),
+		nodechan:    nodechan,
+		owners:      make(map[string]uint64),
+		checkpoints: make(map[string][]byte),
+	}
 	// HACK - need to respond to node requests, assuming a single coordinator/client pair
 	go func() {
 		for {
@@ -34,6 +42,16 @@ type EmbeddedCoordinator struct {
 
 	bl      sync.Mutex
 	backlog []string
+	claimed int // tasks claimed and not yet released or done
+
+	// last fencing token issued
+	tokenL sync.Mutex
+	token  uint64
+
+	// fencing token of each task's current claim and its last checkpoint
+	cpL         sync.Mutex
+	owners      map[string]uint64
+	checkpoints map[string][]byte
 }
 
 func (e *EmbeddedCoordinator) Init(c metafora.CoordinatorContext) error {
@@ -65,10 +83,52 @@ func (e *EmbeddedCoordinator) Watch() (taskID string, err error) {
 
 func (e *EmbeddedCoordinator) Claim(taskID string) bool {
 	// We recieved on a channel, we are the only ones to pull that value
+	e.bl.Lock()
+	e.claimed++
+	e.bl.Unlock()
 	return true
 }
 
+// FencedClaim claims a task and returns a fencing token greater than any
+// previously issued by this coordinator.
+func (e *EmbeddedCoordinator) FencedClaim(taskID string) (uint64, bool) {
+	e.tokenL.Lock()
+	defer e.tokenL.Unlock()
+	e.token++
+	e.cpL.Lock()
+	e.owners[taskID] = e.token
+	e.cpL.Unlock()
+	return e.token, e.Claim(taskID)
+}
+
+// Checkpoint stores a copy of data with the task if the claim with the given
+// fencing token still owns it.
+func (e *EmbeddedCoordinator) Checkpoint(taskID string, token uint64, data []byte) error {
+	e.cpL.Lock()
+	defer e.cpL.Unlock()
+	if owner, ok := e.owners[taskID]; !ok || owner != token {
+		return metafora.ErrStaleClaim
+	}
+	e.checkpoints[taskID] = append([]byte(nil), data...)
+	return nil
+}
+
+// Restore returns a copy of the task's last checkpoint or nil if it has none.
+func (e *EmbeddedCoordinator) Restore(taskID string) ([]byte, error) {
+	e.cpL.Lock()
+	defer e.cpL.Unlock()
+	data, ok := e.checkpoints[taskID]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), data...), nil
+}
+
 func (e *EmbeddedCoordinator) Release(taskID string) {
+	e.unclaim()
+	e.cpL.Lock()
+	delete(e.owners, taskID)
+	e.cpL.Unlock()
 	select {
 	case e.inchan <- taskID:
 	case <-e.stopchan:
@@ -80,7 +140,34 @@ func (e *EmbeddedCoordinator) Release(taskID string) {
 	}
 }
 
-func (e *EmbeddedCoordinator) Done(taskID string) {}
+func (e *EmbeddedCoordinator) Done(taskID string) {
+	e.unclaim()
+	e.cpL.Lock()
+	delete(e.owners, taskID)
+	delete(e.checkpoints, taskID)
+	e.cpL.Unlock()
+}
+
+func (e *EmbeddedCoordinator) unclaim() {
+	e.bl.Lock()
+	if e.claimed > 0 {
+		e.claimed--
+	}
+	e.bl.Unlock()
+}
+
+// Cluster returns a view of the cluster for Balancers. The embedded
+// coordinator is always a cluster of one node.
+func (e *EmbeddedCoordinator) Cluster() (metafora.ClusterView, error) {
+	e.bl.Lock()
+	defer e.bl.Unlock()
+	return metafora.ClusterView{
+		NodeID:    e.nodeid,
+		Nodes:     []string{e.nodeid},
+		NodeTasks: map[string]int{e.nodeid: e.claimed},
+		Backlog:   len(e.backlog) + len(e.inchan),
+	}, nil
+}
 
 func (e *EmbeddedCoordinator) Command() (metafora.Command, error) {
 	select {
@@ -95,6 +95,87 @@ func TestEmbeddedShutdown(t *testing.T) {
 	}
 }
 
+// TestEmbeddedTokens ensures every claim receives a greater fencing token.
+func TestEmbeddedTokens(t *testing.T) {
+	tokens := make(chan uint64, 4)
+	thfunc := metafora.SimpleTaskHandler(func(task metafora.Task, _ <-chan bool) bool {
+		tokens <- task.(metafora.FencedTask).Token()
+		return true
+	})
+
+	coord, client := NewEmbeddedPair("testnode")
+	runner, _ := metafora.NewConsumer(coord, thfunc, &metafora.DumbBalancer{})
+	go runner.Run()
+	defer runner.Shutdown()
+
+	// Submit tasks serially so tokens are received in order
+	last := uint64(0)
+	for _, taskid := range []string{"one", "two", "three", "four"} {
+		if err := client.SubmitTask(taskid); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		select {
+		case token := <-tokens:
+			if token <= last {
+				t.Fatalf("Expected token > %d but received %d", last, token)
+			}
+			last = token
+		case <-time.After(time.Second):
+			t.Fatalf("Handler for %s didn't run", taskid)
+		}
+	}
+}
+
+// TestEmbeddedCheckpoint ensures checkpoints are restored by the next claim
+// after a release and stale claims can't overwrite them.
+func TestEmbeddedCheckpoint(t *testing.T) {
+	type run struct {
+		restored []byte
+		cp       metafora.Checkpointer
+	}
+	runs := make(chan run, 2)
+	thfunc := metafora.SimpleTaskHandler(func(task metafora.Task, _ <-chan bool) bool {
+		cp := task.(metafora.CheckpointTask).Checkpointer()
+		restored, err := cp.Restore()
+		if err != nil {
+			t.Errorf("Error restoring checkpoint: %v", err)
+		}
+		if err := cp.Checkpoint([]byte("progress")); err != nil {
+			t.Errorf("Error checkpointing: %v", err)
+		}
+		runs <- run{restored: restored, cp: cp}
+
+		// Release the first run and finish the second
+		return restored != nil
+	})
+
+	coord, client := NewEmbeddedPair("testnode")
+	runner, _ := metafora.NewConsumer(coord, thfunc, &metafora.DumbBalancer{})
+	go runner.Run()
+	defer runner.Shutdown()
+
+	if err := client.SubmitTask("task"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var first, second run
+	for _, r := range []*run{&first, &second} {
+		select {
+		case *r = <-runs:
+		case <-time.After(time.Second):
+			t.Fatal("Handler didn't run")
+		}
+	}
+	if first.restored != nil {
+		t.Errorf("Expected no checkpoint on first claim but found %q", first.restored)
+	}
+	if string(second.restored) != "progress" {
+		t.Errorf("Expected checkpoint to be restored but found %q", second.restored)
+	}
+	if err := first.cp.Checkpoint([]byte("stale")); err != metafora.ErrStaleClaim {
+		t.Errorf("Expected ErrStaleClaim from stale claim but found: %v", err)
+	}
+}
+
 func newTestCounter() *testcounter {
 	return &testcounter{runs: []string{}}
 }
@@ -0,0 +1,93 @@
+package metafora
+
+import (
+	"fmt"
+	"math"
+)
+
+// GroupQuota limits the tasks of a group (or tenant) running across the
+// cluster. Tasks are assigned to groups by TaskProps.Group.
+type GroupQuota struct {
+	// MaxRunning is the maximum number of the group's tasks which may run
+	// concurrently. Zero is unlimited.
+	MaxRunning int `json:"max_running,omitempty"`
+
+	// Share of running tasks the group is entitled to relative to other groups
+	// while tasks from multiple groups are waiting. Zero is treated as 1.
+	Share float64 `json:"share,omitempty"`
+}
+
+// GroupShare returns the group's share or 1 if no share was set.
+func (q GroupQuota) GroupShare() float64 {
+	if q.Share <= 0 {
+		return 1
+	}
+	return q.Share
+}
+
+// GroupCoordinator is an optional interface Coordinators which enforce
+// GroupQuotas implement. The Consumer logs an error for each claimed task
+// with a Group if its Coordinator doesn't, as the group's quota isn't
+// enforced.
+type GroupCoordinator interface {
+	Coordinator
+
+	// Groups returns the quota and usage of every group with a quota or tasks.
+	Groups() (map[string]GroupStatus, error)
+}
+
+// GroupStatus is a group's quota and its number of running and waiting
+// (unclaimed) tasks.
+type GroupStatus struct {
+	Quota   GroupQuota `json:"quota"`
+	Running int        `json:"running"`
+	Waiting int        `json:"waiting"`
+}
+
+// fairShare returns the number of running tasks the group is entitled to out
+// of total running tasks given shares summed across groups with tasks.
+func (s GroupStatus) fairShare(total int, shares float64) int {
+	return int(math.Ceil(float64(total) * s.Quota.GroupShare() / shares))
+}
+
+// CheckGroupQuota returns an error if claiming another of group's tasks would
+// exceed its MaxRunning quota or its fair share of running tasks while
+// another group with waiting tasks is below its own fair share. Tasks without
+// a group are never limited.
+func CheckGroupQuota(group string, groups map[string]GroupStatus) error {
+	if group == "" {
+		return nil
+	}
+	g := groups[group]
+	if g.Quota.MaxRunning > 0 && g.Running >= g.Quota.MaxRunning {
+		return fmt.Errorf("group %s has %d of %d tasks running", group, g.Running, g.Quota.MaxRunning)
+	}
+
+	// Fair share is calculated as if the claim succeeded
+	total := g.Running + 1
+	shares := g.Quota.GroupShare()
+	for name, s := range groups {
+		if name != group && s.Running+s.Waiting > 0 {
+			total += s.Running
+			shares += s.Quota.GroupShare()
+		}
+	}
+	if g.Running < g.fairShare(total, shares) {
+		return nil
+	}
+
+	// Over its fair share; only refuse if another group is being starved
+	for name, s := range groups {
+		if name == group || s.Waiting == 0 {
+			continue
+		}
+		if s.Quota.MaxRunning > 0 && s.Running >= s.Quota.MaxRunning {
+			continue
+		}
+		if s.Running < s.fairShare(total, shares) {
+			return fmt.Errorf("group %s has %d tasks running which exceeds its fair share while group %s has %d waiting",
+				group, g.Running, name, s.Waiting)
+		}
+	}
+	return nil
+}
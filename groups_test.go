@@ -0,0 +1,49 @@
+package metafora
+
+import "testing"
+
+func TestCheckGroupQuota(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		group  string
+		groups map[string]GroupStatus
+		ok     bool
+	}{
+		{"ungrouped", "", nil, true},
+		{"unknown group", "a", nil, true},
+		{"under max", "a", map[string]GroupStatus{
+			"a": {Quota: GroupQuota{MaxRunning: 2}, Running: 1, Waiting: 3},
+		}, true},
+		{"at max", "a", map[string]GroupStatus{
+			"a": {Quota: GroupQuota{MaxRunning: 2}, Running: 2, Waiting: 3},
+		}, false},
+		{"first claims", "a", map[string]GroupStatus{
+			"a": {Waiting: 1},
+			"b": {Waiting: 1},
+		}, true},
+		{"over share with other waiting", "a", map[string]GroupStatus{
+			"a": {Running: 2, Waiting: 1},
+			"b": {Waiting: 1},
+		}, false},
+		{"over share without other waiting", "a", map[string]GroupStatus{
+			"a": {Running: 2, Waiting: 1},
+			"b": {Running: 1},
+		}, true},
+		{"over share with other at max", "a", map[string]GroupStatus{
+			"a": {Running: 2, Waiting: 1},
+			"b": {Quota: GroupQuota{MaxRunning: 1}, Running: 1, Waiting: 5},
+		}, true},
+		{"weighted share", "a", map[string]GroupStatus{
+			"a": {Quota: GroupQuota{Share: 3}, Running: 2, Waiting: 1},
+			"b": {Running: 1, Waiting: 1},
+		}, true},
+	}
+	for _, test := range tests {
+		err := CheckGroupQuota(test.group, test.groups)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: expected ok=%t but found error: %v", test.name, test.ok, err)
+		}
+	}
+}
@@ -28,6 +28,33 @@ type Handler interface {
 	Stop()
 }
 
+// TaskHandler is an optional interface Handlers may implement to receive their
+// Task before Run is called. Handlers should pass the Task's fencing token to
+// any downstream stores which support fencing.
+//
+// The Consumer's Tasks implement FencedTask, PropsTask, UsageTask,
+// HandoffTask, CheckpointTask, ProgressTask, and HeartbeatTask.
+type TaskHandler interface {
+	Handler
+
+	// Init is called once before Run.
+	Init(Task)
+}
+
+// UsageHandler is an optional interface Handlers may implement to report the
+// resources their task is using. Balancers like ResourceBalancer use it to
+// release the tasks which free the most useful amount of a resource.
+type UsageHandler interface {
+	Handler
+
+	// Usage returns the amount of each resource used by the task keyed by
+	// resource. Keys should match the Name of the ResourceBalancer or
+	// ResourceLimit used for balancing.
+	//
+	// Usage is called concurrently with Run.
+	Usage() map[string]uint64
+}
+
 // HandlerFunc is called by the Consumer to create a new Handler for each task.
 type HandlerFunc func() Handler
 
@@ -42,6 +69,26 @@ func SimpleHandler(f func(task string, stop <-chan bool) bool) HandlerFunc {
 	}
 }
 
+// SimpleTaskHandler is like SimpleHandler but passes the Task -- and
+// therefore its fencing token -- to the function instead of only its ID.
+func SimpleTaskHandler(f func(task Task, stop <-chan bool) bool) HandlerFunc {
+	return func() Handler {
+		return &simpleTaskHandler{simpleHandler: simpleHandler{stop: make(chan bool)}, f: f}
+	}
+}
+
+type simpleTaskHandler struct {
+	simpleHandler
+	task Task
+	f    func(Task, <-chan bool) bool
+}
+
+func (h *simpleTaskHandler) Init(t Task) { h.task = t }
+
+func (h *simpleTaskHandler) Run(string) bool {
+	return h.f(h.task, h.stop)
+}
+
 type simpleHandler struct {
 	stop chan bool
 	f    func(string, <-chan bool) bool
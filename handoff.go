@@ -0,0 +1,102 @@
+package metafora
+
+import (
+	"runtime"
+	"time"
+)
+
+// HandoffWindow is how long a task handed off to a node is reserved for that
+// node to claim before any node may claim it.
+var HandoffWindow = 5 * time.Second
+
+// HandoffBalancer is an optional interface Balancers may implement to
+// nominate the node which should claim each task they release.
+type HandoffBalancer interface {
+	Balancer
+
+	// Handoff is called for each task returned by Balance and returns the node
+	// which should claim it next or "" to release it normally.
+	Handoff(taskID string) string
+}
+
+// HandoffHandler is an optional interface Handlers may implement to pass a
+// checkpoint token to the node a task is handed off to. The new owner's
+// handler receives it from HandoffTask.HandoffToken.
+type HandoffHandler interface {
+	Handler
+
+	// HandoffToken is called after Run returns for tasks being handed off.
+	HandoffToken() string
+}
+
+// HandoffTask is an optional interface Tasks may implement to expose the token
+// passed by their previous owner. The Consumer's Tasks implement it.
+type HandoffTask interface {
+	Task
+
+	// HandoffToken is the token passed by the task's previous owner when it
+	// was handed off to this node or "" if it wasn't.
+	HandoffToken() string
+}
+
+// HandoffCoordinator is an optional interface Coordinators may implement to
+// support directed handoffs of released tasks.
+type HandoffCoordinator interface {
+	Coordinator
+
+	// ReleaseTo is like Release but reserves the task for node to claim for
+	// HandoffWindow and stores token with it.
+	ReleaseTo(taskID, node, token string)
+
+	// HandoffToken is called by the Consumer after a task is claimed and before
+	// its handler is started. It returns the token from the task's last
+	// handoff, if any, and clears it.
+	HandoffToken(taskID string) string
+}
+
+// handoff returns the node a released task should be handed off to or "" if
+// the Balancer or Coordinator don't support handoffs.
+func (c *Consumer) handoff(taskID string) string {
+	hb, ok := c.bal.(HandoffBalancer)
+	if !ok {
+		return ""
+	}
+	if _, ok := c.coord.(HandoffCoordinator); !ok {
+		return ""
+	}
+	return hb.Handoff(taskID)
+}
+
+// release releases a task, handing it off if a target was nominated when it
+// was balanced.
+func (c *Consumer) release(t *task) {
+	target := t.handoffTarget()
+	hc, ok := c.coord.(HandoffCoordinator)
+	if target == "" || !ok {
+		c.coord.Release(t.id)
+		return
+	}
+	Infof("Handing off task %s to %s", t.id, target)
+	hc.ReleaseTo(t.id, target, handoffToken(t))
+}
+
+// handoffToken returns the task's handoff token if its handler implements
+// HandoffHandler. Panics are recovered and handed off without a token.
+func handoffToken(t *task) (token string) {
+	hh, ok := t.h.(HandoffHandler)
+	if !ok {
+		return ""
+	}
+
+	// all handler methods must be wrapped in a recover to prevent a misbehaving
+	// handler from crashing the entire consumer
+	defer func() {
+		if err := recover(); err != nil {
+			stack := make([]byte, 50*1024)
+			sz := runtime.Stack(stack, false)
+			Errorf("Handler %s panic()'d on HandoffToken: %v\n%s", t.id, err, stack[:sz])
+			token = ""
+		}
+	}()
+	return hh.HandoffToken()
+}
@@ -0,0 +1,131 @@
+package metafora
+
+import (
+	"testing"
+	"time"
+)
+
+type handoffCoord struct {
+	*TestCoord
+	handoffs chan [3]string
+}
+
+func (c *handoffCoord) ReleaseTo(taskID, node, token string) {
+	c.handoffs <- [3]string{taskID, node, token}
+}
+func (*handoffCoord) HandoffToken(string) string { return "from-previous" }
+
+type handoffBalancer struct {
+	fakeBalancer
+}
+
+func (*handoffBalancer) Handoff(string) string { return "node2" }
+
+type handoffHandler struct {
+	tokens chan string
+	stop   chan bool
+}
+
+func (h *handoffHandler) Init(t Task)          { h.tokens <- t.(HandoffTask).HandoffToken() }
+func (h *handoffHandler) Run(string) bool      { <-h.stop; return false }
+func (h *handoffHandler) Stop()                { close(h.stop) }
+func (h *handoffHandler) HandoffToken() string { return "checkpoint" }
+
+// TestHandoff ensures released tasks are handed off to the node nominated by
+// the balancer with the handler's token.
+func TestHandoff(t *testing.T) {
+	t.Parallel()
+
+	tc := &handoffCoord{TestCoord: NewTestCoord(), handoffs: make(chan [3]string, 1)}
+	tokens := make(chan string, 1)
+	hf := func() Handler { return &handoffHandler{tokens: tokens, stop: make(chan bool)} }
+	bal := &handoffBalancer{fakeBalancer{claim: true, release: []string{"t1"}}}
+	c, _ := NewConsumer(tc, hf, bal)
+	c.balEvery = time.Hour
+	go c.Run()
+	defer c.Shutdown()
+
+	tc.Tasks <- "t1"
+	select {
+	case token := <-tokens:
+		if token != "from-previous" {
+			t.Fatalf("Expected handoff token from previous owner but found %q", token)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Task didn't start in a timely fashion")
+	}
+
+	tc.Commands <- CommandBalance()
+	select {
+	case h := <-tc.handoffs:
+		if h != [3]string{"t1", "node2", "checkpoint"} {
+			t.Fatalf("Unexpected handoff: %v", h)
+		}
+	case task := <-tc.Releases:
+		t.Fatalf("Task %s released instead of handed off", task)
+	case <-time.After(time.Second):
+		t.Fatal("Task wasn't handed off in a timely fashion")
+	}
+}
+
+type panicHandoffHandler struct{ handoffHandler }
+
+func (*panicHandoffHandler) HandoffToken() string { panic("boom") }
+
+// TestHandoffTokenPanic ensures a panicking HandoffToken hands off without a
+// token instead of crashing the consumer.
+func TestHandoffTokenPanic(t *testing.T) {
+	t.Parallel()
+
+	tk := newTask("t1", 0, TaskProps{}, &panicHandoffHandler{})
+	if token := handoffToken(tk); token != "" {
+		t.Fatalf("Expected no token after panic but found %q", token)
+	}
+	tk = newTask("t2", 0, TaskProps{}, &handoffHandler{})
+	if token := handoffToken(tk); token != "checkpoint" {
+		t.Fatalf("Expected checkpoint token but found %q", token)
+	}
+}
+
+func TestFairBalancerHandoff(t *testing.T) {
+	t.Parallel()
+	ctx := &viewCtx{
+		TestConsumerState: TestConsumerState{[]string{"1", "2", "3", "4", "5"}},
+		view: ClusterView{
+			NodeID:    "node1",
+			Nodes:     []string{"node1", "node2", "node3"},
+			NodeTasks: map[string]int{"node1": 10, "node2": 2, "node3": 3},
+		},
+	}
+	fb := NewFairBalancer().(*FairBalancer)
+	fb.Init(ctx)
+	release := fb.Balance()
+	if len(release) == 0 {
+		t.Fatal("Expected tasks to be released")
+	}
+	if target := fb.Handoff(release[0]); target != "node2" {
+		t.Fatalf("Expected handoff to least loaded node2 but found %q", target)
+	}
+	if target := fb.Handoff("not-released"); target != "" {
+		t.Fatalf("Expected no handoff for a task that wasn't released but found %q", target)
+	}
+}
+
+// TestHandoffWrappedBalancers ensures balancers wrapping others forward
+// Handoff.
+func TestHandoffWrappedBalancers(t *testing.T) {
+	t.Parallel()
+	hb := &handoffBalancer{}
+	wrapped := []Balancer{
+		NewCompositeBalancer(ClaimAll, ReleaseUnion, 0, &fakeBalancer{}, hb),
+		NewRateLimitedBalancer(hb, NewReleaseLimiter(1, time.Hour), 0),
+	}
+	for _, b := range wrapped {
+		if node := b.(HandoffBalancer).Handoff("t1"); node != "node2" {
+			t.Errorf("Expected %T to hand off to node2 but found %q", b, node)
+		}
+	}
+	if node := NewCompositeBalancer(ClaimAll, ReleaseUnion, 0, &fakeBalancer{}).(HandoffBalancer).Handoff("t1"); node != "" {
+		t.Errorf("Expected no handoff without a HandoffBalancer but found %q", node)
+	}
+}
@@ -0,0 +1,77 @@
+package httputil
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lytics/metafora"
+)
+
+// DefaultWebhookTimeout bounds webhook calls made with clients which have no
+// Timeout set, as predicates block the Consumer from claiming or balancing.
+const DefaultWebhookTimeout = 5 * time.Second
+
+// AdmissionRequest is the JSON body POSTed to admission webhooks.
+type AdmissionRequest struct {
+	Task string `json:"task"`
+}
+
+// AdmissionResponse is the JSON response expected from admission webhooks.
+// Decision is required; responses without one defer the task.
+type AdmissionResponse struct {
+	Decision metafora.Decision `json:"decision"`
+	Reason   string            `json:"reason,omitempty"`
+}
+
+// NewWebhookPredicate creates an admission predicate which POSTs an
+// AdmissionRequest to url and decides based on the AdmissionResponse. Tasks
+// are deferred if the webhook fails or its response has no decision. If
+// client is nil or has no Timeout, DefaultWebhookTimeout is used.
+func NewWebhookPredicate(name, url string, client *http.Client) metafora.Predicate {
+	if client == nil {
+		client = &http.Client{}
+	}
+	if client.Timeout == 0 {
+		c := *client
+		c.Timeout = DefaultWebhookTimeout
+		client = &c
+	}
+	return metafora.NewPredicate(name, func(taskID string) (metafora.Decision, string) {
+		resp, err := webhook(client, url, taskID)
+		if err != nil {
+			return metafora.Defer, fmt.Sprintf("webhook error: %v", err)
+		}
+		return resp.Decision, resp.Reason
+	})
+}
+
+func webhook(client *http.Client, url, taskID string) (*AdmissionResponse, error) {
+	body, err := json.Marshal(&AdmissionRequest{Task: taskID})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	// Decode into a pointer so a missing decision isn't mistaken for Allow
+	ar := struct {
+		Decision *metafora.Decision `json:"decision"`
+		Reason   string             `json:"reason"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+		return nil, err
+	}
+	if ar.Decision == nil {
+		return nil, errors.New("response has no decision")
+	}
+	return &AdmissionResponse{Decision: *ar.Decision, Reason: ar.Reason}, nil
+}
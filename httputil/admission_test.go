@@ -0,0 +1,47 @@
+package httputil_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lytics/metafora"
+	. "github.com/lytics/metafora/httputil"
+)
+
+func TestWebhookPredicate(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := AdmissionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Error decoding request: %v", err)
+		}
+		switch req.Task {
+		case "ok":
+			w.Write([]byte(`{"decision":"allow"}`))
+		case "no":
+			w.Write([]byte(`{"decision":"deny","reason":"nope"}`))
+		case "empty":
+			w.Write([]byte(`{"reason":"forgot"}`))
+		default:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	p := NewWebhookPredicate("hook", srv.URL, nil)
+	if d, reason := p.Admit("ok"); d != metafora.Allow {
+		t.Errorf("Expected allow but found %s: %s", d, reason)
+	}
+	if d, reason := p.Admit("no"); d != metafora.Deny || reason != "nope" {
+		t.Errorf("Expected deny but found %s: %s", d, reason)
+	}
+	if d, reason := p.Admit("empty"); d != metafora.Defer {
+		t.Errorf("Expected defer for a response without a decision but found %s: %s", d, reason)
+	}
+	if d, reason := p.Admit("broken"); d != metafora.Defer {
+		t.Errorf("Expected defer but found %s: %s", d, reason)
+	}
+}
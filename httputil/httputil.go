@@ -15,25 +15,64 @@ type Consumer interface {
 	Tasks() []metafora.Task
 }
 
-// InfoResponse is the JSON response marshalled by the MakeInfoHandler.
+// Admitter is implemented by Consumers with admission predicates.
+type Admitter interface {
+	Admission() []metafora.PredicateStats
+}
+
+// BalanceReporter is implemented by Consumers which report their most recent
+// balance.
+type BalanceReporter interface {
+	LastBalance() metafora.BalanceReport
+}
+
+// InfoResponse is the JSON response marshalled by the MakeInfoHandler. Tasks
+// include the progress set by their handlers.
 type InfoResponse struct {
-	Frozen  bool            `json:"frozen"`
-	Node    string          `json:"node"`
-	Started time.Time       `json:"started"`
-	Tasks   []metafora.Task `json:"tasks"`
+	Frozen    bool                      `json:"frozen"`
+	Node      string                    `json:"node"`
+	Started   time.Time                 `json:"started"`
+	Tasks     []metafora.Task           `json:"tasks"`
+	Admission []metafora.PredicateStats `json:"admission,omitempty"`
+
+	LastBalance *metafora.BalanceReport `json:"last_balance,omitempty"`
 }
 
 // MakeInfoHandler returns an HTTP handler which can be added to an exposed
 // HTTP server mux by Metafora applications to provide operators with basic
-// node introspection.
+// node introspection. Consumers implementing Admitter also report their
+// admission predicates' decisions, and those implementing BalanceReporter
+// report their most recent balance.
 func MakeInfoHandler(c Consumer, node string, started time.Time) http.HandlerFunc {
 	return func(w http.ResponseWriter, _ *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(&InfoResponse{
+		info := &InfoResponse{
 			Frozen:  c.Frozen(),
 			Node:    node,
 			Started: started,
 			Tasks:   c.Tasks(),
-		})
+		}
+		if a, ok := c.(Admitter); ok {
+			info.Admission = a.Admission()
+		}
+		if b, ok := c.(BalanceReporter); ok {
+			last := b.LastBalance()
+			info.LastBalance = &last
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+// MakeGroupsHandler returns an HTTP handler which reports the quota and usage
+// of every task group as a JSON object keyed by group.
+func MakeGroupsHandler(c metafora.GroupClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		groups, err := c.Groups()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
 	}
 }
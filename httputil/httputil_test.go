@@ -3,6 +3,7 @@ package httputil_test
 import (
 	"encoding/json"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
@@ -56,3 +57,32 @@ func TestMakeInfoHandler(t *testing.T) {
 		t.Errorf("Unexpected tasks: %v", info.Tasks)
 	}
 }
+
+type groupClient struct {
+	metafora.Client
+	groups map[string]metafora.GroupStatus
+}
+
+func (*groupClient) SetGroupQuota(string, metafora.GroupQuota) error { return nil }
+func (c *groupClient) Groups() (map[string]metafora.GroupStatus, error) {
+	return c.groups, nil
+}
+
+func TestMakeGroupsHandler(t *testing.T) {
+	t.Parallel()
+
+	c := &groupClient{groups: map[string]metafora.GroupStatus{
+		"acme": {Quota: metafora.GroupQuota{MaxRunning: 5}, Running: 2, Waiting: 1},
+	}}
+
+	resp := httptest.NewRecorder()
+	MakeGroupsHandler(c)(resp, nil)
+
+	groups := map[string]metafora.GroupStatus{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &groups); err != nil {
+		t.Fatalf("Error unmarshalling response body: %v", err)
+	}
+	if !reflect.DeepEqual(groups, c.groups) {
+		t.Errorf("Expected %v but found %v", c.groups, groups)
+	}
+}
@@ -0,0 +1,106 @@
+package metafora
+
+import "time"
+
+// HungGrace is how long the Consumer waits for a hung task's handler to exit
+// after calling Stop before calling Stop again, and then before abandoning
+// the task.
+var HungGrace = 30 * time.Second
+
+// RunningRejectDelay is how long the Consumer waits before rejecting a task
+// whose handler is still running locally, such as an abandoned hung task.
+// Until #93 is fixed rejected tasks may be immediately offered again by the
+// Coordinator, so wait to prevent a tight loop.
+var RunningRejectDelay = time.Second
+
+// HeartbeatTask is an optional interface Tasks may implement to let handlers
+// signal they're alive. The Consumer's Tasks implement it.
+type HeartbeatTask interface {
+	Task
+
+	// Heartbeat tells the Consumer the task's handler is making progress. It
+	// must be called at least once per the task's HeartbeatTimeout, if set,
+	// or the task is considered hung. SetProgress also counts as a heartbeat.
+	Heartbeat()
+}
+
+// HungCoordinator is an optional interface Coordinators which renew claims
+// may implement to stop renewing the claims of hung tasks.
+type HungCoordinator interface {
+	Coordinator
+
+	// Hung is called when a task's handler misses its max run time or
+	// heartbeat deadline. The Coordinator should stop renewing the task's
+	// claim so other nodes may claim it if the handler never exits. Claims
+	// should expire within twice HungGrace, when the task is abandoned. Release
+	// or Done is still called when the handler exits or the task is abandoned.
+	Hung(taskID string)
+}
+
+// runWatched runs a task whose properties set a max run time or heartbeat
+// timeout. If the handler misses a deadline it's stopped, stopped again after
+// HungGrace, and abandoned after another HungGrace. Abandoned tasks are
+// released, or marked done if their properties set FailHung, but remain
+// running locally until their handler exits.
+func (c *Consumer) runWatched(run func(string) bool, t *task) bool {
+	result := make(chan bool, 1)
+	go func() { result <- c.runTask(run, t.id) }()
+
+	for {
+		deadline, reason := t.deadline()
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			Errorf("Task %s hung: %s; stopping", t.id, reason)
+			break
+		}
+		select {
+		case done := <-result:
+			return done
+		case <-time.After(wait):
+			// Heartbeats may have extended the deadline; recheck
+		}
+	}
+
+	t.setHung()
+	if hc, ok := c.coord.(HungCoordinator); ok {
+		hc.Hung(t.id)
+	}
+	c.stopTask(t.id)
+	select {
+	case done := <-result:
+		return done
+	case <-time.After(HungGrace):
+	}
+
+	Errorf("Task %s still running %s after Stop; stopping again", t.id, HungGrace)
+	c.stopTask(t.id)
+	select {
+	case done := <-result:
+		return done
+	case <-time.After(HungGrace):
+	}
+
+	Errorf("Abandoning hung task %s; its handler is still running", t.id)
+	return t.props.FailHung
+}
+
+// deadline returns the earliest of the task's max run time and heartbeat
+// deadlines and a description of it.
+func (t *task) deadline() (time.Time, string) {
+	var deadline time.Time
+	var reason string
+	if t.props.MaxRunTime > 0 {
+		deadline = t.started.Add(t.props.MaxRunTime)
+		reason = "exceeded max run time of " + t.props.MaxRunTime.String()
+	}
+	if t.props.HeartbeatTimeout > 0 {
+		t.beatL.Lock()
+		beat := t.beat
+		t.beatL.Unlock()
+		if hb := beat.Add(t.props.HeartbeatTimeout); deadline.IsZero() || hb.Before(deadline) {
+			deadline = hb
+			reason = "no heartbeat for " + t.props.HeartbeatTimeout.String()
+		}
+	}
+	return deadline, reason
+}
@@ -0,0 +1,206 @@
+package metafora
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type hungCoord struct {
+	*TestCoord
+	props TaskProps
+	hung  chan string
+}
+
+func (c *hungCoord) Props(string) TaskProps { return c.props }
+func (c *hungCoord) Hung(taskID string)     { c.hung <- taskID }
+
+// hungHandler ignores Stop until exit is closed. If block is non-nil Stop
+// blocks until it's closed.
+type hungHandler struct {
+	beat  <-chan time.Time
+	stops chan bool
+	exit  chan bool
+	block chan bool
+	task  Task
+}
+
+func (h *hungHandler) Init(t Task) { h.task = t }
+func (h *hungHandler) Stop() {
+	h.stops <- true
+	if h.block != nil {
+		<-h.block
+	}
+}
+func (h *hungHandler) Run(string) bool {
+	for {
+		select {
+		case <-h.beat:
+			h.task.(HeartbeatTask).Heartbeat()
+		case <-h.exit:
+			return true
+		}
+	}
+}
+
+func newHungConsumer(t *testing.T, props TaskProps, h *hungHandler) (*Consumer, *hungCoord) {
+	tc := &hungCoord{TestCoord: NewTestCoord(), props: props, hung: make(chan string, 1)}
+	c, err := NewConsumer(tc, func() Handler { return h }, &DumbBalancer{})
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	return c, tc
+}
+
+// TestHung ensures handlers which miss heartbeats are stopped twice and then
+// abandoned.
+func TestHung(t *testing.T) {
+	defer func(d time.Duration) { HungGrace = d }(HungGrace)
+	HungGrace = 100 * time.Millisecond
+
+	h := &hungHandler{stops: make(chan bool, 10), exit: make(chan bool)}
+	c, tc := newHungConsumer(t, TaskProps{HeartbeatTimeout: 100 * time.Millisecond}, h)
+	go c.Run()
+	defer c.Shutdown()
+
+	tc.Tasks <- "t1"
+	select {
+	case task := <-tc.hung:
+		if task != "t1" {
+			t.Fatalf("Unexpected hung task: %s", task)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Task wasn't found hung in a timely fashion")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-h.stops:
+		case <-time.After(time.Second):
+			t.Fatalf("Stop %d wasn't called in a timely fashion", i+1)
+		}
+	}
+	select {
+	case <-tc.Releases:
+	case <-time.After(time.Second):
+		t.Fatal("Hung task wasn't released in a timely fashion")
+	}
+
+	// Abandoned tasks are still running locally
+	tasks := c.Tasks()
+	if len(tasks) != 1 {
+		t.Fatalf("Expected abandoned task to still be running but found: %v", tasks)
+	}
+	buf, _ := json.Marshal(tasks[0])
+	js := struct{ Hung *time.Time }{}
+	if err := json.Unmarshal(buf, &js); err != nil || js.Hung == nil {
+		t.Errorf("Expected hung time in task JSON: %s", buf)
+	}
+
+	close(h.exit)
+	time.Sleep(50 * time.Millisecond)
+	if tasks := c.Tasks(); len(tasks) != 0 {
+		t.Errorf("Expected no tasks after hung handler exited but found: %v", tasks)
+	}
+	if len(tc.Dones) > 0 {
+		t.Errorf("Abandoned task marked done after its handler exited")
+	}
+}
+
+// TestHungFail ensures tasks exceeding their max run time are marked done if
+// they fail when hung.
+func TestHungFail(t *testing.T) {
+	defer func(d time.Duration) { HungGrace = d }(HungGrace)
+	HungGrace = 50 * time.Millisecond
+
+	h := &hungHandler{stops: make(chan bool, 10), exit: make(chan bool)}
+	defer close(h.exit)
+	c, tc := newHungConsumer(t, TaskProps{MaxRunTime: 100 * time.Millisecond, FailHung: true}, h)
+	go c.Run()
+	defer c.Shutdown()
+
+	tc.Tasks <- "t1"
+	select {
+	case <-tc.Dones:
+	case <-tc.Releases:
+		t.Fatal("Hung task released instead of failed")
+	case <-time.After(time.Second):
+		t.Fatal("Hung task wasn't failed in a timely fashion")
+	}
+}
+
+// TestHeartbeat ensures handlers which heartbeat aren't considered hung.
+func TestHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	h := &hungHandler{beat: ticker.C, stops: make(chan bool, 10), exit: make(chan bool)}
+	c, tc := newHungConsumer(t, TaskProps{HeartbeatTimeout: 100 * time.Millisecond}, h)
+	go c.Run()
+	defer c.Shutdown()
+
+	tc.Tasks <- "t1"
+	select {
+	case <-tc.hung:
+		t.Fatal("Task found hung despite heartbeating")
+	case <-time.After(300 * time.Millisecond):
+	}
+	close(h.exit)
+	select {
+	case <-tc.Dones:
+	case <-time.After(time.Second):
+		t.Fatal("Task didn't finish in a timely fashion")
+	}
+}
+
+// TestHungStopBlocks ensures handlers whose Stop blocks are still abandoned
+// and don't block the Consumer.
+func TestHungStopBlocks(t *testing.T) {
+	defer func(d time.Duration) { HungGrace = d }(HungGrace)
+	HungGrace = 100 * time.Millisecond
+
+	h := &hungHandler{stops: make(chan bool, 10), exit: make(chan bool), block: make(chan bool)}
+	defer close(h.block)
+	c, tc := newHungConsumer(t, TaskProps{HeartbeatTimeout: 100 * time.Millisecond}, h)
+	go c.Run()
+
+	tc.Tasks <- "t1"
+	select {
+	case <-h.stops:
+	case <-time.After(time.Second):
+		t.Fatal("Stop wasn't called in a timely fashion")
+	}
+	select {
+	case <-tc.Releases:
+	case <-time.After(time.Second):
+		t.Fatal("Hung task wasn't released in a timely fashion")
+	}
+	if len(h.stops) > 0 {
+		t.Errorf("Stop called again while blocked")
+	}
+
+	marshalled := make(chan bool)
+	go func() {
+		for _, task := range c.Tasks() {
+			json.Marshal(task)
+		}
+		close(marshalled)
+	}()
+	select {
+	case <-marshalled:
+	case <-time.After(time.Second):
+		t.Fatal("Marshalling task blocked on Stop")
+	}
+
+	close(h.exit)
+	shutdown := make(chan bool)
+	go func() {
+		c.Shutdown()
+		close(shutdown)
+	}()
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown blocked on Stop")
+	}
+}
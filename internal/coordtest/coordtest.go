@@ -0,0 +1,82 @@
+// Package coordtest contains helpers shared by the tests of the Coordinator
+// implementations.
+package coordtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lytics/metafora"
+)
+
+// Timeout is how long RecvTask waits for Watch to return a task.
+var Timeout = 5 * time.Second
+
+// Ctx is a metafora.CoordinatorContext which records the tasks a Coordinator
+// loses and the membership changes it notices.
+type Ctx struct {
+	t *testing.T
+
+	// LostTasks receives the ID of each task passed to Lost.
+	LostTasks chan string
+
+	// Changes receives a value for each call to NodesChanged. Calls are
+	// dropped if it's full.
+	Changes chan bool
+}
+
+// NewCtx creates a Ctx which logs to t.
+func NewCtx(t *testing.T) *Ctx {
+	return &Ctx{t: t, LostTasks: make(chan string, 10), Changes: make(chan bool, 10)}
+}
+
+func (c *Ctx) Lost(taskID string) {
+	c.t.Logf("Lost(%s)", taskID)
+	c.LostTasks <- taskID
+}
+
+func (c *Ctx) NodesChanged() {
+	c.t.Log("NodesChanged()")
+	select {
+	case c.Changes <- true:
+	default:
+	}
+}
+
+// Init initializes a Coordinator with a new Ctx and fails the test if it
+// returns an error.
+func Init(t *testing.T, c metafora.Coordinator) *Ctx {
+	ctx := NewCtx(t)
+	if err := c.Init(ctx); err != nil {
+		t.Fatalf("Unexpected error initializing coordinator: %v", err)
+	}
+	return ctx
+}
+
+// Watch calls Watch in a goroutine and returns a chan of the result.
+func Watch(t *testing.T, c metafora.Coordinator) <-chan string {
+	res := make(chan string, 1)
+	go func() {
+		task, err := c.Watch()
+		if err != nil {
+			t.Errorf("Watch returned an error: %v", err)
+		}
+		res <- task
+	}()
+	return res
+}
+
+// RecvTask fails the test unless the expected task is received from a chan
+// returned by Watch within Timeout.
+func RecvTask(t *testing.T, res <-chan string, expected string) {
+	select {
+	case task := <-res:
+		if task != expected {
+			t.Fatalf("Expected task %q but received %q", expected, task)
+		}
+	case <-time.After(Timeout):
+		t.Fatalf("Timed out waiting for task %q", expected)
+	}
+}
+
+var _ metafora.CoordinatorContext = (*Ctx)(nil)
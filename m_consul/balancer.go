@@ -0,0 +1,91 @@
+package m_consul
+
+import (
+	"path"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/lytics/metafora"
+)
+
+// NewFairBalancer creates a new metafora.DefaultFairBalancer that uses Consul
+// for counting tasks per node.
+func NewFairBalancer(nodeid, namespace string, client *api.Client) metafora.Balancer {
+	return metafora.NewDefaultFairBalancer(nodeid, NewClusterState(namespace, client))
+}
+
+// NewClusterState creates a new metafora.ClusterState which counts the tasks
+// claimed by each node in Consul.
+func NewClusterState(namespace string, client *api.Client) metafora.ClusterState {
+	namespace = strings.Trim(namespace, "/ ")
+	return &consulClusterState{
+		client:   client,
+		taskPath: path.Join(namespace, TasksPath),
+		nodePath: path.Join(namespace, NodesPath),
+	}
+}
+
+// Checks the current state of a Consul cluster
+type consulClusterState struct {
+	client   *api.Client
+	taskPath string
+	nodePath string
+}
+
+func (c *consulClusterState) NodeTaskCount() (map[string]int, error) {
+	view, err := c.view("")
+	return view.NodeTasks, err
+}
+
+// view returns a metafora.ClusterView for nodeID.
+func (c *consulClusterState) view(nodeID string) (metafora.ClusterView, error) {
+	// First initialize state with nodes as keys
+	nodes, err := nodes(c.client, c.nodePath)
+	if err != nil {
+		return metafora.ClusterView{}, err
+	}
+	view := metafora.ClusterView{
+		NodeID:    nodeID,
+		Nodes:     nodes,
+		NodeTasks: make(map[string]int, len(nodes)),
+	}
+	for _, node := range nodes {
+		view.NodeTasks[node] = 0
+	}
+
+	// Then count how many tasks each node has
+	pairs, _, err := c.client.KV().List(c.taskPath+"/", nil)
+	if err != nil {
+		return metafora.ClusterView{}, err
+	}
+
+	tasks := map[string]bool{} // task ID -> claimed
+	for _, kv := range pairs {
+		task, owner, ok := parseTaskKey(c.taskPath, kv.Key)
+		if !ok {
+			continue
+		}
+		if !owner {
+			if _, ok := tasks[task]; !ok {
+				tasks[task] = false
+			}
+			continue
+		}
+		if kv.Session == "" {
+			continue
+		}
+		tasks[task] = true
+		// Only count nodes which are registered, as some nodes may be
+		// shutting down, etc, and should not be counted
+		if _, ok := view.NodeTasks[string(kv.Value)]; ok {
+			view.NodeTasks[string(kv.Value)]++
+		}
+	}
+	for _, claimed := range tasks {
+		if !claimed {
+			view.Backlog++
+		}
+	}
+
+	return view, nil
+}
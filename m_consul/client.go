@@ -0,0 +1,126 @@
+package m_consul
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/lytics/metafora"
+)
+
+// NewClient creates a new client using a Consul backend.
+func NewClient(namespace string, client *api.Client) metafora.Client {
+	namespace = strings.Trim(namespace, "/ ")
+	return &mclient{
+		consul:   client,
+		taskPath: path.Join(namespace, TasksPath),
+		nodePath: path.Join(namespace, NodesPath),
+	}
+}
+
+// Type 'mclient' is an internal implementation of metafora.Client with a
+// Consul backend.
+type mclient struct {
+	consul   *api.Client
+	taskPath string
+	nodePath string
+}
+
+func (mc *mclient) tskPath(taskID string) string {
+	return path.Join(mc.taskPath, taskID)
+}
+
+func (mc *mclient) cmdPath(node string) string {
+	return path.Join(mc.nodePath, node, CommandsPath)
+}
+
+// SubmitTask creates a new task key. An error is returned if the task
+// already exists.
+func (mc *mclient) SubmitTask(taskID string) error {
+	key := mc.tskPath(taskID)
+
+	// A CAS with a ModifyIndex of 0 only succeeds if the key doesn't exist
+	ok, _, err := mc.consul.KV().CAS(&api.KVPair{Key: key}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("task %s already exists", taskID)
+	}
+	metafora.Debugf("task submitted [%s]", key)
+	return nil
+}
+
+// DeleteTask deletes a task and its claim.
+func (mc *mclient) DeleteTask(taskID string) error {
+	key := mc.tskPath(taskID)
+	if _, err := mc.consul.KV().Delete(key, nil); err != nil {
+		return err
+	}
+	_, err := mc.consul.KV().DeleteTree(key+"/", nil)
+	metafora.Debugf("task deleted [%s]", key)
+	return err
+}
+
+// SubmitCommand creates a new command for a particular node. Commands are
+// executed in the order they're created.
+func (mc *mclient) SubmitCommand(node string, command metafora.Command) error {
+	body, err := command.Marshal()
+	if err != nil {
+		// This is either a bug in metafora or someone implemented their own
+		// command incorrectly.
+		return err
+	}
+
+	key := path.Join(mc.cmdPath(node), fmt.Sprintf("%020d", time.Now().UnixNano()))
+	if _, err := mc.consul.KV().Put(&api.KVPair{Key: key, Value: body}, nil); err != nil {
+		metafora.Errorf("Error submitting command: %s to node: %s", command, node)
+		return err
+	}
+	metafora.Debugf("Submitted command: %s to node: %s", command, node)
+	return nil
+}
+
+// Nodes fetches the IDs of currently registered nodes.
+func (mc *mclient) Nodes() ([]string, error) {
+	return nodes(mc.consul, mc.nodePath)
+}
+
+// nodes returns the IDs of nodes registered under nodePath. Only node keys
+// locked by a session are returned.
+func nodes(client *api.Client, nodePath string) ([]string, error) {
+	pairs, _, err := client.KV().List(nodePath+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseNodes(nodePath, pairs), nil
+}
+
+// parseNodes returns the nodes whose keys are locked by a session from a
+// listing of the nodes path.
+func parseNodes(nodePath string, pairs api.KVPairs) []string {
+	nodes := []string{}
+	for _, kv := range pairs {
+		// Skip commands
+		parts := strings.Split(strings.TrimPrefix(kv.Key, nodePath+"/"), "/")
+		if len(parts) == 1 && kv.Session != "" {
+			nodes = append(nodes, parts[0])
+		}
+	}
+	return nodes
+}
+
+// sameNodes returns true if both sorted lists contain the same nodes.
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,23 @@
+package m_consul
+
+import "time"
+
+const (
+	TasksPath    = "tasks"
+	NodesPath    = "nodes"
+	CommandsPath = "commands"
+	OwnerMarker  = "owner"
+
+	// DefaultSessionTTL is the TTL of the session each node creates on Init.
+	// The node key and all of the node's claims are locked by this session.
+	DefaultSessionTTL = "20s"
+
+	// DefaultLockDelay is how long Consul prevents keys locked by an
+	// invalidated session from being acquired again.
+	DefaultLockDelay = 15 * time.Second
+
+	// minWatchBackoff and maxWatchBackoff bound the delay between retries of
+	// failed node watches.
+	minWatchBackoff = time.Second
+	maxWatchBackoff = 30 * time.Second
+)
@@ -0,0 +1,470 @@
+package m_consul
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/hashicorp/consul/api"
+	"github.com/lytics/metafora"
+)
+
+// WaitTime bounds how long blocking queries made by the coordinator wait for
+// changes before being reissued.
+var WaitTime = 5 * time.Minute
+
+// ConsulCoordinator is a Metafora Coordinator using Consul's KV store and
+// sessions as the broker.
+//
+// Each coordinator creates a single session in Init. The node key and all
+// claims are locks held by that session, so keeping claims alive costs one
+// session renewal per node regardless of the number of tasks claimed. If the
+// session is invalidated -- either its TTL expires or Consul's health checks
+// fail for the agent's node -- Consul deletes the node key and all claims.
+type ConsulCoordinator struct {
+	Client    *api.Client
+	cordCtx   metafora.CoordinatorContext
+	namespace string
+	taskPath  string
+
+	// SessionTTL and LockDelay configure the node's session and must be set
+	// before Init is called.
+	SessionTTL string
+	LockDelay  time.Duration
+
+	NodeID      string
+	nodePath    string
+	commandPath string
+
+	session string
+
+	// claimed tasks
+	tasks map[string]bool
+	taskL sync.Mutex
+
+	// ctx is canceled by Close() to stop blocking queries
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stop is closed by Close() to stop renewing and destroy the session
+	stop    chan struct{}
+	renewed chan struct{} // closed when the session renewer exits
+	closeL  sync.Mutex
+	closed  bool
+}
+
+// NewConsulCoordinator creates a new Metafora Coordinator implementation
+// using Consul as the broker. If no node ID is specified, a unique one will
+// be generated.
+//
+// Coordinator methods will be called by the core Metafora Consumer. Calling
+// Init, Close, etc. from your own code will lead to undefined behavior.
+func NewConsulCoordinator(nodeID, namespace string, client *api.Client) metafora.Coordinator {
+	// Consul keys must not begin with a slash
+	namespace = strings.Trim(namespace, "/ ")
+
+	if nodeID == "" {
+		hn, _ := os.Hostname()
+		nodeID = hn + "-" + uuid.NewRandom().String()
+	}
+
+	nodeID = strings.Trim(nodeID, "/ ")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ConsulCoordinator{
+		Client:     client,
+		namespace:  namespace,
+		taskPath:   path.Join(namespace, TasksPath),
+		SessionTTL: DefaultSessionTTL,
+		LockDelay:  DefaultLockDelay,
+
+		NodeID:      nodeID,
+		nodePath:    path.Join(namespace, NodesPath, nodeID),
+		commandPath: path.Join(namespace, NodesPath, nodeID, CommandsPath),
+
+		tasks: make(map[string]bool),
+
+		ctx:     ctx,
+		cancel:  cancel,
+		stop:    make(chan struct{}),
+		renewed: make(chan struct{}),
+	}
+}
+
+// Init creates the node's session, registers the node by locking its key,
+// and starts renewing the session.
+func (cc *ConsulCoordinator) Init(cordCtx metafora.CoordinatorContext) error {
+	metafora.Debugf("Initializing coordinator with namespace: %s", cc.namespace)
+
+	cc.cordCtx = cordCtx
+
+	// The default health checks are kept so that the session is invalidated
+	// if the agent's node fails as well as when the TTL expires.
+	session, _, err := cc.Client.Session().Create(&api.SessionEntry{
+		Name:      "metafora-" + cc.NodeID,
+		TTL:       cc.SessionTTL,
+		LockDelay: cc.LockDelay,
+		Behavior:  api.SessionBehaviorDelete,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	ok, _, err := cc.Client.KV().Acquire(&api.KVPair{
+		Key:     cc.nodePath,
+		Value:   []byte(cc.NodeID),
+		Session: session,
+	}, nil)
+	if err != nil || !ok {
+		cc.Client.Session().Destroy(session, nil)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("node %s is already registered", cc.NodeID)
+	}
+	cc.session = session
+
+	go cc.sessionRenewer()
+	go cc.nodeWatcher()
+	return nil
+}
+
+// nodeWatcher blocks on the nodes path and notifies the Consumer when nodes
+// join or leave the cluster. Only node keys locked by a session are compared,
+// so commands written under node paths are ignored.
+//
+// Errors are retried with an exponential backoff up to maxWatchBackoff so an
+// unhealthy cluster isn't hammered.
+func (cc *ConsulCoordinator) nodeWatcher() {
+	nodePath := path.Join(cc.namespace, NodesPath)
+	var index uint64
+	var last []string
+	backoff := minWatchBackoff
+	for !cc.isClosed() {
+		pairs, newIndex, err := cc.list(nodePath+"/", index)
+		if err != nil {
+			if cc.isClosed() {
+				return
+			}
+			metafora.Warnf("Error watching nodes: %v", err)
+			select {
+			case <-cc.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxWatchBackoff {
+				backoff = maxWatchBackoff
+			}
+			continue
+		}
+		backoff = minWatchBackoff
+
+		nodes := parseNodes(nodePath, pairs)
+		if last != nil && !sameNodes(last, nodes) {
+			metafora.Infof("Nodes changed from %v to %v", last, nodes)
+			cc.cordCtx.NodesChanged()
+		}
+		last, index = nodes, newIndex
+	}
+}
+
+// sessionRenewer keeps the node's session alive until Close is called. If
+// the session is invalidated before the coordinator is closed every claim
+// has been lost, so the coordinator must shutdown.
+func (cc *ConsulCoordinator) sessionRenewer() {
+	defer close(cc.renewed)
+	err := cc.Client.Session().RenewPeriodic(cc.SessionTTL, cc.session, nil, cc.stop)
+	if cc.isClosed() {
+		return
+	}
+
+	metafora.Errorf("Session for node %s lost (%v). Closing coordinator.", cc.NodeID, err)
+	cc.taskL.Lock()
+	lost := make([]string, 0, len(cc.tasks))
+	for task := range cc.tasks {
+		lost = append(lost, task)
+	}
+	cc.tasks = make(map[string]bool)
+	cc.taskL.Unlock()
+
+	for _, task := range lost {
+		cc.cordCtx.Lost(task)
+	}
+	go cc.Close()
+}
+
+func (cc *ConsulCoordinator) isClosed() bool {
+	cc.closeL.Lock()
+	defer cc.closeL.Unlock()
+	return cc.closed
+}
+
+func (cc *ConsulCoordinator) taskKey(taskID string) string {
+	return path.Join(cc.taskPath, taskID)
+}
+
+func (cc *ConsulCoordinator) ownerKey(taskID string) string {
+	return path.Join(cc.taskPath, taskID, OwnerMarker)
+}
+
+// parseTaskKey returns the task ID for keys in the task path and whether or
+// not the key is the task's owner key. ok is false for any other key.
+func parseTaskKey(taskPath string, key string) (task string, owner bool, ok bool) {
+	if !strings.HasPrefix(key, taskPath+"/") {
+		metafora.Errorf("Received task from outside task path: %s", key)
+		return "", false, false
+	}
+	parts := strings.Split(strings.TrimPrefix(key, taskPath+"/"), "/")
+	switch {
+	case len(parts) == 1:
+		return parts[0], false, true
+	case len(parts) == 2 && parts[1] == OwnerMarker:
+		return parts[0], true, true
+	}
+	// Ignore any other keys
+	return "", false, false
+}
+
+// list performs a blocking query for all keys under prefix which returns
+// once the prefix's index exceeds waitIndex. A waitIndex of 0 returns
+// immediately.
+func (cc *ConsulCoordinator) list(prefix string, waitIndex uint64) (api.KVPairs, uint64, error) {
+	q := &api.QueryOptions{WaitIndex: waitIndex, WaitTime: WaitTime}
+	pairs, meta, err := cc.Client.KV().List(prefix, q.WithContext(cc.ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	index := meta.LastIndex
+	if index < waitIndex {
+		// Consul's index went backwards; start over as recommended by the
+		// blocking query documentation.
+		index = 0
+	}
+	return pairs, index, nil
+}
+
+// Watch returns the first unclaimed task or blocks until a task is created or
+// released. It returns ("", nil) if the coordinator is closed.
+func (cc *ConsulCoordinator) Watch() (taskID string, err error) {
+	var index uint64
+	for {
+		if cc.isClosed() {
+			return "", nil
+		}
+
+		pairs, newIndex, err := cc.list(cc.taskPath+"/", index)
+		if err != nil {
+			if cc.isClosed() {
+				return "", nil
+			}
+			metafora.Errorf("%s Error getting the existing tasks: %v", cc.taskPath, err)
+			return "", err
+		}
+
+		// Released claims are left in place without a session
+		tasks := []string{}
+		claimed := map[string]bool{}
+		for _, kv := range pairs {
+			task, owner, ok := parseTaskKey(cc.taskPath, kv.Key)
+			switch {
+			case !ok:
+			case owner:
+				if kv.Session != "" {
+					claimed[task] = true
+				}
+			default:
+				tasks = append(tasks, task)
+			}
+		}
+		for _, task := range tasks {
+			if !claimed[task] {
+				metafora.Debugf("Received task: %s", task)
+				return task, nil
+			}
+		}
+		index = newIndex
+	}
+}
+
+// Claim is called by the Consumer when a Balancer has determined that a task
+// ID can be claimed. Claim returns false if another consumer has already
+// claimed the ID or the task no longer exists.
+func (cc *ConsulCoordinator) Claim(taskID string) bool {
+	_, ok := cc.FencedClaim(taskID)
+	return ok
+}
+
+// FencedClaim claims a task like Claim and returns the owner key's modify
+// index after acquisition as its token.
+func (cc *ConsulCoordinator) FencedClaim(taskID string) (uint64, bool) {
+	kv := cc.Client.KV()
+	task, _, err := kv.Get(cc.taskKey(taskID), nil)
+	if err != nil {
+		metafora.Errorf("Claim of %s failed with an unexpected error: %v", taskID, err)
+		return 0, false
+	}
+	if task == nil {
+		metafora.Debugf("Claim of %s failed, task deleted", taskID)
+		return 0, false
+	}
+
+	key := cc.ownerKey(taskID)
+	ok, _, err := kv.Acquire(&api.KVPair{Key: key, Value: []byte(cc.NodeID), Session: cc.session}, nil)
+	if err != nil {
+		metafora.Errorf("Claim of %s failed with an unexpected error: %v", key, err)
+		return 0, false
+	}
+	if !ok {
+		metafora.Debugf("Claim of %s failed, already claimed", key)
+		return 0, false
+	}
+
+	// Acquire doesn't return the new index, so read it back
+	owner, _, err := kv.Get(key, nil)
+	if err != nil || owner == nil || owner.Session != cc.session {
+		metafora.Warnf("Claim of %s lost before its token could be read: %v", key, err)
+		return 0, false
+	}
+
+	metafora.Debugf("Claim successful: %s", key)
+	cc.taskL.Lock()
+	cc.tasks[taskID] = true
+	cc.taskL.Unlock()
+	return owner.ModifyIndex, true
+}
+
+// Cluster returns a view of the cluster for Balancers.
+func (cc *ConsulCoordinator) Cluster() (metafora.ClusterView, error) {
+	cs := consulClusterState{
+		client:   cc.Client,
+		taskPath: cc.taskPath,
+		nodePath: path.Join(cc.namespace, NodesPath),
+	}
+	return cs.view(cc.NodeID)
+}
+
+// forget removes a task from the claimed set and returns true if it was
+// present.
+func (cc *ConsulCoordinator) forget(taskID string) bool {
+	cc.taskL.Lock()
+	defer cc.taskL.Unlock()
+	if !cc.tasks[taskID] {
+		return false
+	}
+	delete(cc.tasks, taskID)
+	return true
+}
+
+// Release unlocks the claim key if it's still held by this node's session.
+func (cc *ConsulCoordinator) Release(taskID string) {
+	if !cc.forget(taskID) {
+		metafora.Debugf("Cannot release task %s: not claimed.", taskID)
+		return
+	}
+
+	key := cc.ownerKey(taskID)
+	if _, _, err := cc.Client.KV().Release(&api.KVPair{Key: key, Session: cc.session}, nil); err != nil {
+		metafora.Warnf("Error releasing task %s: %v", taskID, err)
+	}
+}
+
+// Done deletes the task if it's still owned by this node's session.
+func (cc *ConsulCoordinator) Done(taskID string) {
+	if !cc.forget(taskID) {
+		metafora.Debugf("Cannot mark task %s done: not claimed.", taskID)
+		return
+	}
+
+	kv := cc.Client.KV()
+	owner, _, err := kv.Get(cc.ownerKey(taskID), nil)
+	if err != nil {
+		metafora.Errorf("Error deleting task %s: %v", taskID, err)
+		return
+	}
+	if owner == nil || owner.Session != cc.session {
+		metafora.Warnf("Not deleting task %s: claim lost.", taskID)
+		return
+	}
+
+	key := cc.taskKey(taskID)
+	if _, err := kv.Delete(key, nil); err != nil {
+		metafora.Errorf("Error deleting task %s: %v", taskID, err)
+		return
+	}
+	if _, err := kv.DeleteTree(key+"/", nil); err != nil {
+		metafora.Errorf("Error deleting task %s: %v", taskID, err)
+	}
+}
+
+// Command blocks until a command for this node is received from the broker
+// by the coordinator.
+func (cc *ConsulCoordinator) Command() (metafora.Command, error) {
+	var index uint64
+	for {
+		if cc.isClosed() {
+			return nil, nil
+		}
+
+		pairs, newIndex, err := cc.list(cc.commandPath+"/", index)
+		if err != nil {
+			if cc.isClosed() {
+				return nil, nil
+			}
+			metafora.Errorf("%s Error getting commands: %v", cc.commandPath, err)
+			return nil, err
+		}
+
+		// Keys are returned sorted, so commands are handled in order
+		for _, kv := range pairs {
+			if cmd := cc.parseCommand(kv); cmd != nil {
+				return cmd, nil
+			}
+		}
+		index = newIndex
+	}
+}
+
+// parseCommand deletes the command key and unmarshals its value.
+func (cc *ConsulCoordinator) parseCommand(kv *api.KVPair) metafora.Command {
+	if _, err := cc.Client.KV().Delete(kv.Key, nil); err != nil {
+		metafora.Errorf("Error deleting handled command %s: %v", kv.Key, err)
+	}
+
+	cmd, err := metafora.UnmarshalCommand(kv.Value)
+	if err != nil {
+		metafora.Errorf("Invalid command %s: %v", kv.Key, err)
+		return nil
+	}
+	return cmd
+}
+
+// Close stops the coordinator and causes blocking Watch and Command methods to
+// return zero values. The node's session is destroyed which removes the node
+// key and any claims still held.
+func (cc *ConsulCoordinator) Close() {
+	cc.closeL.Lock()
+	if cc.closed {
+		cc.closeL.Unlock()
+		return
+	}
+	cc.closed = true
+	cc.closeL.Unlock()
+
+	cc.cancel()
+
+	// Stopping the renewer destroys the session
+	close(cc.stop)
+	if cc.session != "" {
+		<-cc.renewed
+	}
+
+	// Pending commands are lost on shutdown
+	if _, err := cc.Client.KV().DeleteTree(cc.nodePath+"/", nil); err != nil {
+		metafora.Errorf("Error deleting node path %s: %v", cc.nodePath, err)
+	}
+}
@@ -0,0 +1,219 @@
+package m_consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lytics/metafora"
+	"github.com/lytics/metafora/internal/coordtest"
+)
+
+const (
+	namespace = "metaforatests"
+	nodeID    = "node1"
+)
+
+// newCoord creates and initializes a coordinator with a short session TTL.
+func newCoord(t *testing.T, f *fakeConsul, node string) (*ConsulCoordinator, *coordtest.Ctx) {
+	c := NewConsulCoordinator(node, namespace, f.Client(t)).(*ConsulCoordinator)
+	c.SessionTTL = "1s"
+	return c, coordtest.Init(t, c)
+}
+
+// Ensure Watch returns new tasks, claims are exclusive, and released tasks
+// are picked up by other nodes.
+func TestWatchClaimRelease(t *testing.T) {
+	t.Parallel()
+	f := newFakeConsul(t)
+	defer f.Close()
+
+	coord1, _ := newCoord(t, f, nodeID)
+	defer coord1.Close()
+	coord2, _ := newCoord(t, f, "node2")
+	defer coord2.Close()
+
+	res := coordtest.Watch(t, coord1)
+	time.Sleep(50 * time.Millisecond)
+	if err := NewClient(namespace, f.Client(t)).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	coordtest.RecvTask(t, res, "task1")
+
+	token1, ok := coord1.FencedClaim("task1")
+	if !ok {
+		t.Fatal("coord1 unable to claim task1")
+	}
+	if coord2.Claim("task1") {
+		t.Fatal("coord2 claimed a task already claimed by coord1")
+	}
+
+	res = coordtest.Watch(t, coord2)
+	select {
+	case task := <-res:
+		t.Fatalf("Watch returned claimed task %q", task)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	coord1.Release("task1")
+	coordtest.RecvTask(t, res, "task1")
+	token2, ok := coord2.FencedClaim("task1")
+	if !ok {
+		t.Fatal("coord2 unable to claim released task1")
+	}
+	if token2 <= token1 {
+		t.Fatalf("Expected fencing token > %d but received %d", token1, token2)
+	}
+	if coord1.Claim("missing") {
+		t.Fatal("Claimed a task that doesn't exist")
+	}
+}
+
+// Ensure claims are kept alive past the session TTL and deleted on Done.
+func TestRenewAndDone(t *testing.T) {
+	t.Parallel()
+	f := newFakeConsul(t)
+	defer f.Close()
+
+	coord1, ctx := newCoord(t, f, nodeID)
+	defer coord1.Close()
+	coord2, _ := newCoord(t, f, "node2")
+	defer coord2.Close()
+
+	if err := NewClient(namespace, f.Client(t)).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord1.Claim("task1") {
+		t.Fatal("Unable to claim task1")
+	}
+
+	time.Sleep(2 * time.Second)
+	if coord2.Claim("task1") {
+		t.Fatal("Claim expired despite session being renewed")
+	}
+	if len(ctx.LostTasks) > 0 {
+		t.Fatalf("Unexpectedly lost task %s", <-ctx.LostTasks)
+	}
+
+	coord1.Done("task1")
+	if coord2.Claim("task1") {
+		t.Fatal("Claimed a done task")
+	}
+}
+
+// Ensure all tasks are lost and the coordinator closed when its session is
+// invalidated.
+func TestSessionLost(t *testing.T) {
+	t.Parallel()
+	f := newFakeConsul(t)
+	defer f.Close()
+
+	coord, ctx := newCoord(t, f, nodeID)
+	defer coord.Close()
+
+	if err := NewClient(namespace, f.Client(t)).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord.Claim("task1") {
+		t.Fatal("Unable to claim task1")
+	}
+
+	if _, err := f.Client(t).Session().Destroy(coord.session, nil); err != nil {
+		t.Fatalf("Error destroying session: %v", err)
+	}
+
+	select {
+	case task := <-ctx.LostTasks:
+		if task != "task1" {
+			t.Fatalf("Lost unexpected task: %s", task)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Task wasn't lost after session was invalidated")
+	}
+	coordtest.RecvTask(t, coordtest.Watch(t, coord), "")
+}
+
+// Ensure the Consumer is notified when nodes join or leave.
+func TestNodesChanged(t *testing.T) {
+	t.Parallel()
+	f := newFakeConsul(t)
+	defer f.Close()
+
+	coord1, ctx := newCoord(t, f, "node1")
+	defer coord1.Close()
+
+	coord2, _ := newCoord(t, f, "node2")
+	select {
+	case <-ctx.Changes:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Node joining wasn't noticed")
+	}
+
+	coord2.Close()
+	select {
+	case <-ctx.Changes:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Node leaving wasn't noticed")
+	}
+}
+
+// Ensure commands are received by their node and Command exits on Close.
+func TestCommand(t *testing.T) {
+	t.Parallel()
+	f := newFakeConsul(t)
+	defer f.Close()
+
+	coord, _ := newCoord(t, f, nodeID)
+
+	if err := NewClient(namespace, f.Client(t)).SubmitCommand(nodeID, metafora.CommandFreeze()); err != nil {
+		t.Fatalf("Error submitting command: %v", err)
+	}
+	cmd, err := coord.Command()
+	if err != nil {
+		t.Fatalf("Error receiving command: %v", err)
+	}
+	if cmd.Name() != metafora.CommandFreeze().Name() {
+		t.Fatalf("Expected freeze command but received: %s", cmd.Name())
+	}
+
+	cmds := make(chan metafora.Command, 1)
+	go func() {
+		cmd, _ := coord.Command()
+		cmds <- cmd
+	}()
+	time.Sleep(50 * time.Millisecond)
+	coord.Close()
+	select {
+	case cmd := <-cmds:
+		if cmd != nil {
+			t.Fatalf("Expected nil command after Close but received: %s", cmd.Name())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Command didn't exit after Close")
+	}
+}
+
+// Ensure the consumer runs tasks end to end.
+func TestConsumer(t *testing.T) {
+	t.Parallel()
+	f := newFakeConsul(t)
+	defer f.Close()
+
+	ran := make(chan string, 1)
+	h := metafora.SimpleHandler(func(task string, stop <-chan bool) bool {
+		ran <- task
+		return true
+	})
+	client := f.Client(t)
+	coord := NewConsulCoordinator(nodeID, namespace, client)
+	con, err := metafora.NewConsumer(coord, h, NewFairBalancer(nodeID, namespace, client))
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	go con.Run()
+	defer con.Shutdown()
+
+	if err := NewClient(namespace, client).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	coordtest.RecvTask(t, ran, "task1")
+}
@@ -0,0 +1,292 @@
+package m_consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeConsul is an in-process stand-in for Consul's HTTP API which implements
+// just enough of the KV and session endpoints for the coordinator, client, and
+// cluster state to be tested.
+type fakeConsul struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{} // closed and replaced on every write
+	kvs      map[string]*api.KVPair
+	sessions map[string]*fakeSession
+	nextID   int
+
+	stop chan struct{}
+}
+
+type fakeSession struct {
+	ttl      time.Duration
+	expires  time.Time
+	behavior string
+}
+
+func newFakeConsul(t *testing.T) *fakeConsul {
+	f := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		kvs:      map[string]*api.KVPair{},
+		sessions: map[string]*fakeSession{},
+		stop:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/session/", f.session)
+	mux.HandleFunc("/v1/kv/", f.kv)
+	f.srv = httptest.NewServer(mux)
+	go f.reaper()
+	return f
+}
+
+func (f *fakeConsul) Close() {
+	close(f.stop)
+	f.srv.CloseClientConnections()
+	f.srv.Close()
+}
+
+// Client returns a Consul API client connected to the fake server.
+func (f *fakeConsul) Client(t *testing.T) *api.Client {
+	client, err := api.NewClient(&api.Config{Address: f.srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("Error creating consul client: %v", err)
+	}
+	return client
+}
+
+// bump increments the index and wakes blocking queries. Must be called with
+// mu held.
+func (f *fakeConsul) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// reaper invalidates sessions whose TTL has expired.
+func (f *fakeConsul) reaper() {
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		f.mu.Lock()
+		for id, s := range f.sessions {
+			if time.Now().After(s.expires) {
+				f.invalidate(id)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// invalidate destroys a session and deletes or unlocks the keys it holds.
+// Must be called with mu held.
+func (f *fakeConsul) invalidate(id string) {
+	s, ok := f.sessions[id]
+	if !ok {
+		return
+	}
+	delete(f.sessions, id)
+	for key, kv := range f.kvs {
+		if kv.Session != id {
+			continue
+		}
+		if s.behavior == api.SessionBehaviorDelete {
+			delete(f.kvs, key)
+		} else {
+			kv.Session = ""
+		}
+	}
+	f.bump()
+}
+
+func (f *fakeConsul) session(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	op := strings.TrimPrefix(r.URL.Path, "/v1/session/")
+	switch {
+	case op == "create":
+		// Durations are sent as strings, so SessionEntry can't be used
+		entry := struct{ TTL, Behavior string }{}
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl, _ := time.ParseDuration(entry.TTL)
+		f.nextID++
+		id := fmt.Sprintf("session-%d", f.nextID)
+		f.sessions[id] = &fakeSession{ttl: ttl, expires: time.Now().Add(ttl), behavior: entry.Behavior}
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(op, "renew/"):
+		id := strings.TrimPrefix(op, "renew/")
+		s, ok := f.sessions[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.expires = time.Now().Add(s.ttl)
+		json.NewEncoder(w).Encode([]*api.SessionEntry{{ID: id, TTL: s.ttl.String()}})
+	case strings.HasPrefix(op, "destroy/"):
+		f.invalidate(strings.TrimPrefix(op, "destroy/"))
+		w.Write([]byte("true"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeConsul) kv(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	params := r.URL.Query()
+	switch r.Method {
+	case "GET":
+		f.get(w, r, key)
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		ok, err := f.put(key, body, params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, ok)
+	case "DELETE":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		fmt.Fprint(w, f.delete(key, params))
+	}
+}
+
+// get handles reads including blocking queries.
+func (f *fakeConsul) get(w http.ResponseWriter, r *http.Request, key string) {
+	params := r.URL.Query()
+	waitIndex, _ := strconv.ParseUint(params.Get("index"), 10, 64)
+	wait, err := time.ParseDuration(params.Get("wait"))
+	if err != nil {
+		wait = 5 * time.Minute
+	}
+	timeout := time.After(wait)
+
+	f.mu.Lock()
+	for waitIndex > 0 && f.index <= waitIndex {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+		case <-r.Context().Done():
+			return
+		case <-f.stop:
+			return
+		}
+		f.mu.Lock()
+		if changed == f.changed {
+			// Timed out
+			break
+		}
+	}
+	_, recurse := params["recurse"]
+	keys := []string{}
+	for k := range f.kvs {
+		if k == key || (recurse && strings.HasPrefix(k, key)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	pairs := api.KVPairs{}
+	for _, k := range keys {
+		cp := *f.kvs[k]
+		pairs = append(pairs, &cp)
+	}
+	index := f.index
+	f.mu.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+// put handles writes, lock acquisitions, and releases. Must be called with
+// mu held.
+func (f *fakeConsul) put(key string, body []byte, params map[string][]string) (bool, error) {
+	kv := f.kvs[key]
+	switch {
+	case params["acquire"] != nil:
+		session := params["acquire"][0]
+		if _, ok := f.sessions[session]; !ok {
+			return false, fmt.Errorf("invalid session %q", session)
+		}
+		if kv != nil && kv.Session != "" && kv.Session != session {
+			return false, nil
+		}
+		if kv == nil {
+			kv = &api.KVPair{Key: key, CreateIndex: f.index + 1}
+			f.kvs[key] = kv
+		}
+		if kv.Session != session {
+			kv.LockIndex++
+		}
+		kv.Session = session
+	case params["release"] != nil:
+		if kv == nil || kv.Session != params["release"][0] {
+			return false, nil
+		}
+		kv.Session = ""
+	case params["cas"] != nil:
+		cas, _ := strconv.ParseUint(params["cas"][0], 10, 64)
+		if (cas == 0 && kv != nil) || (cas > 0 && (kv == nil || kv.ModifyIndex != cas)) {
+			return false, nil
+		}
+		fallthrough
+	default:
+		if kv == nil {
+			kv = &api.KVPair{Key: key, CreateIndex: f.index + 1}
+			f.kvs[key] = kv
+		}
+	}
+	if params["release"] == nil {
+		kv.Value = body
+	}
+	kv.ModifyIndex = f.index + 1
+	f.bump()
+	return true, nil
+}
+
+// delete handles deletes of single keys and trees. Must be called with mu
+// held.
+func (f *fakeConsul) delete(key string, params map[string][]string) bool {
+	if params["cas"] != nil {
+		cas, _ := strconv.ParseUint(params["cas"][0], 10, 64)
+		if kv := f.kvs[key]; kv == nil || kv.ModifyIndex != cas {
+			return false
+		}
+	}
+	_, recurse := params["recurse"]
+	for k := range f.kvs {
+		if k == key || (recurse && strings.HasPrefix(k, key)) {
+			delete(f.kvs, k)
+		}
+	}
+	f.bump()
+	return true
+}
@@ -3,6 +3,7 @@ package m_etcd
 import (
 	"encoding/json"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/coreos/go-etcd/etcd"
@@ -21,6 +22,18 @@ func NewFairBalancer(nodeid, namespace string, client *etcd.Client) metafora.Bal
 	return metafora.NewDefaultFairBalancer(nodeid, &e)
 }
 
+// NewWeightedFairBalancer creates a new metafora.WeightedFairBalancer that
+// uses etcd for summing the weight of tasks per node.
+func NewWeightedFairBalancer(nodeid, namespace string, client *etcd.Client) metafora.Balancer {
+	namespace = "/" + strings.Trim(namespace, "/ ")
+	e := etcdClusterState{
+		client:   client,
+		taskPath: path.Join(namespace, "tasks"),
+		nodePath: path.Join(namespace, "nodes"),
+	}
+	return metafora.NewWeightedFairBalancer(nodeid, &e)
+}
+
 // Checks the current state of an Etcd cluster
 type etcdClusterState struct {
 	client   *etcd.Client
@@ -29,17 +42,61 @@ type etcdClusterState struct {
 }
 
 func (e *etcdClusterState) NodeTaskCount() (map[string]int, error) {
-	const sort = false
+	const weighted = false
+	state, _, _, err := e.nodeTasks(weighted)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(state))
+	for node, n := range state {
+		counts[node] = int(n)
+	}
+	return counts, nil
+}
+
+func (e *etcdClusterState) NodeTaskWeight() (map[string]float64, error) {
+	const weighted = true
+	state, _, _, err := e.nodeTasks(weighted)
+	return state, err
+}
+
+// view returns a metafora.ClusterView for nodeID.
+func (e *etcdClusterState) view(nodeID string) (metafora.ClusterView, error) {
+	const weighted = false
+	state, backlog, priority, err := e.nodeTasks(weighted)
+	if err != nil {
+		return metafora.ClusterView{}, err
+	}
+	view := metafora.ClusterView{
+		NodeID:          nodeID,
+		Nodes:           make([]string, 0, len(state)),
+		NodeTasks:       make(map[string]int, len(state)),
+		Backlog:         backlog,
+		BacklogPriority: priority,
+	}
+	for node, n := range state {
+		view.Nodes = append(view.Nodes, node)
+		view.NodeTasks[node] = int(n)
+	}
+	sort.Strings(view.Nodes)
+	return view, nil
+}
+
+// nodeTasks sums the tasks claimed by each live node, counts unclaimed tasks,
+// and finds the highest priority of unclaimed tasks. Each task counts as 1
+// unless weighted is true in which case its props weight is used.
+func (e *etcdClusterState) nodeTasks(weighted bool) (state map[string]float64, backlog, priority int, err error) {
+	const sorted = false
 	const recursive = true
-	state := map[string]int{}
+	state = map[string]float64{}
 
 	// First initialize state with nodes as keys
-	resp, err := e.client.Get(e.nodePath, sort, recursive)
+	resp, err := e.client.Get(e.nodePath, sorted, recursive)
 	if err != nil {
-		return nil, err
+		return nil, 0, 0, err
 	}
 	if resp == nil || resp.Node == nil {
-		return state, nil
+		return state, 0, 0, nil
 	}
 
 	for _, node := range resp.Node.Nodes {
@@ -47,34 +104,53 @@ func (e *etcdClusterState) NodeTaskCount() (map[string]int, error) {
 	}
 
 	// Then count how many tasks each node has
-	resp, err = e.client.Get(e.taskPath, sort, recursive)
+	resp, err = e.client.Get(e.taskPath, sorted, recursive)
 	if err != nil {
-		return nil, err
+		return nil, 0, 0, err
 	}
 
 	// No current tasks
 	if resp == nil {
-		return state, nil
+		return state, 0, 0, nil
 	}
 
 	// Get the list of all claimed work, create a map of the counts and
 	// node values
 	// We ignore tasks which have no claims
 	for _, task := range resp.Node.Nodes {
-		for _, claim := range task.Nodes {
-			if path.Base(claim.Key) == OwnerMarker {
+		owner := ""
+		props := metafora.TaskProps{}
+		for _, child := range task.Nodes {
+			switch path.Base(child.Key) {
+			case OwnerMarker:
 				val := ownerValue{}
-				if err := json.Unmarshal([]byte(claim.Value), &val); err == nil {
-					// We want to only include those nodes which were initially included,
-					// as some nodes may be shutting down, etc, and should not be counted
-					_, ok := state[val.Node]
-					if ok {
-						state[val.Node]++
-					}
+				if err := json.Unmarshal([]byte(child.Value), &val); err == nil {
+					owner = val.Node
 				}
+			case PropsMarker:
+				json.Unmarshal([]byte(child.Value), &props)
+			}
+		}
+
+		if owner == "" {
+			if backlog == 0 || props.Priority > priority {
+				priority = props.Priority
 			}
+			backlog++
+			continue
+		}
+
+		// We want to only include those nodes which were initially included,
+		// as some nodes may be shutting down, etc, and should not be counted
+		if _, ok := state[owner]; !ok {
+			continue
+		}
+		if weighted {
+			state[owner] += props.TaskWeight()
+		} else {
+			state[owner]++
 		}
 	}
 
-	return state, nil
+	return state, backlog, priority, nil
 }
@@ -92,6 +92,12 @@ func TestFairBalancer(t *testing.T) {
 // Fair balancer shouldn't consider a shutting-down node
 // See https://github.com/lytics/metafora/issues/92
 func TestFairBalancerShutdown(t *testing.T) {
+	// node2 is still registered, and may be nominated to claim handed off
+	// tasks, while it's shutting down. Keep the window shorter than the waits
+	// below so node1 can claim those tasks.
+	defer func(w time.Duration) { metafora.HandoffWindow = w }(metafora.HandoffWindow)
+	metafora.HandoffWindow = 500 * time.Millisecond
+
 	coord1, etcdc := setupEtcd(t)
 	coord2 := NewEtcdCoordinator("node2", namespace, etcdc).(*EtcdCoordinator)
 
@@ -0,0 +1,129 @@
+package m_etcd
+
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/lytics/metafora"
+)
+
+// checkpointValue is stored in a task's checkpoint key.
+type checkpointValue struct {
+	Token uint64 `json:"token"`
+	Data  []byte `json:"data"`
+}
+
+// Checkpoint stores data in the task's checkpoint key if the claim with the
+// given fencing token still owns the task.
+//
+// Every claim writes its token to the checkpoint key before its handler
+// starts (see fenceCheckpoint), and checkpoints are only swapped by index
+// while the key holds the writer's token. So once a newer claim has started
+// older claims can't overwrite its checkpoints, and any they wrote before are
+// restored by the newer claim. The key is never created here, so checkpoints
+// can't recreate a task which is done.
+func (ec *EtcdCoordinator) Checkpoint(taskID string, token uint64, data []byte) error {
+	const sorted = false
+	const recursive = false
+	key := ec.checkpointKey(taskID)
+	body, err := json.Marshal(&checkpointValue{Token: token, Data: data})
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := ec.Client.Get(key, sorted, recursive)
+		if isEtcdError(err, EcodeKeyNotFound) {
+			return metafora.ErrStaleClaim
+		}
+		if err != nil {
+			return err
+		}
+		prev := checkpointValue{}
+		if err := json.Unmarshal([]byte(resp.Node.Value), &prev); err != nil {
+			return err
+		}
+		if prev.Token != token {
+			return metafora.ErrStaleClaim
+		}
+
+		_, err = ec.Client.CompareAndSwap(key, string(body), ForeverTTL, "", resp.Node.ModifiedIndex)
+		if isEtcdError(err, EcodeTestFailed) {
+			// Written concurrently; recheck which claim wrote it
+			continue
+		}
+		if isEtcdError(err, EcodeKeyNotFound) {
+			return metafora.ErrStaleClaim
+		}
+		return err
+	}
+}
+
+// fenceCheckpoint writes a new claim's token to the task's checkpoint key,
+// keeping its data, so Checkpoints by older claims are rejected. It's called
+// after claiming and before the claim's handler starts.
+func (ec *EtcdCoordinator) fenceCheckpoint(taskID string, token uint64) error {
+	const sorted = false
+	const recursive = false
+	key := ec.checkpointKey(taskID)
+	for {
+		val := checkpointValue{}
+		resp, err := ec.Client.Get(key, sorted, recursive)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal([]byte(resp.Node.Value), &val); err != nil {
+				return err
+			}
+			if val.Token > token {
+				return metafora.ErrStaleClaim
+			}
+		case !isEtcdError(err, EcodeKeyNotFound):
+			return err
+		}
+
+		val.Token = token
+		body, err := json.Marshal(&val)
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			_, err = ec.Client.Create(key, string(body), ForeverTTL)
+		} else {
+			_, err = ec.Client.CompareAndSwap(key, string(body), ForeverTTL, "", resp.Node.ModifiedIndex)
+		}
+		if isEtcdError(err, EcodeNodeExist) || isEtcdError(err, EcodeTestFailed) || isEtcdError(err, EcodeKeyNotFound) {
+			// Written concurrently by an older claim; fence again
+			continue
+		}
+		return err
+	}
+}
+
+// Restore returns the data in the task's checkpoint key or nil if it has none.
+func (ec *EtcdCoordinator) Restore(taskID string) ([]byte, error) {
+	const sorted = false
+	const recursive = false
+	resp, err := ec.Client.Get(ec.checkpointKey(taskID), sorted, recursive)
+	if isEtcdError(err, EcodeKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	val := checkpointValue{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), &val); err != nil {
+		return nil, err
+	}
+	return val.Data, nil
+}
+
+func (ec *EtcdCoordinator) checkpointKey(taskID string) string {
+	return path.Join(ec.taskPath, taskID, CheckpointMarker)
+}
+
+// isEtcdError returns true if err is an etcd error with the given code.
+func isEtcdError(err error, code int) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == code
+}
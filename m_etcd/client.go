@@ -1,6 +1,7 @@
 package m_etcd
 
 import (
+	"encoding/json"
 	"fmt"
 	"path"
 
@@ -33,6 +34,12 @@ func (mc *mclient) tskPath(taskId string) string {
 	return fmt.Sprintf("/%s/%s/%s", mc.namespace, TasksPath, taskId)
 }
 
+// grpPath is the path to a particular group's quota, represented as a file in
+// etcd.
+func (mc *mclient) grpPath(group string) string {
+	return path.Join("/", mc.namespace, GroupsPath, group)
+}
+
 // cmdPath is the path to a particular nodeId, represented as a directory in etcd.
 func (mc *mclient) cmdPath(node string) string {
 	return path.Join("/", mc.namespace, NodesPath, node, "commands")
@@ -46,10 +53,60 @@ func (mc *mclient) SubmitTask(taskId string) error {
 	return err
 }
 
+// SubmitTaskProps creates a new taskId with its properties stored as JSON in
+// the task's props key. The task directory is created implicitly so watchers
+// never see the task without its properties.
+func (mc *mclient) SubmitTaskProps(taskId string, props metafora.TaskProps) error {
+	body, err := json.Marshal(&props)
+	if err != nil {
+		return err
+	}
+	fullpath := path.Join(mc.tskPath(taskId), PropsMarker)
+	if _, err := mc.etcd.Create(fullpath, string(body), ForeverTTL); err != nil {
+		return err
+	}
+	metafora.Debugf("task submitted [%s]", fullpath)
+	return nil
+}
+
+// SetGroupQuota stores a group's quota as JSON in the group's key.
+func (mc *mclient) SetGroupQuota(group string, quota metafora.GroupQuota) error {
+	body, err := json.Marshal(&quota)
+	if err != nil {
+		return err
+	}
+	_, err = mc.etcd.Set(mc.grpPath(group), string(body), ForeverTTL)
+	return err
+}
+
+// Groups returns the quota and number of running and waiting tasks of every
+// group.
+func (mc *mclient) Groups() (map[string]metafora.GroupStatus, error) {
+	return readGroups(mc.etcd, path.Join("/", mc.namespace, TasksPath), mc.grpPath(""))
+}
+
+// Progress returns the progress stored in the task's progress key or the zero
+// value if it has none.
+func (mc *mclient) Progress(taskId string) (metafora.Progress, error) {
+	const sorted = false
+	const recursive = false
+	p := metafora.Progress{}
+	resp, err := mc.etcd.Get(path.Join(mc.tskPath(taskId), ProgressMarker), sorted, recursive)
+	if isEtcdError(err, EcodeKeyNotFound) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal([]byte(resp.Node.Value), &p)
+	return p, err
+}
+
 // Delete a task
 func (mc *mclient) DeleteTask(taskId string) error {
+	const recursive = true
 	fullpath := mc.tskPath(taskId)
-	_, err := mc.etcd.DeleteDir(fullpath)
+	_, err := mc.etcd.Delete(fullpath, recursive)
 	metafora.Debugf("task deleted [%s]", fullpath)
 	return err
 }
@@ -77,13 +134,16 @@ func (mc *mclient) SubmitCommand(node string, command metafora.Command) error {
 // error occured trying to get the node list. The node list may be nil if no
 // nodes are registered.
 func (mc *mclient) Nodes() ([]string, error) {
-	if res, err := mc.etcd.Get(mc.ndsPath(), false, false); err != nil && res.Node != nil && res.Node.Nodes != nil {
-		nodes := make([]string, len(res.Node.Nodes))
-		for i, n := range res.Node.Nodes {
-			nodes[i] = n.Value
-		}
-		return nodes, nil
+	res, err := mc.etcd.Get(mc.ndsPath(), false, false)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, nil
+	if res.Node == nil || res.Node.Nodes == nil {
+		return nil, nil
+	}
+	nodes := make([]string, len(res.Node.Nodes))
+	for i, n := range res.Node.Nodes {
+		nodes[i] = path.Base(n.Key)
+	}
+	return nodes, nil
 }
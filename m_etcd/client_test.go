@@ -37,12 +37,17 @@ func TestNodes(t *testing.T) {
 		t.Fatalf("AddChild %v returned error: %v", NodesDir, err)
 	}
 
-	if nodes, err := mclient.Nodes(); err != nil {
+	nodes, err := mclient.Nodes()
+	if err != nil {
 		t.Fatalf("Nodes returned error: %v", err)
-	} else {
-		for i, n := range nodes {
-			t.Logf("%v -> %v", i, n)
-		}
+	}
+	found := false
+	for i, n := range nodes {
+		t.Logf("%v -> %v", i, n)
+		found = found || n == Node1
+	}
+	if !found {
+		t.Errorf("Expected %s in nodes: %v", Node1, nodes)
 	}
 }
 
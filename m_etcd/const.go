@@ -1,11 +1,19 @@
 package m_etcd
 
 const (
-	TasksPath    = "tasks"
-	NodesPath    = "nodes"
-	CommandsPath = "commands"
-	MetadataKey  = "_metafora" // _{KEYs} are hidden files, so this will not trigger our watches
-	OwnerMarker  = "owner"
+	TasksPath        = "tasks"
+	NodesPath        = "nodes"
+	CommandsPath     = "commands"
+	BalancePath      = "balance"
+	GroupsPath       = "groups"
+	GroupClaimsPath  = "groupclaims"
+	MetadataKey      = "_metafora" // _{KEYs} are hidden files, so this will not trigger our watches
+	OwnerMarker      = "owner"
+	PropsMarker      = "props"
+	LabelsMarker     = "labels"
+	HandoffMarker    = "handoff"
+	CheckpointMarker = "checkpoint"
+	ProgressMarker   = "progress"
 
 	ForeverTTL = 0 //Ref: https://github.com/coreos/go-etcd/blob/e10c58ee110f54c2f385ac99764e8a7ca4cb13df/etcd/requests.go#L356
 
@@ -13,6 +21,7 @@ const (
 	//So to find the error codes use this ref:
 	//       https://github.com/coreos/etcd/blob/master/error/error.go#L67
 	EcodeKeyNotFound  = 100
+	EcodeTestFailed   = 101
 	EcodeNodeExist    = 105
 	EcodeExpiredIndex = 401 // The event in requested index is outdated and cleared
 )
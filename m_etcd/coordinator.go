@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
@@ -20,11 +21,16 @@ const (
 	actionExpire  = "expire"
 	actionDelete  = "delete"
 	actionCAD     = "compareAndDelete"
+	actionCAS     = "compareAndSwap"
+	actionUpdate  = "update"
 )
 
 var (
-	ClaimTTL           uint64 = 120 // seconds
-	DefaultNodePathTTL uint64 = 20  // seconds
+	// Deprecated: claims no longer expire on their own but last as long as
+	// the owning node's key. ClaimTTL is ignored.
+	ClaimTTL uint64 = 120 // seconds
+
+	DefaultNodePathTTL uint64 = 20 // seconds
 
 	// etcd actions signifying a claim key was released
 	releaseActions = map[string]bool{
@@ -39,6 +45,13 @@ var (
 		actionSet:     true,
 	}
 
+	// etcd actions signifying an existing key's value was replaced
+	changeActions = map[string]bool{
+		actionSet:    true,
+		actionCAS:    true,
+		actionUpdate: true,
+	}
+
 	restartWatchError = errors.New("index too old, need to restart watch")
 )
 
@@ -47,11 +60,19 @@ type ownerValue struct {
 }
 
 type EtcdCoordinator struct {
-	Client    *etcd.Client
-	cordCtx   metafora.CoordinatorContext
-	namespace string
-	taskPath  string
-
+	Client     *etcd.Client
+	cordCtx    metafora.CoordinatorContext
+	namespace  string
+	taskPath   string
+	groupsPath string
+
+	// claims path of each group and the group of each task reserved in it
+	groupClaimsPath string
+	reserved        map[string]string
+	reservedL       sync.Mutex
+
+	// Deprecated: claims no longer expire on their own but last as long as
+	// the owning node's key. ClaimTTL is ignored.
 	ClaimTTL uint64 // seconds
 
 	NodeID      string
@@ -61,6 +82,11 @@ type EtcdCoordinator struct {
 
 	taskManager *taskManager
 
+	// node labels for task constraints; written to etcd once registered
+	labels     map[string]string
+	registered bool
+	labelsL    sync.Mutex
+
 	// Close() closes stop channel to signal to watchers to exit
 	stop chan bool
 }
@@ -97,8 +123,13 @@ func NewEtcdCoordinator(nodeID, namespace string, client *etcd.Client) metafora.
 		Client:    client,
 		namespace: namespace,
 
-		taskPath: path.Join(namespace, TasksPath),
-		ClaimTTL: ClaimTTL, //default to the package constant, but allow it to be overwritten
+		taskPath:   path.Join(namespace, TasksPath),
+		groupsPath: path.Join(namespace, GroupsPath),
+
+		groupClaimsPath: path.Join(namespace, GroupClaimsPath),
+		reserved:        make(map[string]string),
+
+		ClaimTTL: ClaimTTL,
 
 		NodeID:      nodeID,
 		nodePath:    path.Join(namespace, NodesPath, nodeID),
@@ -122,10 +153,19 @@ func (ec *EtcdCoordinator) Init(cordCtx metafora.CoordinatorContext) error {
 	if _, err := ec.Client.CreateDir(ec.nodePath, ec.nodePathTTL); err != nil {
 		return err
 	}
-	go ec.nodeRefresher()
 	ec.upsertDir(ec.commandPath, ForeverTTL)
+	ec.labelsL.Lock()
+	ec.registered = true
+	err := ec.writeLabels()
+	ec.labelsL.Unlock()
+	if err != nil {
+		return err
+	}
 
-	ec.taskManager = newManager(cordCtx, ec.Client, ec.taskPath, ec.NodeID, ec.ClaimTTL)
+	ec.taskManager = newManager(cordCtx, ec.Client, ec.taskPath, path.Join(ec.namespace, NodesPath), ec.NodeID)
+	go ec.nodeRefresher()
+	go ec.nodeWatcher()
+	go ec.claimWatcher()
 	return nil
 }
 
@@ -165,12 +205,13 @@ func (ec *EtcdCoordinator) upsertDir(path string, ttl uint64) {
 	}
 }
 
-// nodeRefresher is in charge of keeping the node entry in etcd alive. If it's
-// unable to communicate with etcd it must shutdown the coordinator.
+// nodeRefresher is in charge of keeping the node entry in etcd alive. Claims
+// are only valid as long as the node entry exists, so this single refresh
+// keeps all of the node's claims alive. If it's unable to communicate with
+// etcd all tasks are lost and it must shutdown the coordinator.
 //
-// watch retries on errors and taskmgr calls Lost(task) on tasks it can't
-// refresh, so it's up to nodeRefresher to cause the coordinator to close if
-// it's unable to communicate with etcd.
+// watch retries on errors, so it's up to nodeRefresher to cause the
+// coordinator to close if it's unable to communicate with etcd.
 func (ec *EtcdCoordinator) nodeRefresher() {
 	ttl := ec.nodePathTTL >> 1 // have some leeway before ttl expires
 	if ttl < 1 {
@@ -186,6 +227,7 @@ func (ec *EtcdCoordinator) nodeRefresher() {
 			if err := ec.refreshBy(deadline); err != nil {
 				// We're in a bad state; shut everything down
 				metafora.Errorf("Unable to refresh node key before deadline %s. Last error: %v", deadline, err)
+				ec.taskManager.loseAll()
 				ec.Close()
 			}
 		}
@@ -207,6 +249,10 @@ func (ec *EtcdCoordinator) refreshBy(deadline time.Time) (err error) {
 			// It worked!
 			return nil
 		}
+		if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == EcodeKeyNotFound {
+			// Node key expired, so other nodes may have already stolen our claims
+			return err
+		}
 		metafora.Warnf("Unexpected error updating node key: %v", err)
 		transport.CloseIdleConnections()   // paranoia; let's get fresh connections on errors.
 		time.Sleep(500 * time.Millisecond) // rate limit retries a bit
@@ -215,6 +261,176 @@ func (ec *EtcdCoordinator) refreshBy(deadline time.Time) (err error) {
 	return err
 }
 
+// nodeWatcher watches the nodes path to release the claims of nodes whose
+// keys expire and to notify the Consumer of membership changes. Like
+// nodeRefresher it runs once per node regardless of the number of tasks
+// claimed. Claims being deleted or stolen are noticed by claimWatcher.
+func (ec *EtcdCoordinator) nodeWatcher() {
+	nodePath := path.Join(ec.namespace, NodesPath)
+	for {
+		index, err := ec.reapClaims()
+		if err != nil {
+			metafora.Errorf("Error reaping claims: %v", err)
+			select {
+			case <-ec.stop:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+
+		for {
+			resp, err := ec.watch(nodePath, index)
+			if err == etcd.ErrWatchStoppedByUser {
+				return
+			}
+			if err != nil {
+				// Events may have been missed, so reap claims again
+				break
+			}
+			ec.parseNodeEvent(resp)
+			index = resp.Node.ModifiedIndex
+		}
+	}
+}
+
+// reapClaims deletes the claims of dead nodes. Returns the etcd index to
+// start watching nodes from.
+func (ec *EtcdCoordinator) reapClaims() (uint64, error) {
+	const sorted = false
+	const recursive = true
+	nodes, err := ec.Client.Get(path.Join(ec.namespace, NodesPath), sorted, recursive)
+	if err != nil {
+		return 0, err
+	}
+	alive := map[string]bool{}
+	for _, node := range nodes.Node.Nodes {
+		alive[path.Base(node.Key)] = true
+	}
+
+	resp, err := ec.Client.Get(ec.taskPath, sorted, recursive)
+	if err != nil {
+		return 0, err
+	}
+	owners := map[string]string{}
+	for _, task := range resp.Node.Nodes {
+		for _, claim := range task.Nodes {
+			if path.Base(claim.Key) == OwnerMarker {
+				owners[path.Base(task.Key)] = claim.Value
+			}
+		}
+	}
+
+	reaped := map[string]bool{}
+	for _, value := range owners {
+		owner := ownerValue{}
+		if err := json.Unmarshal([]byte(value), &owner); err != nil {
+			continue
+		}
+		if !alive[owner.Node] && !reaped[owner.Node] {
+			reaped[owner.Node] = true
+			ec.taskManager.reap(owner.Node)
+		}
+	}
+	return nodes.EtcdIndex, nil
+}
+
+// parseNodeEvent handles a single event from nodeWatcher. Events for keys
+// within node directories such as labels and commands are ignored.
+func (ec *EtcdCoordinator) parseNodeEvent(resp *etcd.Response) {
+	key := strings.TrimPrefix(resp.Node.Key, path.Join(ec.namespace, NodesPath)+"/")
+	if strings.Contains(key, "/") || key == ec.NodeID {
+		// Our own node key's expiration is handled by nodeRefresher
+		return
+	}
+	switch {
+	case releaseActions[resp.Action]:
+		metafora.Infof("Node %s is gone; releasing its claims", key)
+		ec.taskManager.reap(key)
+		ec.cordCtx.NodesChanged()
+	case newActions[resp.Action]:
+		metafora.Infof("Node %s joined", key)
+		ec.cordCtx.NodesChanged()
+	}
+}
+
+// claimWatcher watches the tasks path for this node's claims being deleted
+// -- along with their task -- or replaced by another node's claim, and loses
+// those tasks. Like nodeWatcher it runs once per node regardless of the number
+// of tasks claimed.
+func (ec *EtcdCoordinator) claimWatcher() {
+	for {
+		index, err := ec.verifyClaims()
+		if err != nil {
+			metafora.Errorf("Error verifying claims: %v", err)
+			select {
+			case <-ec.stop:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+
+		for {
+			resp, err := ec.watch(ec.taskPath, index)
+			if err == etcd.ErrWatchStoppedByUser {
+				return
+			}
+			if err != nil {
+				// Events may have been missed, so verify claims again
+				break
+			}
+			ec.parseClaimEvent(resp)
+			index = resp.Node.ModifiedIndex
+		}
+	}
+}
+
+// verifyClaims loses tasks whose claims no longer belong to this node.
+// Returns the etcd index to start watching tasks from.
+func (ec *EtcdCoordinator) verifyClaims() (uint64, error) {
+	const sorted = false
+	const recursive = true
+	resp, err := ec.Client.Get(ec.taskPath, sorted, recursive)
+	if err != nil {
+		return 0, err
+	}
+	owners := map[string]string{}
+	for _, task := range resp.Node.Nodes {
+		for _, claim := range task.Nodes {
+			if path.Base(claim.Key) == OwnerMarker {
+				owners[path.Base(task.Key)] = claim.Value
+			}
+		}
+	}
+	for taskID := range ec.taskManager.claims() {
+		if owners[taskID] != ec.taskManager.owner {
+			metafora.Warnf("Claim of task %s lost", taskID)
+			ec.taskManager.lostAt(taskID, resp.EtcdIndex)
+		}
+	}
+	return resp.EtcdIndex, nil
+}
+
+// parseClaimEvent handles a single event from claimWatcher. Released and done
+// claims are forgotten before being deleted, so any deletion of a claimed
+// task or change of its owner key means it's lost.
+func (ec *EtcdCoordinator) parseClaimEvent(resp *etcd.Response) {
+	parts := strings.Split(strings.TrimPrefix(resp.Node.Key, ec.taskPath+"/"), "/")
+	taskID := parts[0]
+	var lost bool
+	switch {
+	case len(parts) == 1:
+		lost = releaseActions[resp.Action]
+	case len(parts) == 2 && parts[1] == OwnerMarker:
+		lost = releaseActions[resp.Action] || (changeActions[resp.Action] && resp.Node.Value != ec.taskManager.owner)
+	}
+	if lost && ec.taskManager.claimed(taskID) {
+		metafora.Warnf("Claim of task %s lost: %s", taskID, resp.Action)
+		ec.taskManager.lostAt(taskID, resp.Node.ModifiedIndex)
+	}
+}
+
 // Watch will do a blocking etcd watch on taskPath until a claimable task is
 // found or Close() is called.
 //
@@ -241,15 +457,40 @@ startWatch:
 		// tasks up to that point.
 		index := resp.EtcdIndex
 
-		// Act like existing keys are newly created
+		quotas, err := readQuotas(ec.Client, ec.groupsPath)
+		if err != nil {
+			metafora.Warnf("%s Error reading group quotas: %v", ec.groupsPath, err)
+		}
+		groups := groupStatus(resp.Node, quotas)
+
+		// Act like existing keys are newly created and offer the highest
+		// priority claimable task first, skipping tasks handed off to other
+		// nodes and groups over their quota
+		best, bestPriority := "", 0
 		for _, node := range resp.Node.Nodes {
 			if node.ModifiedIndex > index {
 				// Record the max modified index to keep Watch from picking up redundant events
 				index = node.ModifiedIndex
 			}
-			if task, ok := ec.parseTask(&etcd.Response{Action: "create", Node: node}); ok {
-				return task, nil
+			task, ok := ec.parseTask(&etcd.Response{Action: "create", Node: node})
+			if !ok {
+				continue
+			}
+			if h, ok := nodeHandoff(node); ok && h.Node != ec.NodeID && !h.expired() {
+				metafora.Debugf("Skipping task %s: handed off to %s", task, h.Node)
+				continue
+			}
+			props := nodeProps(node)
+			if err := metafora.CheckGroupQuota(props.Group, groups); err != nil {
+				metafora.Debugf("Skipping task %s: %v", task, err)
+				continue
 			}
+			if best == "" || props.Priority > bestPriority {
+				best, bestPriority = task, props.Priority
+			}
+		}
+		if best != "" {
+			return best, nil
 		}
 
 		// Start blocking watch
@@ -262,6 +503,8 @@ startWatch:
 				if err == etcd.ErrWatchStoppedByUser {
 					return "", nil
 				}
+				metafora.Errorf("%s Error watching tasks: %v", ec.taskPath, err)
+				return "", err
 			}
 
 			// Found a claimable task! Return it.
@@ -269,8 +512,22 @@ startWatch:
 				return task, nil
 			}
 
-			// Task wasn't claimable, start next watch from where the last watch ended
-			index = resp.EtcdIndex
+			// A finished task may allow tasks skipped due to their group's quota
+			// to be claimed, so check all tasks again
+			if len(groups) > 0 && releaseActions[resp.Action] && path.Dir(resp.Node.Key) == ec.taskPath {
+				continue startWatch
+			}
+
+			// Tasks skipped while handed off to another node may be claimed once
+			// their handoff key expires
+			if releaseActions[resp.Action] && path.Base(resp.Node.Key) == HandoffMarker {
+				continue startWatch
+			}
+
+			// Task wasn't claimable, start next watch after this event. The
+			// response's EtcdIndex may be past events which haven't been received
+			// yet, such as a release right after a handoff.
+			index = resp.Node.ModifiedIndex
 		}
 	}
 }
@@ -298,6 +555,12 @@ func (ec *EtcdCoordinator) parseTask(resp *etcd.Response) (task string, ok bool)
 		return parts[2], true
 	}
 
+	// Tasks submitted with properties are created by creating their props key
+	if newActions[resp.Action] && len(parts) == 4 && parts[3] == PropsMarker {
+		metafora.Debugf("Received new task with properties: %s", parts[2])
+		return parts[2], true
+	}
+
 	// If a claim key is removed, try to claim the task
 	if releaseActions[resp.Action] && len(parts) == 4 && parts[3] == OwnerMarker {
 		metafora.Debugf("Received released task: %s", parts[2])
@@ -312,19 +575,241 @@ func (ec *EtcdCoordinator) parseTask(resp *etcd.Response) (task string, ok bool)
 // ID can be claimed. Claim returns false if another consumer has already
 // claimed the ID.
 func (ec *EtcdCoordinator) Claim(taskID string) bool {
-	return ec.taskManager.add(taskID)
+	_, ok := ec.FencedClaim(taskID)
+	return ok
+}
+
+// FencedClaim is like Claim but also returns the modified index of the claim
+// key as its fencing token. Since etcd's index increases with every write,
+// later claims always receive greater tokens. Tasks handed off to another
+// node aren't claimed until the handoff expires.
+func (ec *EtcdCoordinator) FencedClaim(taskID string) (uint64, bool) {
+	group := ec.Props(taskID).Group
+	if !ec.handoffAllows(taskID) || !ec.quotaAllows(taskID, group) {
+		return 0, false
+	}
+	token, ok := ec.taskManager.add(taskID)
+	if !ok {
+		return 0, false
+	}
+	if !ec.reserveGroup(taskID, group) {
+		ec.Release(taskID)
+		return 0, false
+	}
+	if err := ec.fenceCheckpoint(taskID, token); err != nil {
+		metafora.Errorf("Error fencing checkpoint of task %s; releasing: %v", taskID, err)
+		ec.Release(taskID)
+		return 0, false
+	}
+	if err := ec.initProgress(taskID); err != nil {
+		metafora.Errorf("Error creating progress of task %s; releasing: %v", taskID, err)
+		ec.Release(taskID)
+		return 0, false
+	}
+	return token, true
+}
+
+// quotaAllows returns true if claiming the task wouldn't exceed its group's
+// fair share. Fair shares are checked against a snapshot of every task so
+// concurrent claims may briefly exceed them; MaxRunning is enforced
+// atomically by reserveGroup once the task is claimed. Refusals don't cause a
+// tight loop (see #93) as Watch skips tasks whose groups are over quota.
+func (ec *EtcdCoordinator) quotaAllows(taskID, group string) bool {
+	if group == "" {
+		return true
+	}
+	groups, err := readGroups(ec.Client, ec.taskPath, ec.groupsPath)
+	if err == nil {
+		err = metafora.CheckGroupQuota(group, groups)
+	}
+	if err != nil {
+		metafora.Infof("Refusing to claim task %s: %v", taskID, err)
+		return false
+	}
+	return true
+}
+
+// reserveGroup adds a claimed task to its group's claims key unless the group
+// already has MaxRunning tasks in it. The key is replaced by compare-and-swap
+// so concurrent claims on any node can't exceed the quota. Tasks in the key
+// which are no longer claimed -- such as those released by Close or reaped
+// from dead nodes -- are pruned when the group is full.
+func (ec *EtcdCoordinator) reserveGroup(taskID, group string) bool {
+	if group == "" {
+		return true
+	}
+	quota, err := readQuota(ec.Client, ec.groupsPath, group)
+	if err != nil {
+		metafora.Errorf("Error reading quota of group %s; refusing task %s: %v", group, taskID, err)
+		return false
+	}
+	if quota.MaxRunning <= 0 {
+		return true
+	}
+
+	key := path.Join(ec.groupClaimsPath, group)
+	for {
+		claims, index, err := readGroupClaims(ec.Client, key)
+		if err != nil {
+			metafora.Errorf("Error reading claims of group %s; refusing task %s: %v", group, taskID, err)
+			return false
+		}
+		if !claims[taskID] && len(claims) >= quota.MaxRunning {
+			ec.pruneGroupClaims(claims)
+			if len(claims) >= quota.MaxRunning {
+				metafora.Infof("Refusing to claim task %s: group %s has %d of %d tasks running",
+					taskID, group, len(claims), quota.MaxRunning)
+				return false
+			}
+		}
+		claims[taskID] = true
+		ok, err := writeGroupClaims(ec.Client, key, claims, index)
+		if err != nil {
+			metafora.Errorf("Error updating claims of group %s; refusing task %s: %v", group, taskID, err)
+			return false
+		}
+		if ok {
+			ec.reservedL.Lock()
+			ec.reserved[taskID] = group
+			ec.reservedL.Unlock()
+			return true
+		}
+		// Modified concurrently; retry with the new claims
+	}
+}
+
+// pruneGroupClaims removes tasks without an owner key from claims.
+func (ec *EtcdCoordinator) pruneGroupClaims(claims map[string]bool) {
+	const sorted = false
+	const recursive = false
+	for task := range claims {
+		_, err := ec.Client.Get(path.Join(ec.taskPath, task, OwnerMarker), sorted, recursive)
+		if isEtcdError(err, EcodeKeyNotFound) {
+			delete(claims, task)
+		}
+	}
+}
+
+// unreserveGroup forgets a task reserved by reserveGroup and, if this node
+// still held its claim, removes it from its group's claims key. Lost tasks
+// are left in the key as another node may have reserved them since.
+func (ec *EtcdCoordinator) unreserveGroup(taskID string, held bool) {
+	ec.reservedL.Lock()
+	group, ok := ec.reserved[taskID]
+	delete(ec.reserved, taskID)
+	ec.reservedL.Unlock()
+	if !ok || !held {
+		return
+	}
+
+	key := path.Join(ec.groupClaimsPath, group)
+	for {
+		claims, index, err := readGroupClaims(ec.Client, key)
+		if err != nil {
+			metafora.Warnf("Error reading claims of group %s to remove task %s: %v", group, taskID, err)
+			return
+		}
+		if !claims[taskID] {
+			return
+		}
+		delete(claims, taskID)
+		ok, err := writeGroupClaims(ec.Client, key, claims, index)
+		if err != nil {
+			metafora.Warnf("Error removing task %s from claims of group %s: %v", taskID, group, err)
+			return
+		}
+		if ok {
+			return
+		}
+	}
+}
+
+// Groups returns the quota and number of running and waiting tasks of every
+// group.
+func (ec *EtcdCoordinator) Groups() (map[string]metafora.GroupStatus, error) {
+	return readGroups(ec.Client, ec.taskPath, ec.groupsPath)
+}
+
+// Props returns the properties stored in the task's props key or the zero
+// value if the task has none.
+func (ec *EtcdCoordinator) Props(taskID string) metafora.TaskProps {
+	const sorted = false
+	const recursive = false
+	props := metafora.TaskProps{}
+	resp, err := ec.Client.Get(path.Join(ec.taskPath, taskID, PropsMarker), sorted, recursive)
+	if err != nil {
+		if etcdErr, ok := err.(*etcd.EtcdError); !ok || etcdErr.ErrorCode != EcodeKeyNotFound {
+			metafora.Warnf("Error retrieving properties of task %s: %v", taskID, err)
+		}
+		return props
+	}
+	if err := json.Unmarshal([]byte(resp.Node.Value), &props); err != nil {
+		metafora.Warnf("Invalid properties for task %s: %q", taskID, resp.Node.Value)
+	}
+	return props
+}
+
+// Labels returns this node's labels.
+func (ec *EtcdCoordinator) Labels() map[string]string {
+	ec.labelsL.Lock()
+	defer ec.labelsL.Unlock()
+	return ec.labels
+}
+
+// SetLabels replaces this node's labels. If the coordinator has been
+// initialized they're written to the node's labels key immediately, otherwise
+// they're written by Init.
+//
+// Running tasks whose constraints are violated by new labels are released by
+// the AffinityBalancer the next time the Consumer balances.
+func (ec *EtcdCoordinator) SetLabels(labels map[string]string) error {
+	ec.labelsL.Lock()
+	defer ec.labelsL.Unlock()
+	ec.labels = labels
+	if !ec.registered {
+		return nil
+	}
+	return ec.writeLabels()
+}
+
+// writeLabels stores labels as JSON in the node's labels key which expires
+// along with the node's key. Must be called with labelsL held.
+func (ec *EtcdCoordinator) writeLabels() error {
+	if ec.labels == nil {
+		return nil
+	}
+	body, err := json.Marshal(ec.labels)
+	if err != nil {
+		return err
+	}
+	_, err = ec.Client.Set(path.Join(ec.nodePath, LabelsMarker), string(body), ForeverTTL)
+	return err
+}
+
+// Cluster returns a view of the cluster for Balancers.
+func (ec *EtcdCoordinator) Cluster() (metafora.ClusterView, error) {
+	cs := etcdClusterState{
+		client:   ec.Client,
+		taskPath: ec.taskPath,
+		nodePath: path.Join(ec.namespace, NodesPath),
+	}
+	return cs.view(ec.NodeID)
 }
 
 // Release deletes the claim file.
 func (ec *EtcdCoordinator) Release(taskID string) {
 	const done = false
+	held := ec.taskManager.claimed(taskID)
 	ec.taskManager.remove(taskID, done)
+	ec.unreserveGroup(taskID, held)
 }
 
 // Done deletes the task.
 func (ec *EtcdCoordinator) Done(taskID string) {
 	const done = true
+	held := ec.taskManager.claimed(taskID)
 	ec.taskManager.remove(taskID, done)
+	ec.unreserveGroup(taskID, held)
 }
 
 // Command blocks until a command for this node is received from the broker
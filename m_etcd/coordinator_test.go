@@ -3,6 +3,7 @@ package m_etcd
 import (
 	"path"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -264,13 +265,11 @@ func TestCoordinatorTC4(t *testing.T) {
 
 // Test that Watch() picks up new tasks and returns them.
 // Then Claim() the task and make sure we are able to claim it.
-//     Calling Claim() should also trigger a scheduled refresh of the claim before it's ttl
-// Test after (ClaimTTL + 1 second) that the claim is still around.
+// Test after 5 seconds that the claim is still around.
 // Then add a second coordinator and kill the first one.  The second coordinator
 // should pick up the work from the dead first one.
 func TestClaimRefreshExpire(t *testing.T) {
 	coordinator1, client := setupEtcd(t)
-	coordinator1.ClaimTTL = 3
 	defer coordinator1.Close()
 	if err := coordinator1.Init(newCtx(t, "coordinator1")); err != nil {
 		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
@@ -309,7 +308,6 @@ func TestClaimRefreshExpire(t *testing.T) {
 
 	// Start a second coordinator and make sure it can't claim our task.
 	coordinator2 := NewEtcdCoordinator("node2", namespace, client).(*EtcdCoordinator)
-	coordinator2.ClaimTTL = 3
 	defer coordinator2.Close()
 	if err := coordinator2.Init(newCtx(t, "coordinator2")); err != nil {
 		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
@@ -483,3 +481,475 @@ func TestNodeRefresher(t *testing.T) {
 		t.Fatal("Consumer didn't exit even though node directory disappeared!")
 	}
 }
+
+// TestNodeExpireReleasesClaims ensures claims are tied to their node's key:
+// when the key disappears the node loses its tasks and other nodes may claim
+// them.
+func TestNodeExpireReleasesClaims(t *testing.T) {
+	coord1, client := setupEtcd(t)
+	ctx1 := newCtx(t, "coordinator1")
+	if err := coord1.Init(ctx1); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord1.Close()
+	coord2 := NewEtcdCoordinator("node2", namespace, client).(*EtcdCoordinator)
+	if err := coord2.Init(newCtx(t, "coordinator2")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord2.Close()
+
+	const task = "testnodeexpire"
+	if err := NewClient(namespace, client).SubmitTask(task); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord1.Claim(task) {
+		t.Fatal("coordinator1 unable to claim task")
+	}
+
+	// Claims must not have a TTL of their own
+	resp, err := client.Get(path.Join(namespace, TasksPath, task, OwnerMarker), false, false)
+	if err != nil {
+		t.Fatalf("Error retrieving claim: %v", err)
+	}
+	if resp.Node.TTL != 0 {
+		t.Errorf("Expected claim without a TTL but found: %d", resp.Node.TTL)
+	}
+
+	res := make(chan string)
+	go func() {
+		taskID, _ := coord2.Watch()
+		res <- taskID
+	}()
+
+	// Simulate coordinator1's node key expiring
+	if _, err := client.Delete(coord1.nodePath, true); err != nil {
+		t.Fatalf("Error deleting node key: %v", err)
+	}
+
+	select {
+	case taskID := <-res:
+		if taskID != task {
+			t.Fatalf("Expected %s but received %s", task, taskID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dead node's claim wasn't released")
+	}
+	if !coord2.Claim(task) {
+		t.Fatal("coordinator2 unable to claim task of dead node")
+	}
+
+	select {
+	case taskID := <-ctx1.lost:
+		if taskID != task {
+			t.Fatalf("Lost unexpected task: %s", taskID)
+		}
+	case <-time.After(time.Duration(DefaultNodePathTTL) * time.Second):
+		t.Fatal("coordinator1 didn't lose its task")
+	}
+}
+
+// TestOwnerWatch ensures writes to other keys of a claimed task are ignored
+// while deleting the task loses it.
+func TestOwnerWatch(t *testing.T) {
+	coord, client := setupEtcd(t)
+	ctx := newCtx(t, "coordinator1")
+	if err := coord.Init(ctx); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord.Close()
+
+	const task = "testownerwatch"
+	if err := NewClient(namespace, client).SubmitTask(task); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord.Claim(task) {
+		t.Fatal("Unable to claim task")
+	}
+
+	if _, err := client.Set(path.Join(namespace, TasksPath, task, "other"), "x", ForeverTTL); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+	select {
+	case taskID := <-ctx.lost:
+		t.Fatalf("Unexpectedly lost %s", taskID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := client.Delete(path.Join(namespace, TasksPath, task), true); err != nil {
+		t.Fatalf("Error deleting task: %v", err)
+	}
+	select {
+	case taskID := <-ctx.lost:
+		if taskID != task {
+			t.Fatalf("Lost unexpected task: %s", taskID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deleted task wasn't lost")
+	}
+}
+
+// Ensure coordinators are notified of nodes joining and leaving.
+func TestNodesChanged(t *testing.T) {
+	coord1, client := setupEtcd(t)
+	ctx1 := newCtx(t, "coordinator1")
+	if err := coord1.Init(ctx1); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord1.Close()
+
+	// Give nodeWatcher a chance to start watching
+	time.Sleep(100 * time.Millisecond)
+
+	coord2 := NewEtcdCoordinator("node2", namespace, client).(*EtcdCoordinator)
+	if err := coord2.Init(newCtx(t, "coordinator2")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	select {
+	case <-ctx1.nodes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not notified of node joining")
+	}
+
+	coord2.Close()
+	select {
+	case <-ctx1.nodes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not notified of node leaving")
+	}
+}
+
+// Ensure node labels are registered on Init and props are returned for tasks
+// submitted with them.
+func TestLabelsAndProps(t *testing.T) {
+	coord, client := setupEtcd(t)
+	coord.SetLabels(map[string]string{"dc": "east"})
+	if err := coord.Init(newCtx(t, "coordinator1")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord.Close()
+
+	resp, err := client.Get(path.Join(namespace, NodesPath, nodeID, LabelsMarker), false, false)
+	if err != nil {
+		t.Fatalf("Error retrieving labels: %v", err)
+	}
+	if resp.Node.Value != `{"dc":"east"}` {
+		t.Errorf("Unexpected labels: %s", resp.Node.Value)
+	}
+
+	const task = "testprops"
+	props := metafora.TaskProps{Weight: 3, Constraints: metafora.Constraints{AntiAffinity: "g"}}
+	if err := NewClient(namespace, client).(metafora.PropsClient).SubmitTaskProps(task, props); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if p := coord.Props(task); p.Weight != 3 || p.Constraints.AntiAffinity != "g" {
+		t.Errorf("Unexpected props: %#v", p)
+	}
+	if p := coord.Props("missing"); p.Weight != 0 {
+		t.Errorf("Expected zero props for missing task but found: %#v", p)
+	}
+}
+
+// Ensure Watch offers higher priority tasks first.
+func TestWatchPriority(t *testing.T) {
+	coord, client := setupEtcd(t)
+	if err := coord.Init(newCtx(t, "coordinator1")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord.Close()
+
+	mclient := NewClient(namespace, client).(metafora.PropsClient)
+	for task, priority := range map[string]int{"prio-a": 0, "prio-b": 5, "prio-c": 1} {
+		if err := mclient.SubmitTaskProps(task, metafora.TaskProps{Priority: priority}); err != nil {
+			t.Fatalf("Error submitting task: %v", err)
+		}
+	}
+
+	for _, expected := range []string{"prio-b", "prio-c", "prio-a"} {
+		task, err := coord.Watch()
+		if err != nil {
+			t.Fatalf("Unexpected error watching: %v", err)
+		}
+		if task != expected {
+			t.Fatalf("Expected %s but received %s", expected, task)
+		}
+		if !coord.Claim(task) {
+			t.Fatalf("Unable to claim %s", task)
+		}
+	}
+
+	view, err := coord.Cluster()
+	if err != nil {
+		t.Fatalf("Error retrieving cluster view: %v", err)
+	}
+	if view.Backlog != 0 || view.NodeTasks[nodeID] != 3 {
+		t.Errorf("Unexpected cluster view: %#v", view)
+	}
+}
+
+// Ensure claims exceeding a group's quota are refused and usage is reported.
+func TestGroupQuota(t *testing.T) {
+	coord, client := setupEtcd(t)
+	if err := coord.Init(newCtx(t, "coordinator1")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord.Close()
+
+	mclient := NewClient(namespace, client).(metafora.GroupClient)
+	if err := mclient.SetGroupQuota("acme", metafora.GroupQuota{MaxRunning: 1}); err != nil {
+		t.Fatalf("Error setting quota: %v", err)
+	}
+	for _, task := range []string{"group1", "group2"} {
+		props := metafora.TaskProps{Group: "acme"}
+		if err := mclient.(metafora.PropsClient).SubmitTaskProps(task, props); err != nil {
+			t.Fatalf("Error submitting task: %v", err)
+		}
+	}
+
+	if !coord.Claim("group1") {
+		t.Fatal("Unable to claim group1")
+	}
+	if coord.Claim("group2") {
+		t.Fatal("Claimed group2 despite exceeding its group's quota")
+	}
+
+	groups, err := mclient.Groups()
+	if err != nil {
+		t.Fatalf("Error retrieving groups: %v", err)
+	}
+	expected := metafora.GroupStatus{Quota: metafora.GroupQuota{MaxRunning: 1}, Running: 1, Waiting: 1}
+	if groups["acme"] != expected {
+		t.Errorf("Expected %#v but found %#v", expected, groups["acme"])
+	}
+
+	// Releasing a task frees its place in the group
+	coord.Release("group1")
+	if !coord.Claim("group2") {
+		t.Fatal("Unable to claim group2 after group1 was released")
+	}
+}
+
+// Ensure concurrent claims on different nodes can't exceed a group's
+// MaxRunning quota.
+func TestGroupQuotaConcurrent(t *testing.T) {
+	coord1, client := setupEtcd(t)
+	if err := coord1.Init(newCtx(t, "coordinator1")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord1.Close()
+	coord2 := NewEtcdCoordinator("node2", namespace, client).(*EtcdCoordinator)
+	if err := coord2.Init(newCtx(t, "coordinator2")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord2.Close()
+
+	mclient := NewClient(namespace, client).(metafora.GroupClient)
+	if err := mclient.SetGroupQuota("acme", metafora.GroupQuota{MaxRunning: 2}); err != nil {
+		t.Fatalf("Error setting quota: %v", err)
+	}
+	tasks := []string{"group1", "group2", "group3", "group4", "group5", "group6"}
+	for _, task := range tasks {
+		props := metafora.TaskProps{Group: "acme"}
+		if err := mclient.(metafora.PropsClient).SubmitTaskProps(task, props); err != nil {
+			t.Fatalf("Error submitting task: %v", err)
+		}
+	}
+
+	claimed := make(chan bool, 2*len(tasks))
+	wg := sync.WaitGroup{}
+	for _, coord := range []*EtcdCoordinator{coord1, coord2} {
+		for _, task := range tasks {
+			wg.Add(1)
+			go func(coord *EtcdCoordinator, task string) {
+				defer wg.Done()
+				claimed <- coord.Claim(task)
+			}(coord, task)
+		}
+	}
+	wg.Wait()
+	close(claimed)
+
+	n := 0
+	for ok := range claimed {
+		if ok {
+			n++
+		}
+	}
+	if n > 2 {
+		t.Fatalf("Expected at most 2 tasks claimed but %d were", n)
+	}
+}
+
+// Ensure handed off tasks are reserved for their target and carry a token.
+func TestHandoff(t *testing.T) {
+	defer func(w time.Duration) { metafora.HandoffWindow = w }(metafora.HandoffWindow)
+	metafora.HandoffWindow = 500 * time.Millisecond
+	coord1, client := setupEtcd(t)
+	if err := coord1.Init(newCtx(t, "coordinator1")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord1.Close()
+	coord2 := NewEtcdCoordinator("node2", namespace, client).(*EtcdCoordinator)
+	if err := coord2.Init(newCtx(t, "coordinator2")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord2.Close()
+
+	const task = "testhandoff"
+	if err := NewClient(namespace, client).SubmitTask(task); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord1.Claim(task) {
+		t.Fatal("coordinator1 unable to claim task")
+	}
+
+	// The target claims immediately
+	coord1.ReleaseTo(task, "node2", "checkpoint")
+	start := time.Now()
+	if !coord2.Claim(task) {
+		t.Fatal("coordinator2 unable to claim handed off task")
+	}
+	if time.Since(start) >= metafora.HandoffWindow {
+		t.Errorf("Target waited for handoff window to claim")
+	}
+	if token := coord2.HandoffToken(task); token != "checkpoint" {
+		t.Errorf("Expected handoff token but found %q", token)
+	}
+	if token := coord2.HandoffToken(task); token != "" {
+		t.Errorf("Expected handoff token to be cleared but found %q", token)
+	}
+
+	// Other nodes refuse to claim the task until the window expires and
+	// aren't offered it until the handoff key expires
+	coord2.ReleaseTo(task, "node3", "stale")
+	start = time.Now()
+	if coord1.Claim(task) {
+		t.Fatal("Claimed task handed off to another node before the window expired")
+	}
+	if time.Since(start) >= metafora.HandoffWindow {
+		t.Errorf("Waited for handoff window to refuse claim")
+	}
+	watchRes := make(chan string, 1)
+	go func() {
+		task, err := coord1.Watch()
+		if err != nil {
+			t.Errorf("Watch returned an error: %v", err)
+		}
+		watchRes <- task
+	}()
+	select {
+	case <-watchRes:
+		if time.Since(start) < metafora.HandoffWindow {
+			t.Fatal("Watch offered task handed off to another node before the window expired")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Watch didn't offer task after its handoff expired")
+	}
+	if !coord1.Claim(task) {
+		t.Fatal("coordinator1 unable to claim task after handoff expired")
+	}
+	if token := coord1.HandoffToken(task); token != "" {
+		t.Errorf("Expected token handed off to another node to be ignored but found %q", token)
+	}
+}
+
+// Ensure checkpoints survive releases and can't be overwritten by stale claims.
+func TestCheckpoint(t *testing.T) {
+	coord1, client := setupEtcd(t)
+	if err := coord1.Init(newCtx(t, "coordinator1")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord1.Close()
+	coord2 := NewEtcdCoordinator("node2", namespace, client).(*EtcdCoordinator)
+	if err := coord2.Init(newCtx(t, "coordinator2")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord2.Close()
+
+	const task = "testcheckpoint"
+	if err := NewClient(namespace, client).SubmitTask(task); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	token1, ok := coord1.FencedClaim(task)
+	if !ok {
+		t.Fatal("coordinator1 unable to claim task")
+	}
+	if data, err := coord1.Restore(task); err != nil || data != nil {
+		t.Fatalf("Expected no checkpoint but found %q (err=%v)", data, err)
+	}
+	if err := coord1.Checkpoint(task, token1, []byte("one")); err != nil {
+		t.Fatalf("Error checkpointing: %v", err)
+	}
+	if err := coord1.Checkpoint(task, token1, []byte("two")); err != nil {
+		t.Fatalf("Error replacing checkpoint: %v", err)
+	}
+	coord1.Release(task)
+
+	token2, ok := coord2.FencedClaim(task)
+	if !ok {
+		t.Fatal("coordinator2 unable to claim released task")
+	}
+	if data, err := coord2.Restore(task); err != nil || string(data) != "two" {
+		t.Fatalf("Expected checkpoint to be restored but found %q (err=%v)", data, err)
+	}
+	if err := coord1.Checkpoint(task, token1, []byte("stale")); err != metafora.ErrStaleClaim {
+		t.Errorf("Expected ErrStaleClaim from stale claim but found: %v", err)
+	}
+	if err := coord2.Checkpoint(task, token2, []byte("three")); err != nil {
+		t.Fatalf("Error checkpointing: %v", err)
+	}
+
+	coord2.Done(task)
+	if data, err := coord2.Restore(task); err != nil || data != nil {
+		t.Errorf("Expected checkpoint to be deleted with task but found %q (err=%v)", data, err)
+	}
+	if err := coord2.Checkpoint(task, token2, []byte("done")); err != metafora.ErrStaleClaim {
+		t.Errorf("Expected ErrStaleClaim checkpointing done task but found: %v", err)
+	}
+	if _, err := client.Get(path.Join(namespace, TasksPath, task), false, false); !isEtcdError(err, EcodeKeyNotFound) {
+		t.Errorf("Expected checkpoint of done task not to recreate it but found: %v", err)
+	}
+}
+
+// Ensure progress is stored for claimed tasks and readable by clients.
+func TestProgress(t *testing.T) {
+	coord, client := setupEtcd(t)
+	if err := coord.Init(newCtx(t, "coordinator1")); err != nil {
+		t.Fatalf("Unexpected error initialzing coordinator: %v", err)
+	}
+	defer coord.Close()
+	mc := NewClient(namespace, client).(metafora.ProgressClient)
+
+	const task = "testprogress"
+	if err := mc.SubmitTask(task); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if p, err := mc.Progress(task); err != nil || p.Status != "" {
+		t.Fatalf("Expected no progress but found %+v (err=%v)", p, err)
+	}
+	if err := coord.SetProgress(task, metafora.Progress{Status: "unclaimed"}); err != metafora.ErrStaleClaim {
+		t.Errorf("Expected ErrStaleClaim storing progress of unclaimed task but found: %v", err)
+	}
+	if !coord.Claim(task) {
+		t.Fatal("Unable to claim task")
+	}
+	if err := coord.SetProgress(task, metafora.Progress{Status: "working", Percent: 50}); err != nil {
+		t.Fatalf("Error storing progress: %v", err)
+	}
+	if p, err := mc.Progress(task); err != nil || p.Status != "working" || p.Percent != 50 {
+		t.Errorf("Expected stored progress but found %+v (err=%v)", p, err)
+	}
+
+	// Progress stored after the task is deleted mustn't recreate it
+	if err := mc.DeleteTask(task); err != nil {
+		t.Fatalf("Error deleting task: %v", err)
+	}
+	if err := coord.SetProgress(task, metafora.Progress{Status: "deleted"}); err != metafora.ErrStaleClaim {
+		t.Errorf("Expected ErrStaleClaim storing progress of deleted task but found: %v", err)
+	}
+	if _, err := client.Get(path.Join(namespace, TasksPath, task), false, false); !isEtcdError(err, EcodeKeyNotFound) {
+		t.Errorf("Expected progress of deleted task not to recreate it but found: %v", err)
+	}
+}
+
+var _ metafora.AffinityState = (*EtcdCoordinator)(nil)
+var _ metafora.GroupCoordinator = (*EtcdCoordinator)(nil)
@@ -0,0 +1,168 @@
+package m_etcd
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/lytics/metafora"
+)
+
+// readGroups returns the status of every group with a quota stored under
+// groupsPath or tasks stored under taskPath.
+func readGroups(client *etcd.Client, taskPath, groupsPath string) (map[string]metafora.GroupStatus, error) {
+	quotas, err := readQuotas(client, groupsPath)
+	if err != nil {
+		return nil, err
+	}
+	const sorted = false
+	const recursive = true
+	resp, err := client.Get(taskPath, sorted, recursive)
+	if err != nil {
+		return nil, err
+	}
+	return groupStatus(resp.Node, quotas), nil
+}
+
+// readQuotas returns the quota of every group stored under groupsPath.
+func readQuotas(client *etcd.Client, groupsPath string) (map[string]metafora.GroupQuota, error) {
+	const sorted = false
+	const recursive = false
+	quotas := map[string]metafora.GroupQuota{}
+	resp, err := client.Get(groupsPath, sorted, recursive)
+	if err != nil {
+		if ee, ok := err.(*etcd.EtcdError); ok && ee.ErrorCode == EcodeKeyNotFound {
+			return quotas, nil
+		}
+		return nil, err
+	}
+	for _, node := range resp.Node.Nodes {
+		q := metafora.GroupQuota{}
+		if err := json.Unmarshal([]byte(node.Value), &q); err != nil {
+			metafora.Warnf("Ignoring invalid quota %s: %v", node.Key, err)
+			continue
+		}
+		quotas[path.Base(node.Key)] = q
+	}
+	return quotas, nil
+}
+
+// groupStatus counts the running and waiting tasks of each group in a
+// recursive listing of the tasks path.
+func groupStatus(tasks *etcd.Node, quotas map[string]metafora.GroupQuota) map[string]metafora.GroupStatus {
+	groups := make(map[string]metafora.GroupStatus, len(quotas))
+	for name, q := range quotas {
+		groups[name] = metafora.GroupStatus{Quota: q}
+	}
+	if tasks == nil {
+		return groups
+	}
+	for _, task := range tasks.Nodes {
+		group := nodeProps(task).Group
+		if group == "" {
+			continue
+		}
+		s := groups[group]
+		if nodeClaimed(task) {
+			s.Running++
+		} else {
+			s.Waiting++
+		}
+		groups[group] = s
+	}
+	return groups
+}
+
+// nodeProps returns the properties from a task node's props key or the zero
+// value if it has none.
+func nodeProps(task *etcd.Node) metafora.TaskProps {
+	props := metafora.TaskProps{}
+	for _, child := range task.Nodes {
+		if path.Base(child.Key) == PropsMarker {
+			json.Unmarshal([]byte(child.Value), &props)
+		}
+	}
+	return props
+}
+
+// nodeClaimed returns true if a task node has an owner key.
+func nodeClaimed(task *etcd.Node) bool {
+	for _, child := range task.Nodes {
+		if path.Base(child.Key) == OwnerMarker {
+			return true
+		}
+	}
+	return false
+}
+
+// readQuota returns a group's quota or the zero value if it has none.
+func readQuota(client *etcd.Client, groupsPath, group string) (metafora.GroupQuota, error) {
+	const sorted = false
+	const recursive = false
+	q := metafora.GroupQuota{}
+	resp, err := client.Get(path.Join(groupsPath, group), sorted, recursive)
+	if isEtcdError(err, EcodeKeyNotFound) {
+		return q, nil
+	}
+	if err != nil {
+		return q, err
+	}
+	if err := json.Unmarshal([]byte(resp.Node.Value), &q); err != nil {
+		metafora.Warnf("Ignoring invalid quota %s: %v", resp.Node.Key, err)
+	}
+	return q, nil
+}
+
+// readGroupClaims returns the tasks in a group's claims key and the key's
+// modified index, or 0 if the key doesn't exist.
+func readGroupClaims(client *etcd.Client, key string) (map[string]bool, uint64, error) {
+	const sorted = false
+	const recursive = false
+	claims := map[string]bool{}
+	resp, err := client.Get(key, sorted, recursive)
+	if isEtcdError(err, EcodeKeyNotFound) {
+		return claims, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	tasks := []string{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), &tasks); err != nil {
+		metafora.Warnf("Resetting invalid group claims %s: %v", key, err)
+	}
+	for _, task := range tasks {
+		claims[task] = true
+	}
+	return claims, resp.Node.ModifiedIndex, nil
+}
+
+// writeGroupClaims replaces a group's claims key if it hasn't been modified
+// since index, deleting it if there are no claims. Returns false if it was
+// modified concurrently.
+func writeGroupClaims(client *etcd.Client, key string, claims map[string]bool, index uint64) (bool, error) {
+	var err error
+	switch {
+	case len(claims) == 0:
+		_, err = client.CompareAndDelete(key, "", index)
+	case index == 0:
+		_, err = client.Create(key, encodeGroupClaims(claims), ForeverTTL)
+	default:
+		_, err = client.CompareAndSwap(key, encodeGroupClaims(claims), ForeverTTL, "", index)
+	}
+	if isEtcdError(err, EcodeTestFailed) || isEtcdError(err, EcodeNodeExist) || isEtcdError(err, EcodeKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// encodeGroupClaims returns claimed task IDs as a sorted JSON list.
+func encodeGroupClaims(claims map[string]bool) string {
+	tasks := make([]string, 0, len(claims))
+	for task := range claims {
+		tasks = append(tasks, task)
+	}
+	sort.Strings(tasks)
+	buf, _ := json.Marshal(tasks)
+	return string(buf)
+}
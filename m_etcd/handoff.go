@@ -0,0 +1,116 @@
+package m_etcd
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/lytics/metafora"
+)
+
+// handoffValue is stored in a task's handoff key when it's handed off.
+type handoffValue struct {
+	Node    string    `json:"node"`
+	Token   string    `json:"token,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// ReleaseTo stores the task's handoff in its handoff key and releases it.
+// Other nodes refuse to claim the task until the handoff expires. The key's
+// TTL outlasts the handoff so its expiration causes Watch to offer the task
+// again.
+func (ec *EtcdCoordinator) ReleaseTo(taskID, node, token string) {
+	val := handoffValue{Node: node, Token: token, Expires: time.Now().Add(metafora.HandoffWindow)}
+	ttl := uint64((metafora.HandoffWindow + time.Second - 1) / time.Second)
+	buf, err := json.Marshal(&val)
+	if err == nil {
+		_, err = ec.Client.Set(ec.handoffKey(taskID), string(buf), ttl)
+	}
+	if err != nil {
+		metafora.Errorf("Error handing off task %s to %s; releasing normally: %v", taskID, node, err)
+	}
+	ec.Release(taskID)
+}
+
+// HandoffToken deletes the task's handoff key and returns its token if the
+// task was handed off to this node. Tokens meant for other nodes, whose
+// handoffs expired before they claimed the task, are ignored.
+func (ec *EtcdCoordinator) HandoffToken(taskID string) string {
+	val, index, ok := ec.handoff(taskID)
+	if !ok {
+		return ""
+	}
+	ec.deleteHandoff(taskID, index)
+	if val.Node != ec.NodeID {
+		return ""
+	}
+	return val.Token
+}
+
+// handoffAllows returns true unless the task is handed off to another node
+// and the handoff hasn't expired. Refusals don't cause a tight loop as Watch
+// skips tasks handed off to other nodes until their handoff key expires.
+func (ec *EtcdCoordinator) handoffAllows(taskID string) bool {
+	val, index, ok := ec.handoff(taskID)
+	if !ok || val.Node == ec.NodeID {
+		return true
+	}
+	if val.expired() {
+		// Don't leave the stale handoff for the next claim
+		ec.deleteHandoff(taskID, index)
+		return true
+	}
+	metafora.Infof("Refusing to claim task %s handed off to %s until %s", taskID, val.Node, val.Expires)
+	return false
+}
+
+// handoff returns the task's handoff and the modified index of its key or
+// false if it has none.
+func (ec *EtcdCoordinator) handoff(taskID string) (handoffValue, uint64, bool) {
+	const sorted = false
+	const recursive = false
+	val := handoffValue{}
+	resp, err := ec.Client.Get(ec.handoffKey(taskID), sorted, recursive)
+	if err != nil {
+		if etcdErr, ok := err.(*etcd.EtcdError); !ok || etcdErr.ErrorCode != EcodeKeyNotFound {
+			metafora.Warnf("Error retrieving handoff of task %s: %v", taskID, err)
+		}
+		return val, 0, false
+	}
+	if err := json.Unmarshal([]byte(resp.Node.Value), &val); err != nil {
+		metafora.Warnf("Invalid handoff for task %s: %q", taskID, resp.Node.Value)
+		return val, 0, false
+	}
+	return val, resp.Node.ModifiedIndex, true
+}
+
+// deleteHandoff deletes the task's handoff key unless it was replaced by a
+// newer handoff since it was read at index.
+func (ec *EtcdCoordinator) deleteHandoff(taskID string, index uint64) {
+	_, err := ec.Client.CompareAndDelete(ec.handoffKey(taskID), "", index)
+	if err != nil && !isEtcdError(err, EcodeKeyNotFound) && !isEtcdError(err, EcodeTestFailed) {
+		metafora.Warnf("Error deleting handoff of task %s: %v", taskID, err)
+	}
+}
+
+// nodeHandoff returns the handoff from a task node's handoff key or false if
+// it has none.
+func nodeHandoff(task *etcd.Node) (handoffValue, bool) {
+	val := handoffValue{}
+	for _, child := range task.Nodes {
+		if path.Base(child.Key) == HandoffMarker {
+			return val, json.Unmarshal([]byte(child.Value), &val) == nil
+		}
+	}
+	return val, false
+}
+
+// expired returns true once other nodes may claim the task.
+func (v handoffValue) expired() bool {
+	return !time.Now().Before(v.Expires)
+}
+
+func (ec *EtcdCoordinator) handoffKey(taskID string) string {
+	return path.Join(ec.taskPath, taskID, HandoffMarker)
+}
@@ -66,13 +66,15 @@ func (l testLogger) Log(lvl metafora.LogLevel, m string, v ...interface{}) {
 
 type testCoordCtx struct {
 	testLogger
-	lost chan string
+	lost  chan string
+	nodes chan struct{}
 }
 
 func newCtx(t *testing.T, prefix string) *testCoordCtx {
 	return &testCoordCtx{
 		testLogger: testLogger{prefix: prefix, T: t},
 		lost:       make(chan string, 10),
+		nodes:      make(chan struct{}, 10),
 	}
 }
 
@@ -80,3 +82,11 @@ func (t *testCoordCtx) Lost(taskID string) {
 	t.Log(metafora.LogLevelDebug, "Lost(%s)", taskID)
 	t.lost <- taskID
 }
+
+func (t *testCoordCtx) NodesChanged() {
+	t.Log(metafora.LogLevelDebug, "NodesChanged()")
+	select {
+	case t.nodes <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,85 @@
+package m_etcd
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/lytics/metafora"
+)
+
+// NewReleaseLimiter creates a metafora.ReleaseLimiter which permits max task
+// releases per interval across every node in the namespace.
+//
+// Releases are counted in a key per interval under <namespace>/balance which
+// expires after the interval ends.
+func NewReleaseLimiter(namespace string, client *etcd.Client, max int, interval time.Duration) metafora.ReleaseLimiter {
+	return &releaseLimiter{
+		client:   client,
+		path:     path.Join("/", strings.Trim(namespace, "/ "), BalancePath),
+		max:      max,
+		interval: interval,
+	}
+}
+
+type releaseLimiter struct {
+	client   client
+	path     string
+	max      int
+	interval time.Duration
+}
+
+// Acquire increments the current interval's release count by up to n using
+// compare-and-swap so concurrent nodes never exceed the limit.
+func (l *releaseLimiter) Acquire(n int) (int, error) {
+	window := time.Now().UnixNano() / int64(l.interval)
+	key := path.Join(l.path, strconv.FormatInt(window, 10))
+	ttl := uint64(2 * l.interval / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	for {
+		const sorted = false
+		const recursive = false
+		resp, err := l.client.Get(key, sorted, recursive)
+		if err != nil {
+			if etcdErr, ok := err.(*etcd.EtcdError); !ok || etcdErr.ErrorCode != EcodeKeyNotFound {
+				return 0, err
+			}
+			// First releases in this interval
+			if n > l.max {
+				n = l.max
+			}
+			if _, err := l.client.Create(key, strconv.Itoa(n), ttl); err != nil {
+				if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == EcodeNodeExist {
+					continue // raced with another node
+				}
+				return 0, err
+			}
+			return n, nil
+		}
+
+		used, err := strconv.Atoi(resp.Node.Value)
+		if err != nil {
+			return 0, err
+		}
+		granted := n
+		if granted > l.max-used {
+			granted = l.max - used
+		}
+		if granted <= 0 {
+			return 0, nil
+		}
+		_, err = l.client.CompareAndSwap(key, strconv.Itoa(used+granted), ttl, resp.Node.Value, resp.Node.ModifiedIndex)
+		if err == nil {
+			return granted, nil
+		}
+		if etcdErr, ok := err.(*etcd.EtcdError); !ok || etcdErr.ErrorCode != EcodeTestFailed {
+			return 0, err
+		}
+		metafora.Debugf("Release count %s modified concurrently; retrying", key)
+	}
+}
@@ -0,0 +1,26 @@
+package m_etcd
+
+import (
+	"testing"
+	"time"
+)
+
+// Ensure releases are limited across limiters sharing a namespace.
+func TestReleaseLimiter(t *testing.T) {
+	client := newEtcdClient(t)
+	const recursive = true
+	client.Delete(namespace, recursive)
+
+	l1 := NewReleaseLimiter(namespace, client, 3, time.Hour)
+	l2 := NewReleaseLimiter(namespace, client, 3, time.Hour)
+
+	if n, err := l1.Acquire(2); err != nil || n != 2 {
+		t.Fatalf("Expected 2 releases but received %d: %v", n, err)
+	}
+	if n, err := l2.Acquire(2); err != nil || n != 1 {
+		t.Fatalf("Expected 1 release but received %d: %v", n, err)
+	}
+	if n, err := l1.Acquire(1); err != nil || n != 0 {
+		t.Fatalf("Expected 0 releases but received %d: %v", n, err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 type ctx struct{}
 
 func (ctx) Lost(string)                                   {}
+func (ctx) NodesChanged()                                 {}
 func (ctx) Log(metafora.LogLevel, string, ...interface{}) {}
 
 type taskTest struct {
@@ -26,6 +27,7 @@ func TestParseTask(t *testing.T) {
 		{Resp: &etcd.Response{Action: actionCAD, Node: &etcd.Node{Key: "/namespace/tasks/1", Dir: true}}},
 		{Resp: &etcd.Response{Action: actionCreated, Node: &etcd.Node{Key: "/namespace/tasks/1/a", Dir: true}}},
 		{Resp: &etcd.Response{Action: actionCAD, Node: &etcd.Node{Key: "/namespace/tasks/1", Dir: false}}},
+		{Resp: &etcd.Response{Action: actionDelete, Node: &etcd.Node{Key: "/namespace/tasks/1/props"}}},
 
 		// good
 		{
@@ -38,6 +40,11 @@ func TestParseTask(t *testing.T) {
 			Task: "1",
 			Ok:   true,
 		},
+		{
+			Resp: &etcd.Response{Action: actionCreated, Node: &etcd.Node{Key: "/namespace/tasks/1/props"}},
+			Task: "1",
+			Ok:   true,
+		},
 		{
 			Resp: &etcd.Response{Action: actionCAD, Node: &etcd.Node{Key: "/namespace/tasks/1/owner"}},
 			Task: "1",
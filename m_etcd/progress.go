@@ -0,0 +1,41 @@
+package m_etcd
+
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/lytics/metafora"
+)
+
+// SetProgress stores the task's progress as JSON in its progress key if it's
+// still claimed by this node. The key is created when the task is claimed and
+// only updated here, so progress stored after a task is done can't recreate
+// it.
+func (ec *EtcdCoordinator) SetProgress(taskID string, p metafora.Progress) error {
+	if !ec.taskManager.claimed(taskID) {
+		return metafora.ErrStaleClaim
+	}
+	body, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	_, err = ec.Client.Update(ec.progressKey(taskID), string(body), ForeverTTL)
+	if isEtcdError(err, EcodeKeyNotFound) {
+		return metafora.ErrStaleClaim
+	}
+	return err
+}
+
+// initProgress creates the task's progress key if it doesn't have one yet.
+// It's called after claiming and before the claim's handler starts.
+func (ec *EtcdCoordinator) initProgress(taskID string) error {
+	_, err := ec.Client.Create(ec.progressKey(taskID), "{}", ForeverTTL)
+	if isEtcdError(err, EcodeNodeExist) {
+		return nil
+	}
+	return err
+}
+
+func (ec *EtcdCoordinator) progressKey(taskID string) string {
+	return path.Join(ec.taskPath, taskID, ProgressMarker)
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"path"
 	"sync"
-	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/lytics/metafora"
@@ -13,52 +12,44 @@ import (
 
 // Don't depend directly on etcd.Client to make testing easier.
 type client interface {
+	Get(key string, sort, recursive bool) (*etcd.Response, error)
 	Create(key, value string, ttl uint64) (*etcd.Response, error)
 	Delete(key string, recursive bool) (*etcd.Response, error)
 	CompareAndDelete(key, prevValue string, index uint64) (*etcd.Response, error)
 	CompareAndSwap(key, value string, ttl uint64, prevValue string, index uint64) (*etcd.Response, error)
 }
 
-// taskStates hold channels to communicate task state transitions.
-type taskStates struct {
-	done    chan struct{}
-	release chan struct{}
-}
-
-// taskManager bumps claims to keep them from expiring and deletes them on
-// release.
+// taskManager creates and deletes claims.
+//
+// Claims never expire on their own. Instead they're tied to the liveness of
+// the owning node's key which is kept alive by the coordinator's
+// nodeRefresher, so the cost of maintaining claims is constant per node
+// regardless of how many tasks it has claimed. Claims owned by nodes whose
+// keys have expired may be stolen.
 type taskManager struct {
-	ctx    metafora.CoordinatorContext
-	client client
-	wg     sync.WaitGroup
-	tasks  map[string]taskStates // map of task ID to state chans
-	taskL  sync.Mutex            // protect tasks from concurrent access
-	path   string                // etcd path to tasks
-	node   string                // node ID
-
-	ttl      uint64 // seconds
-	interval time.Duration
+	ctx      metafora.CoordinatorContext
+	client   client
+	tasks    map[string]uint64 // claimed task IDs to the etcd index of their claims
+	taskL    sync.Mutex        // protect tasks from concurrent access
+	path     string            // etcd path to tasks
+	nodePath string            // etcd path to nodes
+	node     string            // node ID
+	owner    string            // JSON encoded ownerValue for node
 }
 
-func newManager(ctx metafora.CoordinatorContext, client client, path, nodeID string, ttl uint64) *taskManager {
-	if ttl == 0 {
-		panic("refresher: TTL must be > 0")
-	}
-
-	// refresh more often than strictly necessary to be safe
-	interval := time.Duration((ttl>>1)+(ttl>>2)) * time.Second
-	if ttl == 1 {
-		interval = 750 * time.Millisecond
-		metafora.Warnf("Dangerously low TTL: %d; consider raising.", ttl)
+func newManager(ctx metafora.CoordinatorContext, client client, path, nodePath, nodeID string) *taskManager {
+	p, err := json.Marshal(&ownerValue{Node: nodeID})
+	if err != nil {
+		panic(fmt.Sprintf("coordinator: error marshalling node body: %v", err))
 	}
 	return &taskManager{
 		ctx:      ctx,
 		client:   client,
-		tasks:    make(map[string]taskStates),
+		tasks:    make(map[string]uint64),
 		path:     path,
+		nodePath: nodePath,
 		node:     nodeID,
-		ttl:      ttl,
-		interval: interval,
+		owner:    string(p),
 	}
 }
 
@@ -70,116 +61,205 @@ func (m *taskManager) ownerKey(taskID string) string {
 	return path.Join(m.taskPath(taskID), OwnerMarker)
 }
 
-func (m *taskManager) ownerNode(taskID string) (key, value string) {
-	p, err := json.Marshal(&ownerValue{Node: m.node})
-	if err != nil {
-		panic(fmt.Sprintf("coordinator: error marshalling node body: %v", err))
-	}
-	return m.ownerKey(taskID), string(p)
-}
-
-// add starts refreshing a given key+value pair for a task asynchronously.
-func (m *taskManager) add(taskID string) bool {
+// add claims a task by creating its owner key or by stealing it from a dead
+// node. The owner key's modified index is returned as the claim's fencing
+// token.
+func (m *taskManager) add(taskID string) (uint64, bool) {
 	// Attempt to claim the node
-	key, value := m.ownerNode(taskID)
-	_, err := m.client.Create(key, value, m.ttl)
+	key := m.ownerKey(taskID)
+	resp, err := m.client.Create(key, m.owner, ForeverTTL)
 	if err != nil {
 		etcdErr, ok := err.(*etcd.EtcdError)
 		if !ok || etcdErr.ErrorCode != EcodeNodeExist {
 			metafora.Errorf("Claim of %s failed with an unexpected error: %v", key, err)
-		} else {
+			return 0, false
+		}
+		if resp = m.steal(taskID); resp == nil {
 			metafora.Debugf("Claim of %s failed, already claimed", key)
+			return 0, false
 		}
-		return false
 	}
 
-	// Claim successful, start the refresher
 	metafora.Debugf("Claim successful: %s", key)
-	done := make(chan struct{})
-	release := make(chan struct{})
 	m.taskL.Lock()
-	m.tasks[taskID] = taskStates{done: done, release: release}
+	m.tasks[taskID] = resp.Node.ModifiedIndex
 	m.taskL.Unlock()
+	return resp.Node.ModifiedIndex, true
+}
 
-	metafora.Debugf("Starting claim refresher for task %s", taskID)
-	m.wg.Add(1)
-	go func() {
-		defer func() {
-			m.taskL.Lock()
-			delete(m.tasks, taskID)
-			m.taskL.Unlock()
-			m.wg.Done()
-		}()
-
-		for {
-			select {
-			case <-time.After(m.interval):
-				// Try to refresh the claim node (0 index means compare by value)
-				if _, err := m.client.CompareAndSwap(key, value, m.ttl, value, 0); err != nil {
-					metafora.Errorf("Error trying to update task %s ttl: %v", taskID, err)
-					m.ctx.Lost(taskID)
-					// On errors, don't even try to Delete as we're in a bad state
-					return
-				}
-			case <-done:
-				metafora.Debugf("Deleting directory for task %s as it's done.", taskID)
-				const recursive = true
-				if _, err := m.client.Delete(m.taskPath(taskID), recursive); err != nil {
-					metafora.Errorf("Error deleting task %s while stopping: %v", taskID, err)
-				}
-				return
-			case <-release:
-				metafora.Debugf("Deleting claim for task %s as it's released.", taskID)
-				// Not done, releasing; just delete the claim node
-				if _, err := m.client.CompareAndDelete(key, value, 0); err != nil {
-					metafora.Warnf("Error releasing task %s while stopping: %v", taskID, err)
-				}
-				return
-			}
-		}
-	}()
+// steal replaces an existing claim if the node which owns it is dead. Returns
+// nil if the claim wasn't stolen.
+func (m *taskManager) steal(taskID string) *etcd.Response {
+	const sorted = false
+	const recursive = false
+	key := m.ownerKey(taskID)
+	resp, err := m.client.Get(key, sorted, recursive)
+	if err != nil {
+		return nil
+	}
+	prev := resp.Node.Value
+	owner := ownerValue{}
+	if err := json.Unmarshal([]byte(prev), &owner); err != nil {
+		metafora.Warnf("Invalid owner for task %s: %q", taskID, prev)
+		return nil
+	}
+	if owner.Node == m.node || m.alive(owner.Node) {
+		return nil
+	}
+
+	// Compare by value so only one node can steal the claim
+	resp, err = m.client.CompareAndSwap(key, m.owner, ForeverTTL, prev, 0)
+	if err != nil {
+		metafora.Debugf("Unable to steal claim %s from dead node %s: %v", key, owner.Node, err)
+		return nil
+	}
+	metafora.Infof("Stole claim %s from dead node %s", key, owner.Node)
+	return resp
+}
+
+// alive returns true unless the node's key definitely doesn't exist.
+func (m *taskManager) alive(node string) bool {
+	const sorted = false
+	const recursive = false
+	_, err := m.client.Get(path.Join(m.nodePath, node), sorted, recursive)
+	if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == EcodeKeyNotFound {
+		return false
+	}
 	return true
 }
 
-// remove tells a single task's refresher to stop.
-func (m *taskManager) remove(taskID string, done bool) {
+// claims returns the claimed tasks and the etcd indexes of their claims.
+func (m *taskManager) claims() map[string]uint64 {
+	m.taskL.Lock()
+	defer m.taskL.Unlock()
+	claims := make(map[string]uint64, len(m.tasks))
+	for taskID, index := range m.tasks {
+		claims[taskID] = index
+	}
+	return claims
+}
+
+// claimed returns true if the task is currently claimed by this node.
+func (m *taskManager) claimed(taskID string) bool {
+	m.taskL.Lock()
+	defer m.taskL.Unlock()
+	_, ok := m.tasks[taskID]
+	return ok
+}
+
+// forget removes a task from the claimed set and returns true if it was
+// present.
+func (m *taskManager) forget(taskID string) bool {
 	m.taskL.Lock()
 	defer m.taskL.Unlock()
-	states, ok := m.tasks[taskID]
-	if !ok {
-		metafora.Debugf("Cannot remove task %s from refresher: not present.", taskID)
+	if _, ok := m.tasks[taskID]; !ok {
+		return false
+	}
+	delete(m.tasks, taskID)
+	return true
+}
+
+// remove deletes a task's claim or, if it's done, the entire task.
+func (m *taskManager) remove(taskID string, done bool) {
+	if !m.forget(taskID) {
+		metafora.Debugf("Cannot remove task %s from manager: not present.", taskID)
 		return
 	}
 
-	select {
-	case <-states.release:
-		// already stopping
-	case <-states.done:
-		// already stopping
-	default:
-		if done {
-			close(states.done)
-		} else {
-			close(states.release)
+	if done {
+		metafora.Debugf("Deleting directory for task %s as it's done.", taskID)
+		const recursive = true
+		if _, err := m.client.Delete(m.taskPath(taskID), recursive); err != nil {
+			metafora.Errorf("Error deleting task %s while stopping: %v", taskID, err)
 		}
+		return
+	}
+
+	metafora.Debugf("Deleting claim for task %s as it's released.", taskID)
+	// Not done, releasing; just delete the claim node if it's still ours
+	if _, err := m.client.CompareAndDelete(m.ownerKey(taskID), m.owner, 0); err != nil {
+		metafora.Warnf("Error releasing task %s while stopping: %v", taskID, err)
 	}
 }
 
-// stop blocks until all refreshers have exited.
-func (m *taskManager) stop() {
-	func() {
-		m.taskL.Lock()
-		defer m.taskL.Unlock()
-		for _, states := range m.tasks {
-			select {
-			case <-states.release:
-				// already stopping
-			case <-states.done:
-				// already stopping
-			default:
-				close(states.release)
+// lost forgets a task whose claim has been deleted or stolen and notifies the
+// consumer.
+func (m *taskManager) lost(taskID string) {
+	if m.forget(taskID) {
+		m.ctx.Lost(taskID)
+	}
+}
+
+// lostAt is like lost but only loses the task if it was claimed at or before
+// the given etcd index. Prevents events and reads which predate the current
+// claim from losing it.
+func (m *taskManager) lostAt(taskID string, index uint64) {
+	m.taskL.Lock()
+	claim, ok := m.tasks[taskID]
+	current := ok && claim <= index
+	if current {
+		delete(m.tasks, taskID)
+	}
+	m.taskL.Unlock()
+	if current {
+		m.ctx.Lost(taskID)
+	}
+}
+
+// loseAll forgets all tasks and notifies the consumer they've been lost.
+func (m *taskManager) loseAll() {
+	m.taskL.Lock()
+	lost := make([]string, 0, len(m.tasks))
+	for taskID := range m.tasks {
+		lost = append(lost, taskID)
+	}
+	m.tasks = make(map[string]uint64)
+	m.taskL.Unlock()
+
+	for _, taskID := range lost {
+		m.ctx.Lost(taskID)
+	}
+}
+
+// reap deletes all claims owned by a dead node so other nodes may claim its
+// tasks.
+func (m *taskManager) reap(node string) {
+	const sorted = false
+	const recursive = true
+	resp, err := m.client.Get(m.path, sorted, recursive)
+	if err != nil {
+		metafora.Errorf("Error retrieving tasks to reap claims of node %s: %v", node, err)
+		return
+	}
+
+	for _, task := range resp.Node.Nodes {
+		for _, claim := range task.Nodes {
+			if path.Base(claim.Key) != OwnerMarker {
+				continue
+			}
+			owner := ownerValue{}
+			if err := json.Unmarshal([]byte(claim.Value), &owner); err != nil || owner.Node != node {
+				continue
+			}
+			// Other nodes may be reaping concurrently, so ignore failures
+			if _, err := m.client.CompareAndDelete(claim.Key, claim.Value, 0); err == nil {
+				metafora.Infof("Released claim %s of dead node %s", claim.Key, node)
 			}
 		}
-	}()
-	m.wg.Wait()
+	}
+}
+
+// stop releases all claims.
+func (m *taskManager) stop() {
+	m.taskL.Lock()
+	tasks := make([]string, 0, len(m.tasks))
+	for taskID := range m.tasks {
+		tasks = append(tasks, taskID)
+	}
+	m.taskL.Unlock()
+
+	const done = false
+	for _, taskID := range tasks {
+		m.remove(taskID, done)
+	}
 }
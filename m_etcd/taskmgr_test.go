@@ -1,23 +1,40 @@
 package m_etcd
 
 import (
-	"fmt"
 	"testing"
-	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 )
 
 type fakeEtcd struct {
-	add chan string
-	del chan string
-	cas chan string
-	cad chan string
+	keys  map[string]string // existing keys
+	index *uint64           // etcd index of the last write
+	add   chan string
+	del   chan string
+	cas   chan string
+	cad   chan string
+}
+
+func (f fakeEtcd) Get(key string, sort, recursive bool) (*etcd.Response, error) {
+	v, ok := f.keys[key]
+	if !ok {
+		return nil, &etcd.EtcdError{ErrorCode: EcodeKeyNotFound}
+	}
+	return &etcd.Response{Node: &etcd.Node{Key: key, Value: v}}, nil
 }
 
 func (f fakeEtcd) Create(key, value string, ttl uint64) (*etcd.Response, error) {
+	if _, ok := f.keys[key]; ok {
+		return nil, &etcd.EtcdError{ErrorCode: EcodeNodeExist}
+	}
 	f.add <- key
-	return nil, nil
+	return f.write(key), nil
+}
+
+// write returns a response for a write with a new index.
+func (f fakeEtcd) write(key string) *etcd.Response {
+	*f.index++
+	return &etcd.Response{Node: &etcd.Node{Key: key, ModifiedIndex: *f.index}}
 }
 
 func (f fakeEtcd) Delete(key string, recursive bool) (*etcd.Response, error) {
@@ -31,201 +48,126 @@ func (f fakeEtcd) CompareAndDelete(k, pv string, _ uint64) (*etcd.Response, erro
 }
 
 func (f fakeEtcd) CompareAndSwap(k, v string, ttl uint64, pv string, _ uint64) (*etcd.Response, error) {
-	if k == "testns/testlost/owner" {
-		return nil, fmt.Errorf("test error")
-	}
 	f.cas <- k
-	return nil, nil
+	return f.write(k), nil
 }
+
 func newFakeEtcd() fakeEtcd {
 	return fakeEtcd{
-		add: make(chan string, 10),
-		del: make(chan string, 10),
-		cas: make(chan string, 10),
-		cad: make(chan string, 10),
-	}
-}
-
-// Test that tasks are refreshed periodically.
-func TestTaskRefreshing(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping due to -short")
-	}
-
-	client := newFakeEtcd()
-	const ttl = 2
-	mgr := newManager(newCtx(t, "mgr"), client, "testns", "testnode", ttl)
-	defer mgr.stop()
-	mgr.add("tid")
-	for i := 0; i < 2; i++ {
-		select {
-		case <-client.cas:
-			t.Log("Task refreshed.")
-		case <-client.cad:
-			t.Errorf("Task deleted?! This isn't right at all.")
-		case <-time.After(4 * time.Second):
-			t.Errorf("Task wasn't refreshed soon enough.")
-		}
+		keys:  map[string]string{},
+		index: new(uint64),
+		add:   make(chan string, 10),
+		del:   make(chan string, 10),
+		cas:   make(chan string, 10),
+		cad:   make(chan string, 10),
 	}
 }
 
-// Test that tasks can be removed before they're even refreshed.
+// Test that claims are created without refreshers and deleted on release.
 func TestTaskRemoval(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping due to -short")
-	}
-
 	client := newFakeEtcd()
-	const ttl = 2
-	mgr := newManager(newCtx(t, "mgr"), client, "testns", "testnode", ttl)
-	defer mgr.stop()
-	mgr.add("tid")
+	mgr := newManager(newCtx(t, "mgr"), client, "testns", "testnodes", "testnode")
+	if _, ok := mgr.add("tid"); !ok {
+		t.Fatal("Unable to claim task")
+	}
 	mgr.remove("tid", false)
-	select {
-	case <-client.add:
-		// Yay, everything worked
-	case <-time.After(500 * time.Millisecond):
-		t.Errorf("Task wasn't added soon enough.")
+	if len(client.add) != 1 || <-client.add != mgr.ownerKey("tid") {
+		t.Errorf("Expected claim to be created")
 	}
-	select {
-	case <-client.cad:
-		// Yay, everything worked
-	case <-time.After(500 * time.Millisecond):
-		t.Errorf("Task wasn't removed soon enough.")
+	if len(client.cad) != 1 || <-client.cad != mgr.ownerKey("tid") {
+		t.Errorf("Expected claim to be deleted")
 	}
-
-	select {
-	case <-client.cas:
-		t.Errorf("Task shouldn't have lived long enough to be CAS'd")
-	default:
+	if len(client.cas) > 0 {
+		t.Errorf("Claims shouldn't be refreshed")
 	}
-}
 
-// Test multiple tasks can be added, will be refreshed, removed, and stopped.
-func TestFullTaskMgr(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping due to -short")
+	// Removing twice is a noop
+	mgr.remove("tid", false)
+	if len(client.cad) > 0 {
+		t.Errorf("Claim deleted twice")
 	}
+}
 
+// Test that marking tasks as done calls delete and stop releases the rest.
+func TestTaskDone(t *testing.T) {
 	client := newFakeEtcd()
-	const ttl = 2
-	mgr := newManager(newCtx(t, "mgr"), client, "testns", "testnode", ttl)
-	defer mgr.stop()
-
-	// Add a few tasks and remove one
-	mgr.add("tid1")
-	mgr.add("tid2")
-	mgr.add("tid3")
-	mgr.remove("tid2", false)
-
-	delDone := false
-	expectedSwaps := map[string]bool{mgr.ownerKey("tid1"): true, mgr.ownerKey("tid3"): true}
-
-	// Test that only expected actions occurred (and in a timely manner)
-	for i := 0; i < 3; i++ {
-		select {
-		case path := <-client.cas:
-			if !expectedSwaps[path] {
-				t.Errorf("CAS'd unexpected task: %s", path)
-			}
-			delete(expectedSwaps, path)
-		case path := <-client.cad:
-			if path != mgr.ownerKey("tid2") {
-				t.Errorf("Deleted unexpected task: %s", path)
-			}
-			if delDone {
-				t.Errorf("Deleted tid2 twice!")
-			}
-			delDone = true
-		case <-time.After(1500 * time.Millisecond):
-			t.Errorf("Took too long for refreshes to happen")
-		}
-	}
-
-	// Calling remove and stop concurrently should be safe
-	go mgr.remove("tid3", false)
-	go mgr.stop()
-	expectedDels := map[string]bool{mgr.ownerKey("tid1"): true, mgr.ownerKey("tid3"): true}
-	for len(expectedDels) > 0 {
-		select {
-		case path := <-client.cad:
-			if !expectedDels[path] {
-				t.Errorf("Removed unexpected task: %s", path)
-			}
-			delete(expectedDels, path)
-		case <-time.After(1 * time.Second):
-			t.Errorf("Took too long for deletes to happen")
-		}
+	mgr := newManager(newCtx(t, "mgr"), client, "testns", "testnodes", "testnode")
+
+	mgr.add("t1")
+	mgr.add("t2")
+	mgr.add("t3")
+	mgr.remove("t1", true)
+	mgr.stop()
+
+	if len(client.cas) > 0 {
+		t.Errorf("Expected 0 CASs but found %d", len(client.cas))
+	}
+	if len(client.cad) != 2 {
+		t.Errorf("Expected 2 CADs but found %d", len(client.cad))
+	}
+	if len(client.del) != 1 || <-client.del != mgr.taskPath("t1") {
+		t.Errorf("Expected t1 to be deleted")
 	}
 
 	// Stopping more than once is silly but should be a safe noop
 	mgr.stop()
-	if len(client.cad) > 0 {
+	if len(client.cad) != 2 {
 		t.Errorf("Unexpected deletes occurred")
 	}
 }
 
-// Test that losing tasks who cannot be refreshed works.
-func TestTaskLost(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping due to -short")
-	}
-
-	ctx := newCtx(t, "mgr")
+// Test that claims are only stolen from dead nodes.
+func TestTaskSteal(t *testing.T) {
 	client := newFakeEtcd()
-	const ttl = 2
-	mgr := newManager(ctx, client, "testns", "testnode", ttl)
-	defer mgr.stop()
+	mgr := newManager(newCtx(t, "mgr"), client, "testns", "testnodes", "testnode")
 
-	mgr.add("testlost")
-
-	// Wait for the CAS to fail
-	time.Sleep(ttl * time.Second)
+	first, ok := mgr.add("new")
+	if !ok {
+		t.Fatal("Unable to claim a new task")
+	}
 
-	if len(client.cas) > 0 {
-		t.Error("Unexpected CAS. Should have failed.")
+	client.keys["testns/alive/owner"] = `{"node":"node2"}`
+	client.keys["testnodes/node2"] = ""
+	if _, ok := mgr.add("alive"); ok {
+		t.Fatal("Claimed a task owned by a live node")
 	}
-	n := len(ctx.lost)
-	if n != 1 {
-		t.Fatalf("Expected 1 lost task, but found %d.", n)
+
+	client.keys["testns/dead/owner"] = `{"node":"node3"}`
+	token, ok := mgr.add("dead")
+	if !ok {
+		t.Fatal("Unable to claim a task owned by a dead node")
 	}
-	if <-ctx.lost != "testlost" {
-		t.Fatalf("Lost a different task ID than expected! Oh my.")
+	if token <= first {
+		t.Fatalf("Expected stolen claim's token to be > %d but found %d", first, token)
 	}
-
-	// removing a lost task should be a noop
-	mgr.remove("testlost", false)
-	// as should stopping
-	mgr.stop()
-
-	if len(client.cad) > 0 {
-		t.Error("Unexpectedly deleted non-existant tasks when shutting down.")
+	if len(client.cas) != 1 || <-client.cas != "testns/dead/owner" {
+		t.Fatal("Expected dead node's claim to be swapped")
 	}
 }
 
-// Test that marking tests as done calls delete.
-func TestTaskDone(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping due to -short")
-	}
-
+// Test that claims are only lost by events after the current claim.
+func TestTaskLost(t *testing.T) {
 	ctx := newCtx(t, "mgr")
 	client := newFakeEtcd()
-	const ttl = 2
-	mgr := newManager(ctx, client, "testns", "testnode", ttl)
+	mgr := newManager(ctx, client, "testns", "testnodes", "testnode")
 
-	mgr.add("t1")
-	mgr.add("t2")
-	mgr.remove("t1", true)
-	mgr.stop()
+	t1, _ := mgr.add("t1")
+	t2, _ := mgr.add("t2")
 
-	if len(client.cas) > 0 {
-		t.Errorf("Expected 0 CASs but found %d", len(client.cas))
+	// An event before the current claim mustn't lose it
+	mgr.lostAt("t1", t1-1)
+	mgr.lostAt("t2", t2+1)
+	if len(ctx.lost) != 1 || <-ctx.lost != "t2" {
+		t.Fatal("Expected only t2 to be lost")
 	}
-	if len(client.cad) != 1 {
-		t.Errorf("Expected 1 CAD but found %d", len(client.cad))
+	if claims := mgr.claims(); len(claims) != 1 || claims["t1"] != t1 {
+		t.Fatalf("Expected only t1 to be claimed but found: %v", claims)
 	}
-	if len(client.del) != 1 {
-		t.Errorf("Expected 1 delete but found %d", len(client.del))
+
+	// removing a lost task should be a noop as should stopping
+	mgr.remove("t2", false)
+	mgr.stop()
+	if len(client.cad) != 1 || <-client.cad != mgr.ownerKey("t1") {
+		t.Error("Expected only t1 to be released on stop")
 	}
 }
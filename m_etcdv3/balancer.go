@@ -0,0 +1,91 @@
+package m_etcdv3
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/lytics/metafora"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// NewFairBalancer creates a new metafora.DefaultFairBalancer that uses etcd
+// for counting tasks per node.
+func NewFairBalancer(nodeid, namespace string, client *clientv3.Client) metafora.Balancer {
+	namespace = "/" + strings.Trim(namespace, "/ ")
+	e := etcdClusterState{
+		client:   client,
+		taskPath: path.Join(namespace, TasksPath),
+		nodePath: path.Join(namespace, NodesPath),
+	}
+	return metafora.NewDefaultFairBalancer(nodeid, &e)
+}
+
+// Checks the current state of an etcd cluster
+type etcdClusterState struct {
+	client   *clientv3.Client
+	taskPath string
+	nodePath string
+}
+
+func (e *etcdClusterState) NodeTaskCount() (map[string]int, error) {
+	view, err := e.view("")
+	return view.NodeTasks, err
+}
+
+// view returns a metafora.ClusterView for nodeID.
+func (e *etcdClusterState) view(nodeID string) (metafora.ClusterView, error) {
+	// First initialize state with nodes as keys
+	nodes, err := nodes(e.client, e.nodePath)
+	if err != nil {
+		return metafora.ClusterView{}, err
+	}
+	view := metafora.ClusterView{
+		NodeID:    nodeID,
+		Nodes:     nodes,
+		NodeTasks: make(map[string]int, len(nodes)),
+	}
+	for _, node := range nodes {
+		view.NodeTasks[node] = 0
+	}
+
+	// Then count how many tasks each node has
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	resp, err := e.client.Get(ctx, e.taskPath+"/", clientv3.WithPrefix())
+	if err != nil {
+		return metafora.ClusterView{}, err
+	}
+
+	tasks := map[string]bool{} // task ID -> claimed
+	for _, kv := range resp.Kvs {
+		task, owner, ok := parseTaskKey(e.taskPath, kv.Key)
+		if !ok {
+			continue
+		}
+		if !owner {
+			if _, ok := tasks[task]; !ok {
+				tasks[task] = false
+			}
+			continue
+		}
+		tasks[task] = true
+		val := ownerValue{}
+		if err := json.Unmarshal(kv.Value, &val); err != nil {
+			continue
+		}
+		// Only count nodes which are registered, as some nodes may be
+		// shutting down, etc, and should not be counted
+		if _, ok := view.NodeTasks[val.Node]; ok {
+			view.NodeTasks[val.Node]++
+		}
+	}
+	for _, claimed := range tasks {
+		if !claimed {
+			view.Backlog++
+		}
+	}
+
+	return view, nil
+}
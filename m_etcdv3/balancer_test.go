@@ -0,0 +1,36 @@
+package m_etcdv3
+
+import (
+	"testing"
+
+	"github.com/lytics/metafora/internal/coordtest"
+)
+
+func TestNodeTaskCount(t *testing.T) {
+	t.Parallel()
+	coord1, client, namespace := setupEtcd(t)
+	coordtest.Init(t, coord1)
+	defer coord1.Close()
+	coord2 := NewEtcdV3Coordinator("node2", namespace, client)
+	coordtest.Init(t, coord2)
+	defer coord2.Close()
+
+	mclient := NewClient(namespace, client)
+	for _, task := range []string{"t1", "t2", "t3"} {
+		if err := mclient.SubmitTask(task); err != nil {
+			t.Fatalf("Error submitting task: %v", err)
+		}
+	}
+	coord1.Claim("t1")
+	coord1.Claim("t2")
+	coord2.Claim("t3")
+
+	cs := &etcdClusterState{client: client, taskPath: coord1.taskPath, nodePath: namespace + "/" + NodesPath}
+	counts, err := cs.NodeTaskCount()
+	if err != nil {
+		t.Fatalf("Error counting tasks: %v", err)
+	}
+	if len(counts) != 2 || counts[nodeID] != 2 || counts["node2"] != 1 {
+		t.Fatalf("Unexpected task counts: %v", counts)
+	}
+}
@@ -0,0 +1,120 @@
+package m_etcdv3
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lytics/metafora"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// NewClient creates a new client using an etcd v3 backend.
+func NewClient(namespace string, client *clientv3.Client) metafora.Client {
+	namespace = "/" + strings.Trim(namespace, "/ ")
+	return &mclient{
+		etcd:     client,
+		taskPath: path.Join(namespace, TasksPath),
+		nodePath: path.Join(namespace, NodesPath),
+	}
+}
+
+// Type 'mclient' is an internal implementation of metafora.Client with an
+// etcd v3 backend.
+type mclient struct {
+	etcd     *clientv3.Client
+	taskPath string
+	nodePath string
+}
+
+func (mc *mclient) tskPath(taskID string) string {
+	return path.Join(mc.taskPath, taskID)
+}
+
+func (mc *mclient) cmdPath(node string) string {
+	return path.Join(mc.nodePath, node, CommandsPath)
+}
+
+// SubmitTask creates a new task key. An error is returned if the task
+// already exists.
+func (mc *mclient) SubmitTask(taskID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	key := mc.tskPath(taskID)
+	resp, err := mc.etcd.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "")).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("task %s already exists", taskID)
+	}
+	metafora.Debugf("task submitted [%s]", key)
+	return nil
+}
+
+// DeleteTask deletes a task and its claim.
+func (mc *mclient) DeleteTask(taskID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	key := mc.tskPath(taskID)
+	_, err := mc.etcd.Txn(ctx).
+		Then(clientv3.OpDelete(key), clientv3.OpDelete(key+"/", clientv3.WithPrefix())).
+		Commit()
+	metafora.Debugf("task deleted [%s]", key)
+	return err
+}
+
+// SubmitCommand creates a new command for a particular node. Commands are
+// executed in the order they're created.
+func (mc *mclient) SubmitCommand(node string, command metafora.Command) error {
+	body, err := command.Marshal()
+	if err != nil {
+		// This is either a bug in metafora or someone implemented their own
+		// command incorrectly.
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	key := path.Join(mc.cmdPath(node), fmt.Sprintf("%020d", time.Now().UnixNano()))
+	if _, err := mc.etcd.Put(ctx, key, string(body)); err != nil {
+		metafora.Errorf("Error submitting command: %s to node: %s", command, node)
+		return err
+	}
+	metafora.Debugf("Submitted command: %s to node: %s", command, node)
+	return nil
+}
+
+// Nodes fetches the IDs of currently registered nodes.
+func (mc *mclient) Nodes() ([]string, error) {
+	return nodes(mc.etcd, mc.nodePath)
+}
+
+// nodes returns the IDs of nodes registered under nodePath.
+func nodes(client *clientv3.Client, nodePath string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	resp, err := client.Get(ctx, nodePath+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []string{}
+	for _, kv := range resp.Kvs {
+		// Skip commands
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), nodePath+"/"), "/")
+		if len(parts) == 1 {
+			nodes = append(nodes, parts[0])
+		}
+	}
+	return nodes, nil
+}
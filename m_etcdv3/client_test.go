@@ -0,0 +1,65 @@
+package m_etcdv3
+
+import (
+	"testing"
+
+	"github.com/lytics/metafora"
+	"github.com/lytics/metafora/internal/coordtest"
+)
+
+// TestSubmitTask tests that the same task ID cannot be submitted twice.
+func TestSubmitTask(t *testing.T) {
+	t.Parallel()
+	_, client, namespace := setupEtcd(t)
+	mclient := NewClient(namespace, client)
+
+	if err := mclient.SubmitTask("testid1"); err != nil {
+		t.Fatalf("Submit task failed on initial submission, error: %v", err)
+	}
+	if err := mclient.SubmitTask("testid1"); err == nil {
+		t.Fatal("Submit task did not fail when using existing task id")
+	}
+	if err := mclient.DeleteTask("testid1"); err != nil {
+		t.Fatalf("Error deleting task: %v", err)
+	}
+	if err := mclient.SubmitTask("testid1"); err != nil {
+		t.Fatalf("Submit task failed after deleting task, error: %v", err)
+	}
+}
+
+// TestNodes tests that Nodes returns registered nodes and not commands.
+func TestNodes(t *testing.T) {
+	t.Parallel()
+	coord, client, namespace := setupEtcd(t)
+	mclient := NewClient(namespace, client)
+
+	nodes, err := mclient.Nodes()
+	if err != nil {
+		t.Fatalf("Error listing nodes: %v", err)
+	}
+	if len(nodes) != 0 {
+		t.Fatalf("Expected no nodes but found: %v", nodes)
+	}
+
+	coordtest.Init(t, coord)
+	if err := mclient.SubmitCommand(nodeID, metafora.CommandFreeze()); err != nil {
+		t.Fatalf("Error submitting command: %v", err)
+	}
+
+	nodes, err = mclient.Nodes()
+	if err != nil {
+		t.Fatalf("Error listing nodes: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0] != nodeID {
+		t.Fatalf("Expected [%s] but found: %v", nodeID, nodes)
+	}
+
+	coord.Close()
+	nodes, err = mclient.Nodes()
+	if err != nil {
+		t.Fatalf("Error listing nodes: %v", err)
+	}
+	if len(nodes) != 0 {
+		t.Fatalf("Expected no nodes after Close but found: %v", nodes)
+	}
+}
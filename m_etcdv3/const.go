@@ -0,0 +1,13 @@
+package m_etcdv3
+
+const (
+	TasksPath    = "tasks"
+	NodesPath    = "nodes"
+	CommandsPath = "commands"
+	OwnerMarker  = "owner"
+
+	// DefaultLeaseTTL is the TTL (in seconds) of the lease each node grants
+	// itself on Init. The node key and all of the node's claims are attached to
+	// this lease.
+	DefaultLeaseTTL int64 = 20
+)
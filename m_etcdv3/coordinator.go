@@ -0,0 +1,561 @@
+package m_etcdv3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/lytics/metafora"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// RequestTimeout bounds non-blocking requests to etcd made by the coordinator
+// and client.
+var RequestTimeout = 5 * time.Second
+
+const (
+	minWatchBackoff = time.Second
+	maxWatchBackoff = 30 * time.Second
+)
+
+type ownerValue struct {
+	Node string `json:"node"`
+}
+
+// EtcdV3Coordinator is a Metafora Coordinator using etcd's v3 API as the
+// broker.
+//
+// Each coordinator grants a single lease in Init. The node key and all claims
+// are attached to it, so keeping claims alive costs one keepalive stream per
+// node regardless of the number of tasks claimed.
+type EtcdV3Coordinator struct {
+	Client    *clientv3.Client
+	cordCtx   metafora.CoordinatorContext
+	namespace string
+	taskPath  string
+
+	// LeaseTTL is the TTL in seconds of the node's lease. Must be set before
+	// Init is called.
+	LeaseTTL int64
+
+	NodeID      string
+	nodePath    string
+	commandPath string
+	owner       string // JSON encoded ownerValue for this node
+
+	lease clientv3.LeaseID
+
+	// claimed tasks
+	tasks map[string]bool
+	taskL sync.Mutex
+
+	// ctx is canceled by Close() to stop keepalives and blocking watches
+	ctx    context.Context
+	cancel context.CancelFunc
+	closeL sync.Mutex
+	closed bool
+}
+
+// NewEtcdV3Coordinator creates a new Metafora Coordinator implementation
+// using etcd's v3 API as the broker. If no node ID is specified, a unique one
+// will be generated.
+//
+// Coordinator methods will be called by the core Metafora Consumer. Calling
+// Init, Close, etc. from your own code will lead to undefined behavior.
+func NewEtcdV3Coordinator(nodeID, namespace string, client *clientv3.Client) metafora.Coordinator {
+	// Namespace should be an absolute path with no trailing slash
+	namespace = "/" + strings.Trim(namespace, "/ ")
+
+	if nodeID == "" {
+		hn, _ := os.Hostname()
+		nodeID = hn + "-" + uuid.NewRandom().String()
+	}
+
+	nodeID = strings.Trim(nodeID, "/ ")
+
+	owner, err := json.Marshal(&ownerValue{Node: nodeID})
+	if err != nil {
+		panic(fmt.Sprintf("coordinator: error marshalling node body: %v", err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EtcdV3Coordinator{
+		Client:    client,
+		namespace: namespace,
+		taskPath:  path.Join(namespace, TasksPath),
+		LeaseTTL:  DefaultLeaseTTL,
+
+		NodeID:      nodeID,
+		nodePath:    path.Join(namespace, NodesPath, nodeID),
+		commandPath: path.Join(namespace, NodesPath, nodeID, CommandsPath),
+		owner:       string(owner),
+
+		tasks: make(map[string]bool),
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Init grants the node's lease, registers the node, and starts keeping the
+// lease alive.
+func (ec *EtcdV3Coordinator) Init(cordCtx metafora.CoordinatorContext) error {
+	metafora.Debugf("Initializing coordinator with namespace: %s and etcd cluster: %s",
+		ec.namespace, strings.Join(ec.Client.Endpoints(), ", "))
+
+	ec.cordCtx = cordCtx
+
+	ctx, cancel := context.WithTimeout(ec.ctx, RequestTimeout)
+	defer cancel()
+	lease, err := ec.Client.Grant(ctx, ec.LeaseTTL)
+	if err != nil {
+		return err
+	}
+	ec.lease = lease.ID
+
+	// Register the node; fail if another node with the same ID is alive
+	resp, err := ec.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(ec.nodePath), "=", 0)).
+		Then(clientv3.OpPut(ec.nodePath, ec.owner, clientv3.WithLease(ec.lease))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("node %s is already registered", ec.NodeID)
+	}
+
+	keepalive, err := ec.Client.KeepAlive(ec.ctx, ec.lease)
+	if err != nil {
+		return err
+	}
+	go ec.leaseKeeper(keepalive)
+	go ec.nodeWatcher(resp.Header.Revision + 1)
+	return nil
+}
+
+// leaseKeeper drains keepalive responses. If the keepalive channel closes
+// before the coordinator is closed the lease -- and therefore every claim --
+// has been lost, so the coordinator must shutdown.
+func (ec *EtcdV3Coordinator) leaseKeeper(keepalive <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range keepalive {
+	}
+
+	if ec.isClosed() {
+		return
+	}
+
+	metafora.Errorf("Lease for node %s lost. Closing coordinator.", ec.NodeID)
+	ec.taskL.Lock()
+	lost := make([]string, 0, len(ec.tasks))
+	for task := range ec.tasks {
+		lost = append(lost, task)
+	}
+	ec.tasks = make(map[string]bool)
+	ec.taskL.Unlock()
+
+	for _, task := range lost {
+		ec.cordCtx.Lost(task)
+	}
+	ec.Close()
+}
+
+// nodeWatcher watches the nodes path starting at rev and notifies the
+// Consumer when other nodes join or leave the cluster.
+//
+// Watch errors such as losing the etcd leader are retried with an exponential
+// backoff up to maxWatchBackoff so an unhealthy cluster isn't hammered.
+func (ec *EtcdV3Coordinator) nodeWatcher(rev int64) {
+	prefix := path.Join(ec.namespace, NodesPath) + "/"
+	backoff := minWatchBackoff
+	for !ec.isClosed() {
+		wch := ec.Client.Watch(clientv3.WithRequireLeader(ec.ctx), prefix,
+			clientv3.WithPrefix(), clientv3.WithRev(rev))
+		for wresp := range wch {
+			if err := wresp.Err(); err != nil {
+				if wresp.CompactRevision != 0 {
+					// Events were missed, so assume membership changed
+					rev = wresp.CompactRevision
+					ec.cordCtx.NodesChanged()
+				} else {
+					metafora.Warnf("Error watching nodes: %v", err)
+				}
+				break
+			}
+			backoff = minWatchBackoff
+			rev = wresp.Header.Revision + 1
+			for _, ev := range wresp.Events {
+				node := strings.TrimPrefix(string(ev.Kv.Key), prefix)
+				if strings.Contains(node, "/") || node == ec.NodeID {
+					continue
+				}
+				switch {
+				case ev.Type == clientv3.EventTypeDelete:
+					metafora.Infof("Node %s left", node)
+				case ev.IsCreate():
+					metafora.Infof("Node %s joined", node)
+				default:
+					continue
+				}
+				ec.cordCtx.NodesChanged()
+			}
+		}
+		if ec.isClosed() {
+			return
+		}
+		select {
+		case <-ec.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+func (ec *EtcdV3Coordinator) isClosed() bool {
+	ec.closeL.Lock()
+	defer ec.closeL.Unlock()
+	return ec.closed
+}
+
+func (ec *EtcdV3Coordinator) taskKey(taskID string) string {
+	return path.Join(ec.taskPath, taskID)
+}
+
+func (ec *EtcdV3Coordinator) ownerKey(taskID string) string {
+	return path.Join(ec.taskPath, taskID, OwnerMarker)
+}
+
+// parseTaskKey returns the task ID for keys in the task path and whether or
+// not the key is the task's owner key. ok is false for any other key.
+func parseTaskKey(taskPath string, key []byte) (task string, owner bool, ok bool) {
+	k := string(key)
+	if !strings.HasPrefix(k, taskPath+"/") {
+		metafora.Errorf("Received task from outside task path: %s", k)
+		return "", false, false
+	}
+	parts := strings.Split(strings.TrimPrefix(k, taskPath+"/"), "/")
+	switch {
+	case len(parts) == 1:
+		return parts[0], false, true
+	case len(parts) == 2 && parts[1] == OwnerMarker:
+		return parts[0], true, true
+	}
+	// Ignore any other keys
+	return "", false, false
+}
+
+// Watch returns the first unclaimed task or blocks until a task is created or
+// released. It returns ("", nil) if the coordinator is closed.
+func (ec *EtcdV3Coordinator) Watch() (taskID string, err error) {
+	for {
+		if ec.isClosed() {
+			return "", nil
+		}
+
+		// Get existing tasks
+		resp, err := ec.Client.Get(ec.ctx, ec.taskPath+"/",
+			clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+		if err != nil {
+			if ec.isClosed() {
+				return "", nil
+			}
+			metafora.Errorf("%s Error getting the existing tasks: %v", ec.taskPath, err)
+			return "", err
+		}
+
+		tasks := []string{}
+		claimed := map[string]bool{}
+		for _, kv := range resp.Kvs {
+			task, owner, ok := parseTaskKey(ec.taskPath, kv.Key)
+			switch {
+			case !ok:
+			case owner:
+				claimed[task] = true
+			default:
+				tasks = append(tasks, task)
+			}
+		}
+		for _, task := range tasks {
+			if !claimed[task] {
+				metafora.Debugf("Received existing task: %s", task)
+				return task, nil
+			}
+		}
+
+		// Watch for changes since the Get
+		task, err := ec.watchTasks(resp.Header.Revision + 1)
+		if err == rpctypes.ErrCompacted {
+			metafora.Debugf("%s Revision compacted. Restarting watch.", ec.taskPath)
+			continue
+		}
+		return task, err
+	}
+}
+
+// watchTasks blocks until a task is created or released after the given
+// revision.
+func (ec *EtcdV3Coordinator) watchTasks(rev int64) (string, error) {
+	ctx, cancel := context.WithCancel(ec.ctx)
+	defer cancel()
+
+	wch := ec.Client.Watch(clientv3.WithRequireLeader(ctx), ec.taskPath+"/",
+		clientv3.WithPrefix(), clientv3.WithRev(rev))
+	for wresp := range wch {
+		if err := wresp.Err(); err != nil {
+			if ec.isClosed() {
+				return "", nil
+			}
+			return "", err
+		}
+
+		// Tasks deleted in this response should not be returned even if their
+		// owner key was deleted along with them.
+		candidates := []string{}
+		deleted := map[string]bool{}
+		for _, ev := range wresp.Events {
+			task, owner, ok := parseTaskKey(ec.taskPath, ev.Kv.Key)
+			if !ok {
+				continue
+			}
+			switch {
+			case ev.Type == clientv3.EventTypePut && !owner && ev.IsCreate():
+				metafora.Debugf("Received new task: %s", task)
+				candidates = append(candidates, task)
+			case ev.Type == clientv3.EventTypeDelete && owner:
+				metafora.Debugf("Received released task: %s", task)
+				candidates = append(candidates, task)
+			case ev.Type == clientv3.EventTypeDelete:
+				deleted[task] = true
+			}
+		}
+		for _, task := range candidates {
+			if !deleted[task] {
+				return task, nil
+			}
+		}
+	}
+
+	// Watch channel closes when the coordinator is closed
+	if ec.isClosed() {
+		return "", nil
+	}
+	return "", ctx.Err()
+}
+
+// Claim is called by the Consumer when a Balancer has determined that a task
+// ID can be claimed. Claim returns false if another consumer has already
+// claimed the ID or the task no longer exists.
+func (ec *EtcdV3Coordinator) Claim(taskID string) bool {
+	_, ok := ec.FencedClaim(taskID)
+	return ok
+}
+
+// FencedClaim is like Claim but also returns the revision of the claim as its
+// fencing token. Since etcd's revision increases with every write, later
+// claims always receive greater tokens.
+func (ec *EtcdV3Coordinator) FencedClaim(taskID string) (uint64, bool) {
+	ctx, cancel := context.WithTimeout(ec.ctx, RequestTimeout)
+	defer cancel()
+
+	key := ec.ownerKey(taskID)
+	resp, err := ec.Client.Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.CreateRevision(ec.taskKey(taskID)), ">", 0),
+			clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+		).
+		Then(clientv3.OpPut(key, ec.owner, clientv3.WithLease(ec.lease))).
+		Commit()
+	if err != nil {
+		metafora.Errorf("Claim of %s failed with an unexpected error: %v", key, err)
+		return 0, false
+	}
+	if !resp.Succeeded {
+		metafora.Debugf("Claim of %s failed, already claimed or deleted", key)
+		return 0, false
+	}
+
+	metafora.Debugf("Claim successful: %s", key)
+	ec.taskL.Lock()
+	ec.tasks[taskID] = true
+	ec.taskL.Unlock()
+	return uint64(resp.Header.Revision), true
+}
+
+// forget removes a task from the claimed set and returns true if it was
+// present.
+func (ec *EtcdV3Coordinator) forget(taskID string) bool {
+	ec.taskL.Lock()
+	defer ec.taskL.Unlock()
+	if !ec.tasks[taskID] {
+		return false
+	}
+	delete(ec.tasks, taskID)
+	return true
+}
+
+// Release deletes the claim key if it's still owned by this node's lease.
+func (ec *EtcdV3Coordinator) Release(taskID string) {
+	if !ec.forget(taskID) {
+		metafora.Debugf("Cannot release task %s: not claimed.", taskID)
+		return
+	}
+
+	// Use a fresh context as tasks are released during shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	key := ec.ownerKey(taskID)
+	_, err := ec.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.LeaseValue(key), "=", ec.lease)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		metafora.Warnf("Error releasing task %s: %v", taskID, err)
+	}
+}
+
+// Done deletes the task if it's still owned by this node's lease.
+func (ec *EtcdV3Coordinator) Done(taskID string) {
+	if !ec.forget(taskID) {
+		metafora.Debugf("Cannot mark task %s done: not claimed.", taskID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	key := ec.taskKey(taskID)
+	_, err := ec.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.LeaseValue(ec.ownerKey(taskID)), "=", ec.lease)).
+		Then(clientv3.OpDelete(key), clientv3.OpDelete(key+"/", clientv3.WithPrefix())).
+		Commit()
+	if err != nil {
+		metafora.Errorf("Error deleting task %s: %v", taskID, err)
+	}
+}
+
+// Cluster returns a view of the cluster for Balancers.
+func (ec *EtcdV3Coordinator) Cluster() (metafora.ClusterView, error) {
+	e := etcdClusterState{
+		client:   ec.Client,
+		taskPath: ec.taskPath,
+		nodePath: path.Join(ec.namespace, NodesPath),
+	}
+	return e.view(ec.NodeID)
+}
+
+// Command blocks until a command for this node is received from the broker
+// by the coordinator.
+func (ec *EtcdV3Coordinator) Command() (metafora.Command, error) {
+	prefix := ec.commandPath + "/"
+	for {
+		if ec.isClosed() {
+			return nil, nil
+		}
+
+		// Get existing commands
+		resp, err := ec.Client.Get(ec.ctx, prefix, clientv3.WithPrefix(),
+			clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+		if err != nil {
+			if ec.isClosed() {
+				return nil, nil
+			}
+			metafora.Errorf("%s Error getting the existing commands: %v", ec.commandPath, err)
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			if cmd := ec.parseCommand(kv.Key, kv.Value); cmd != nil {
+				return cmd, nil
+			}
+		}
+
+		cmd, err := ec.watchCommands(prefix, resp.Header.Revision+1)
+		if err == rpctypes.ErrCompacted {
+			metafora.Debugf("%s Revision compacted. Restarting watch.", ec.commandPath)
+			continue
+		}
+		return cmd, err
+	}
+}
+
+func (ec *EtcdV3Coordinator) watchCommands(prefix string, rev int64) (metafora.Command, error) {
+	ctx, cancel := context.WithCancel(ec.ctx)
+	defer cancel()
+
+	wch := ec.Client.Watch(clientv3.WithRequireLeader(ctx), prefix,
+		clientv3.WithPrefix(), clientv3.WithRev(rev))
+	for wresp := range wch {
+		if err := wresp.Err(); err != nil {
+			if ec.isClosed() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, ev := range wresp.Events {
+			if ev.Type != clientv3.EventTypePut {
+				continue
+			}
+			if cmd := ec.parseCommand(ev.Kv.Key, ev.Kv.Value); cmd != nil {
+				return cmd, nil
+			}
+		}
+	}
+	if ec.isClosed() {
+		return nil, nil
+	}
+	return nil, ctx.Err()
+}
+
+// parseCommand deletes the command key and unmarshals its value.
+func (ec *EtcdV3Coordinator) parseCommand(key, value []byte) metafora.Command {
+	ctx, cancel := context.WithTimeout(ec.ctx, RequestTimeout)
+	defer cancel()
+	if _, err := ec.Client.Delete(ctx, string(key)); err != nil {
+		metafora.Errorf("Error deleting handled command %s: %v", key, err)
+	}
+
+	cmd, err := metafora.UnmarshalCommand(value)
+	if err != nil {
+		metafora.Errorf("Invalid command %s: %v", key, err)
+		return nil
+	}
+	return cmd
+}
+
+// Close stops the coordinator and causes blocking Watch and Command methods to
+// return zero values. The node's lease is revoked which removes the node key
+// and any claims still held.
+func (ec *EtcdV3Coordinator) Close() {
+	ec.closeL.Lock()
+	if ec.closed {
+		ec.closeL.Unlock()
+		return
+	}
+	ec.closed = true
+	ec.closeL.Unlock()
+
+	ec.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	if _, err := ec.Client.Revoke(ctx, ec.lease); err != nil {
+		if err != rpctypes.ErrLeaseNotFound {
+			metafora.Errorf("Error revoking lease for node %s: %v", ec.NodeID, err)
+		}
+	}
+
+	// Pending commands are lost on shutdown
+	if _, err := ec.Client.Delete(ctx, ec.nodePath+"/", clientv3.WithPrefix()); err != nil {
+		metafora.Errorf("Error deleting node path %s: %v", ec.nodePath, err)
+	}
+}
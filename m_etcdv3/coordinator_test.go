@@ -0,0 +1,221 @@
+package m_etcdv3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lytics/metafora"
+	"github.com/lytics/metafora/internal/coordtest"
+)
+
+// Ensure Watch returns new tasks, claims are exclusive, and released tasks
+// are picked up by other nodes.
+func TestWatchClaimRelease(t *testing.T) {
+	t.Parallel()
+	coord1, client, namespace := setupEtcd(t)
+	coordtest.Init(t, coord1)
+	defer coord1.Close()
+	coord2 := NewEtcdV3Coordinator("node2", namespace, client).(*EtcdV3Coordinator)
+	coordtest.Init(t, coord2)
+	defer coord2.Close()
+
+	mclient := NewClient(namespace, client)
+
+	// Submit a task while watching
+	res := coordtest.Watch(t, coord1)
+	time.Sleep(50 * time.Millisecond)
+	if err := mclient.SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	coordtest.RecvTask(t, res, "task1")
+
+	token1, ok := coord1.FencedClaim("task1")
+	if !ok {
+		t.Fatal("coord1 unable to claim task1")
+	}
+	if coord2.Claim("task1") {
+		t.Fatal("coord2 claimed a task already claimed by coord1")
+	}
+
+	// Claimed tasks shouldn't be returned by Watch
+	res = coordtest.Watch(t, coord2)
+	select {
+	case task := <-res:
+		t.Fatalf("Watch returned claimed task %q", task)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Releasing the task should let coord2 claim it
+	coord1.Release("task1")
+	coordtest.RecvTask(t, res, "task1")
+	token2, ok := coord2.FencedClaim("task1")
+	if !ok {
+		t.Fatal("coord2 unable to claim released task1")
+	}
+	if token2 <= token1 {
+		t.Fatalf("Expected fencing token > %d but received %d", token1, token2)
+	}
+}
+
+// Ensure Done deletes tasks and they're never returned by Watch again.
+func TestDone(t *testing.T) {
+	t.Parallel()
+	coord, client, namespace := setupEtcd(t)
+	coordtest.Init(t, coord)
+	defer coord.Close()
+
+	mclient := NewClient(namespace, client)
+	if err := mclient.SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	coordtest.RecvTask(t, coordtest.Watch(t, coord), "task1")
+	if !coord.Claim("task1") {
+		t.Fatal("Unable to claim task1")
+	}
+
+	res := coordtest.Watch(t, coord)
+	coord.Done("task1")
+	select {
+	case task := <-res:
+		t.Fatalf("Watch returned task %q after it was done", task)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	resp, err := client.Get(context.Background(), coord.taskKey("task1"))
+	if err != nil {
+		t.Fatalf("Error getting task key: %v", err)
+	}
+	if len(resp.Kvs) != 0 {
+		t.Fatalf("Task wasn't deleted: %v", resp.Kvs)
+	}
+	if mclient.SubmitTask("task1") != nil {
+		t.Fatal("Unable to resubmit a done task")
+	}
+}
+
+// Ensure commands are received by their node and deleted.
+func TestCommand(t *testing.T) {
+	t.Parallel()
+	coord, client, namespace := setupEtcd(t)
+	coordtest.Init(t, coord)
+
+	mclient := NewClient(namespace, client)
+	if err := mclient.SubmitCommand(nodeID, metafora.CommandFreeze()); err != nil {
+		t.Fatalf("Error submitting command: %v", err)
+	}
+	cmd, err := coord.Command()
+	if err != nil {
+		t.Fatalf("Error receiving command: %v", err)
+	}
+	if cmd.Name() != metafora.CommandFreeze().Name() {
+		t.Fatalf("Expected freeze command but received: %s", cmd.Name())
+	}
+
+	// Close should cause Command to return nil
+	cmds := make(chan metafora.Command, 1)
+	go func() {
+		cmd, _ := coord.Command()
+		cmds <- cmd
+	}()
+	time.Sleep(50 * time.Millisecond)
+	coord.Close()
+	select {
+	case cmd := <-cmds:
+		if cmd != nil {
+			t.Fatalf("Expected nil command after Close but received: %s", cmd.Name())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Command didn't exit after Close")
+	}
+}
+
+// Ensure claims are lost and the coordinator closes when the node's lease
+// expires.
+func TestLeaseLost(t *testing.T) {
+	t.Parallel()
+	coord, client, namespace := setupEtcd(t)
+	// Keepalives are sent every LeaseTTL/3, so keep it short to notice the
+	// revoked lease quickly
+	coord.LeaseTTL = 2
+	ctx := coordtest.Init(t, coord)
+	defer coord.Close()
+
+	mclient := NewClient(namespace, client)
+	if err := mclient.SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord.Claim("task1") {
+		t.Fatal("Unable to claim task1")
+	}
+
+	// Revoke the lease out from under the coordinator
+	if _, err := client.Revoke(context.Background(), coord.lease); err != nil {
+		t.Fatalf("Error revoking lease: %v", err)
+	}
+
+	select {
+	case task := <-ctx.LostTasks:
+		if task != "task1" {
+			t.Fatalf("Lost unexpected task: %s", task)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Task wasn't lost after lease was revoked")
+	}
+
+	coordtest.RecvTask(t, coordtest.Watch(t, coord), "")
+
+	// Another node should be able to claim the task
+	coord2 := NewEtcdV3Coordinator("node2", namespace, client).(*EtcdV3Coordinator)
+	coordtest.Init(t, coord2)
+	defer coord2.Close()
+	if !coord2.Claim("task1") {
+		t.Fatal("Unable to claim task1 after lease was revoked")
+	}
+}
+
+// Ensure coordinators are notified of nodes joining and leaving.
+func TestNodesChanged(t *testing.T) {
+	t.Parallel()
+	coord, client, namespace := setupEtcd(t)
+	ctx := coordtest.Init(t, coord)
+	defer coord.Close()
+
+	coord2 := NewEtcdV3Coordinator("node2", namespace, client).(*EtcdV3Coordinator)
+	coordtest.Init(t, coord2)
+	select {
+	case <-ctx.Changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not notified of node joining")
+	}
+
+	coord2.Close()
+	select {
+	case <-ctx.Changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not notified of node leaving")
+	}
+}
+
+// Ensure the consumer runs tasks end to end.
+func TestConsumer(t *testing.T) {
+	t.Parallel()
+	coord, client, namespace := setupEtcd(t)
+
+	ran := make(chan string, 1)
+	h := metafora.SimpleHandler(func(task string, stop <-chan bool) bool {
+		ran <- task
+		return true
+	})
+	con, err := metafora.NewConsumer(coord, h, NewFairBalancer(nodeID, namespace, client))
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	go con.Run()
+	defer con.Shutdown()
+
+	if err := NewClient(namespace, client).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	coordtest.RecvTask(t, ran, "task1")
+}
@@ -0,0 +1,90 @@
+package m_etcdv3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+const nodeID = "node1"
+
+// clientURL is the client URL of the embedded etcd server started by TestMain
+var clientURL string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "metafora-etcdv3")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating etcd data dir: %v\n", err)
+		os.Exit(1)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	curl, purl := freeURL(), freeURL()
+	cfg.ListenClientUrls = []url.URL{curl}
+	cfg.AdvertiseClientUrls = []url.URL{curl}
+	cfg.ListenPeerUrls = []url.URL{purl}
+	cfg.AdvertisePeerUrls = []url.URL{purl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting embedded etcd: %v\n", err)
+		os.Exit(1)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		fmt.Fprintln(os.Stderr, "Embedded etcd took too long to start")
+		os.Exit(1)
+	}
+	clientURL = curl.String()
+
+	code := m.Run()
+	e.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// freeURL returns a localhost URL with a port that's free to listen on.
+func freeURL() url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// newEtcdClient creates a new etcd client connected to the embedded server.
+func newEtcdClient(t *testing.T) *clientv3.Client {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to embedded etcd: %v", err)
+	}
+	return client
+}
+
+// setupEtcd creates a client and coordinator in a namespace unique to the
+// test so parallel tests don't interfere. Keys left in the namespace by
+// previous runs of the test are deleted.
+func setupEtcd(t *testing.T) (*EtcdV3Coordinator, *clientv3.Client, string) {
+	client := newEtcdClient(t)
+	namespace := "/metaforatests/" + t.Name()
+	if _, err := client.Delete(context.Background(), namespace+"/", clientv3.WithPrefix()); err != nil {
+		t.Fatalf("Error deleting test namespace: %v", err)
+	}
+	return NewEtcdV3Coordinator(nodeID, namespace, client).(*EtcdV3Coordinator), client, namespace
+}
@@ -0,0 +1,77 @@
+package m_redis
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/lytics/metafora"
+)
+
+// NewFairBalancer creates a new metafora.DefaultFairBalancer that uses Redis
+// for counting tasks per node.
+func NewFairBalancer(nodeid, namespace string, pool *redis.Pool) metafora.Balancer {
+	return metafora.NewDefaultFairBalancer(nodeid, NewClusterState(namespace, pool))
+}
+
+// NewClusterState creates a metafora.ClusterState which counts claimed tasks
+// per live node.
+func NewClusterState(namespace string, pool *redis.Pool) metafora.ClusterState {
+	return &redisClusterState{pool: pool, keys: newKeys(namespace)}
+}
+
+// Checks the current state of a Redis backed cluster
+type redisClusterState struct {
+	pool *redis.Pool
+	keys keys
+}
+
+func (r *redisClusterState) NodeTaskCount() (map[string]int, error) {
+	view, err := r.view("")
+	return view.NodeTasks, err
+}
+
+// view returns a metafora.ClusterView for nodeID.
+func (r *redisClusterState) view(nodeID string) (metafora.ClusterView, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// First initialize state with nodes as keys
+	nodes, err := liveNodes(conn, r.keys)
+	if err != nil {
+		return metafora.ClusterView{}, err
+	}
+	view := metafora.ClusterView{
+		NodeID:    nodeID,
+		Nodes:     nodes,
+		NodeTasks: make(map[string]int, len(nodes)),
+	}
+	for _, node := range nodes {
+		view.NodeTasks[node] = 0
+	}
+
+	// Then count how many tasks each node has
+	tasks, err := redis.Strings(conn.Do("SMEMBERS", r.keys.tasks()))
+	if err != nil {
+		return metafora.ClusterView{}, err
+	}
+	if len(tasks) == 0 {
+		return view, nil
+	}
+	args := make([]interface{}, len(tasks))
+	for i, task := range tasks {
+		args[i] = r.keys.owner(task)
+	}
+	owners, err := redis.Strings(conn.Do("MGET", args...))
+	if err != nil {
+		return metafora.ClusterView{}, err
+	}
+	for _, owner := range owners {
+		if owner == "" {
+			view.Backlog++
+			continue
+		}
+		// Only count live nodes
+		if _, ok := view.NodeTasks[owner]; ok {
+			view.NodeTasks[owner]++
+		}
+	}
+	return view, nil
+}
@@ -0,0 +1,119 @@
+package m_redis
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lytics/metafora"
+)
+
+// NewClient creates a new client using a Redis backend.
+func NewClient(namespace string, pool *redis.Pool) metafora.Client {
+	return &mclient{pool: pool, keys: newKeys(namespace)}
+}
+
+// Type 'mclient' is an internal implementation of metafora.Client with a
+// Redis backend.
+type mclient struct {
+	pool *redis.Pool
+	keys keys
+}
+
+// SubmitTask adds a task to the tasks set and notifies nodes. An error is
+// returned if the task already exists.
+func (mc *mclient) SubmitTask(taskID string) error {
+	conn := mc.pool.Get()
+	defer conn.Close()
+
+	added, err := redis.Int(conn.Do("SADD", mc.keys.tasks(), taskID))
+	if err != nil {
+		return err
+	}
+	if added == 0 {
+		return fmt.Errorf("task %s already exists", taskID)
+	}
+	metafora.Debugf("task submitted [%s]", taskID)
+
+	_, err = conn.Do("PUBLISH", mc.keys.notify(), taskID)
+	return err
+}
+
+// DeleteTask removes a task and its claim.
+func (mc *mclient) DeleteTask(taskID string) error {
+	conn := mc.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SREM", mc.keys.tasks(), taskID); err != nil {
+		return err
+	}
+	_, err := conn.Do("DEL", mc.keys.owner(taskID))
+	metafora.Debugf("task deleted [%s]", taskID)
+	return err
+}
+
+// SubmitCommand appends a command to a node's command list.
+func (mc *mclient) SubmitCommand(node string, command metafora.Command) error {
+	body, err := command.Marshal()
+	if err != nil {
+		// This is either a bug in metafora or someone implemented their own
+		// command incorrectly.
+		return err
+	}
+
+	conn := mc.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("RPUSH", mc.keys.commands(node), body); err != nil {
+		metafora.Errorf("Error submitting command: %s to node: %s", command, node)
+		return err
+	}
+	metafora.Debugf("Submitted command: %s to node: %s", command, node)
+	return nil
+}
+
+// Nodes fetches the currently live nodes.
+func (mc *mclient) Nodes() ([]string, error) {
+	conn := mc.pool.Get()
+	defer conn.Close()
+	return liveNodes(conn, mc.keys)
+}
+
+// liveNodes returns the sorted IDs of registered nodes whose liveness key
+// hasn't expired.
+func liveNodes(conn redis.Conn, k keys) ([]string, error) {
+	nodes, err := redis.Strings(conn.Do("SMEMBERS", k.nodes()))
+	if err != nil || len(nodes) == 0 {
+		return nodes, err
+	}
+	sort.Strings(nodes)
+
+	args := make([]interface{}, len(nodes))
+	for i, node := range nodes {
+		args[i] = k.node(node)
+	}
+	alive, err := redis.Strings(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	live := make([]string, 0, len(nodes))
+	for i, node := range nodes {
+		if alive[i] != "" {
+			live = append(live, node)
+		}
+	}
+	return live, nil
+}
+
+// sameNodes returns true if both sorted lists contain the same nodes.
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package m_redis
+
+import "testing"
+
+// TestSubmitTask tests that the same task ID cannot be submitted twice.
+func TestSubmitTask(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+	mclient := NewClient(namespace, s.Pool())
+
+	if err := mclient.SubmitTask("testid1"); err != nil {
+		t.Fatalf("Submit task failed on initial submission, error: %v", err)
+	}
+	if err := mclient.SubmitTask("testid1"); err == nil {
+		t.Fatal("Submit task did not fail when using existing task id")
+	}
+	if err := mclient.DeleteTask("testid1"); err != nil {
+		t.Fatalf("Error deleting task: %v", err)
+	}
+	if err := mclient.SubmitTask("testid1"); err != nil {
+		t.Fatalf("Submit task failed after deleting task, error: %v", err)
+	}
+}
+
+// TestNodesAndTaskCount tests that only live nodes are listed and counted.
+func TestNodesAndTaskCount(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+	mclient := NewClient(namespace, s.Pool())
+
+	coord1, _ := newCoord(t, s, nodeID)
+	defer coord1.Close()
+	coord2, _ := newCoord(t, s, "node2")
+
+	for _, task := range []string{"t1", "t2", "t3", "t4"} {
+		if err := mclient.SubmitTask(task); err != nil {
+			t.Fatalf("Error submitting task: %v", err)
+		}
+	}
+	coord1.Claim("t1")
+	coord1.Claim("t2")
+	coord2.Claim("t3")
+
+	nodes, err := mclient.Nodes()
+	if err != nil {
+		t.Fatalf("Error listing nodes: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0] != nodeID || nodes[1] != "node2" {
+		t.Fatalf("Unexpected nodes: %v", nodes)
+	}
+
+	counts, err := NewClusterState(namespace, s.Pool()).NodeTaskCount()
+	if err != nil {
+		t.Fatalf("Error counting tasks: %v", err)
+	}
+	if len(counts) != 2 || counts[nodeID] != 2 || counts["node2"] != 1 {
+		t.Fatalf("Unexpected task counts: %v", counts)
+	}
+
+	view, err := coord1.Cluster()
+	if err != nil {
+		t.Fatalf("Error retrieving cluster view: %v", err)
+	}
+	if view.NodeID != nodeID || len(view.Nodes) != 2 || view.NodeTasks["node2"] != 1 || view.Backlog != 1 {
+		t.Fatalf("Unexpected cluster view: %#v", view)
+	}
+
+	coord2.Close()
+	if nodes, _ := mclient.Nodes(); len(nodes) != 1 || nodes[0] != nodeID {
+		t.Fatalf("Unexpected nodes after Close: %v", nodes)
+	}
+}
@@ -0,0 +1,611 @@
+package m_redis
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/gomodule/redigo/redis"
+	"github.com/lytics/metafora"
+)
+
+var (
+	ClaimTTL           = 2 * time.Minute
+	DefaultNodeTTL     = 20 * time.Second
+	DefaultWatchPoll   = 5 * time.Second
+	DefaultCommandPoll = time.Second
+
+	errNodeExists  = errors.New("node already registered")
+	errNodeExpired = errors.New("node key expired")
+)
+
+// Scripts which only modify a task if its claim is still held by this node.
+// Checking the owner with GET before writing would let a claim which expired
+// in between -- and was taken by another node -- be deleted.
+const (
+	// KEYS[1] = owner key, ARGV[1] = node ID
+	releaseSrc = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+	// KEYS[1] = owner key, KEYS[2] = tasks set, ARGV[1] = node ID, ARGV[2] = task ID
+	doneSrc = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SREM", KEYS[2], ARGV[2])
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+	// KEYS[1] = owner key, ARGV[1] = node ID, ARGV[2] = TTL in milliseconds
+	expireSrc = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+)
+
+// claimSrc claims a task and increments the fence counter atomically so a
+// claim can't expire -- and be taken by another node -- before its token is
+// assigned. Returns -1 if the task doesn't exist, 0 if it's already claimed,
+// or the claim's token.
+//
+// KEYS[1] = tasks set, KEYS[2] = owner key, KEYS[3] = fence counter,
+// ARGV[1] = task ID, ARGV[2] = node ID, ARGV[3] = claim TTL in milliseconds
+const claimSrc = `if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 0 then
+	return -1
+end
+if not redis.call("SET", KEYS[2], ARGV[2], "NX", "PX", ARGV[3]) then
+	return 0
+end
+return redis.call("INCR", KEYS[3])`
+
+var (
+	releaseScript = redis.NewScript(1, releaseSrc)
+	doneScript    = redis.NewScript(2, doneSrc)
+	claimScript   = redis.NewScript(3, claimSrc)
+	expireScript  = redis.NewScript(1, expireSrc)
+)
+
+// RedisCoordinator is a Metafora Coordinator using Redis as the broker.
+//
+// Claims are made with SET NX PX and refreshed in batches by a single
+// goroutine per node. New and released tasks are announced over pub/sub, but
+// since expired claims aren't announced Watch also polls for unclaimed tasks.
+type RedisCoordinator struct {
+	Pool    *redis.Pool
+	cordCtx metafora.CoordinatorContext
+	keys    keys
+
+	NodeID string
+
+	// ClaimTTL, NodeTTL, and WatchPoll must be set before Init is called.
+	ClaimTTL  time.Duration
+	NodeTTL   time.Duration
+	WatchPoll time.Duration
+
+	// claimed tasks and those whose claims aren't refreshed as they're hung
+	tasks map[string]bool
+	hung  map[string]bool
+	taskL sync.Mutex
+
+	// live nodes as of the last refresh; only used by the refresher
+	nodes []string
+
+	// notify is ticked by the subscriber when tasks are submitted or released
+	notify chan struct{}
+	sub    redis.PubSubConn
+
+	// Close() closes stop channel to signal to goroutines to exit
+	stop  chan bool
+	stopL sync.Mutex
+	wg    sync.WaitGroup
+}
+
+// NewRedisCoordinator creates a new Metafora Coordinator implementation using
+// Redis as the broker. If no node ID is specified, a unique one will be
+// generated.
+//
+// Coordinator methods will be called by the core Metafora Consumer. Calling
+// Init, Close, etc. from your own code will lead to undefined behavior.
+func NewRedisCoordinator(nodeID, namespace string, pool *redis.Pool) metafora.Coordinator {
+	if nodeID == "" {
+		hn, _ := os.Hostname()
+		nodeID = hn + "-" + uuid.NewRandom().String()
+	}
+
+	return &RedisCoordinator{
+		Pool:      pool,
+		keys:      newKeys(namespace),
+		NodeID:    strings.Trim(nodeID, ": "),
+		ClaimTTL:  ClaimTTL,
+		NodeTTL:   DefaultNodeTTL,
+		WatchPoll: DefaultWatchPoll,
+		tasks:     make(map[string]bool),
+		hung:      make(map[string]bool),
+		notify:    make(chan struct{}, 1),
+		stop:      make(chan bool),
+	}
+}
+
+func (rc *RedisCoordinator) closed() bool {
+	select {
+	case <-rc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func ms(d time.Duration) int64 { return int64(d / time.Millisecond) }
+
+// Init registers the node, subscribes to task notifications, and starts the
+// refresher.
+func (rc *RedisCoordinator) Init(cordCtx metafora.CoordinatorContext) error {
+	metafora.Debugf("Initializing coordinator with namespace: %s", rc.keys.ns)
+	rc.cordCtx = cordCtx
+
+	conn := rc.Pool.Get()
+	defer conn.Close()
+	ok, err := redis.String(conn.Do("SET", rc.keys.node(rc.NodeID), rc.NodeID, "NX", "PX", ms(rc.NodeTTL)))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if ok != "OK" {
+		return errNodeExists
+	}
+	if _, err := conn.Do("SADD", rc.keys.nodes(), rc.NodeID); err != nil {
+		return err
+	}
+	if rc.nodes, err = liveNodes(conn, rc.keys); err != nil {
+		return err
+	}
+
+	// Subscribe before Watch is called so no notifications are missed
+	rc.sub = redis.PubSubConn{Conn: rc.Pool.Get()}
+	if err := rc.sub.Subscribe(rc.keys.notify()); err != nil {
+		rc.sub.Close()
+		return err
+	}
+
+	rc.wg.Add(2)
+	go rc.subscriber()
+	go rc.refresher()
+	return nil
+}
+
+// subscriber ticks the notify chan whenever a task is submitted or released.
+func (rc *RedisCoordinator) subscriber() {
+	defer rc.wg.Done()
+	for {
+		switch v := rc.sub.Receive().(type) {
+		case redis.Message:
+			select {
+			case rc.notify <- struct{}{}:
+			default:
+				// Watch hasn't handled the last notification yet
+			}
+		case redis.Subscription:
+			if v.Kind == "unsubscribe" && v.Count == 0 {
+				// Close() unsubscribed
+				return
+			}
+		case error:
+			if rc.closed() {
+				return
+			}
+			// Watch falls back to polling until Close is called
+			metafora.Errorf("Error receiving task notifications: %v", v)
+			return
+		}
+	}
+}
+
+// refresher keeps the node key and all claims alive with one batch of
+// requests per interval. If it's unable to communicate with Redis before the
+// node key expires it must shutdown the coordinator.
+func (rc *RedisCoordinator) refresher() {
+	defer rc.wg.Done()
+
+	ttl := rc.NodeTTL
+	if rc.ClaimTTL < ttl {
+		ttl = rc.ClaimTTL
+	}
+	interval := ttl >> 1 // have some leeway before ttl expires
+	for {
+		// Deadline for refreshes to finish by or the coordinator closes.
+		deadline := time.Now().Add(ttl)
+		select {
+		case <-rc.stop:
+			return
+		case <-time.After(interval):
+			if err := rc.refreshBy(deadline); err != nil {
+				// We're in a bad state; shut everything down
+				metafora.Errorf("Unable to refresh node key before deadline %s. Last error: %v", deadline, err)
+				go rc.Close()
+				return
+			}
+			rc.checkNodes()
+		}
+	}
+}
+
+// checkNodes notifies the Consumer if nodes joined or left since the last
+// refresh. Node keys expire without notification, so membership is polled.
+func (rc *RedisCoordinator) checkNodes() {
+	conn := rc.Pool.Get()
+	defer conn.Close()
+	nodes, err := liveNodes(conn, rc.keys)
+	if err != nil {
+		metafora.Warnf("Error checking nodes: %v", err)
+		return
+	}
+	if !sameNodes(rc.nodes, nodes) {
+		metafora.Infof("Nodes changed from %v to %v", rc.nodes, nodes)
+		rc.cordCtx.NodesChanged()
+	}
+	rc.nodes = nodes
+}
+
+// refreshBy retries refreshing until the deadline is reached.
+func (rc *RedisCoordinator) refreshBy(deadline time.Time) (err error) {
+	for time.Now().Before(deadline) {
+		// Make sure we shouldn't exit
+		if rc.closed() {
+			return err
+		}
+
+		if err = rc.refresh(); err == nil {
+			// It worked!
+			return nil
+		}
+		metafora.Warnf("Unexpected error refreshing node and claims: %v", err)
+		time.Sleep(500 * time.Millisecond) // rate limit retries a bit
+	}
+	// Didn't get a successful response before deadline, exit with error
+	return err
+}
+
+// refresh bumps the node key's TTL and the TTL of every claim still owned by
+// this node except those of hung tasks. Claims owned by other nodes are lost.
+func (rc *RedisCoordinator) refresh() error {
+	conn := rc.Pool.Get()
+	defer conn.Close()
+
+	ok, err := redis.String(conn.Do("SET", rc.keys.node(rc.NodeID), rc.NodeID, "XX", "PX", ms(rc.NodeTTL)))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if ok != "OK" {
+		// Node key expired; other nodes may have claimed our tasks
+		rc.loseAll()
+		return errNodeExpired
+	}
+
+	tasks := rc.claimed()
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, len(tasks))
+	for i, task := range tasks {
+		args[i] = rc.keys.owner(task)
+	}
+	owners, err := redis.Strings(conn.Do("MGET", args...))
+	if err != nil {
+		return err
+	}
+
+	refreshed := 0
+	for i, task := range tasks {
+		if rc.isHung(task) {
+			// Let the claim expire so other nodes may claim the task
+			continue
+		}
+		if owners[i] != rc.NodeID {
+			metafora.Errorf("Claim for task %s lost to %q", task, owners[i])
+			if rc.forget(task) {
+				rc.cordCtx.Lost(task)
+			}
+			continue
+		}
+		// There's a small window where the claim expires and is claimed by
+		// another node between the MGET and PEXPIRE. The only harm is the
+		// other node's claim is refreshed and we lose the task on the next
+		// refresh.
+		if err := conn.Send("PEXPIRE", rc.keys.owner(task), ms(rc.ClaimTTL)); err != nil {
+			return err
+		}
+		refreshed++
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < refreshed; i++ {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimed returns a sorted list of tasks claimed by this coordinator.
+func (rc *RedisCoordinator) claimed() []string {
+	rc.taskL.Lock()
+	defer rc.taskL.Unlock()
+	tasks := make([]string, 0, len(rc.tasks))
+	for task := range rc.tasks {
+		tasks = append(tasks, task)
+	}
+	sort.Strings(tasks)
+	return tasks
+}
+
+// forget removes a task from the claimed set and returns true if it was
+// present.
+func (rc *RedisCoordinator) forget(taskID string) bool {
+	rc.taskL.Lock()
+	defer rc.taskL.Unlock()
+	if !rc.tasks[taskID] {
+		return false
+	}
+	delete(rc.tasks, taskID)
+	delete(rc.hung, taskID)
+	return true
+}
+
+// Hung stops refreshing the claim of a task whose handler is hung and
+// shortens it to expire within metafora.HungGrace, before the Consumer
+// abandons the task, if ClaimTTL is longer.
+func (rc *RedisCoordinator) Hung(taskID string) {
+	rc.taskL.Lock()
+	claimed := rc.tasks[taskID]
+	if claimed {
+		rc.hung[taskID] = true
+	}
+	rc.taskL.Unlock()
+	if !claimed {
+		return
+	}
+	metafora.Warnf("No longer refreshing claim of hung task %s", taskID)
+
+	ttl := rc.ClaimTTL
+	if metafora.HungGrace < ttl {
+		ttl = metafora.HungGrace
+	}
+	conn := rc.Pool.Get()
+	defer conn.Close()
+	key := rc.keys.owner(taskID)
+	if _, err := expireScript.Do(conn, key, rc.NodeID, ms(ttl)); err != nil {
+		metafora.Errorf("Error expiring claim %s of hung task: %v", key, err)
+	}
+}
+
+// isHung returns true if the task's claim is no longer refreshed.
+func (rc *RedisCoordinator) isHung(taskID string) bool {
+	rc.taskL.Lock()
+	defer rc.taskL.Unlock()
+	return rc.hung[taskID]
+}
+
+// loseAll calls Lost for every claimed task.
+func (rc *RedisCoordinator) loseAll() {
+	for _, task := range rc.claimed() {
+		if rc.forget(task) {
+			rc.cordCtx.Lost(task)
+		}
+	}
+}
+
+// Watch returns the first unclaimed task or blocks until a task is
+// submitted, released, or a claim expires.
+//
+// Watch will return ("", nil) if the coordinator is closed.
+func (rc *RedisCoordinator) Watch() (taskID string, err error) {
+	for {
+		if rc.closed() {
+			return "", nil
+		}
+
+		task, err := rc.unclaimed()
+		if err != nil {
+			metafora.Errorf("%s Error getting the existing tasks: %v", rc.keys.tasks(), err)
+			return "", err
+		}
+		if task != "" {
+			return task, nil
+		}
+
+		select {
+		case <-rc.stop:
+			return "", nil
+		case <-rc.notify:
+		case <-time.After(rc.WatchPoll):
+		}
+	}
+}
+
+// unclaimed returns the first unclaimed task in lexicographic order or an
+// empty string if all tasks are claimed.
+func (rc *RedisCoordinator) unclaimed() (string, error) {
+	conn := rc.Pool.Get()
+	defer conn.Close()
+
+	tasks, err := redis.Strings(conn.Do("SMEMBERS", rc.keys.tasks()))
+	if err != nil || len(tasks) == 0 {
+		return "", err
+	}
+	sort.Strings(tasks)
+
+	args := make([]interface{}, len(tasks))
+	for i, task := range tasks {
+		args[i] = rc.keys.owner(task)
+	}
+	owners, err := redis.Strings(conn.Do("MGET", args...))
+	if err != nil {
+		return "", err
+	}
+	for i, task := range tasks {
+		if owners[i] == "" {
+			return task, nil
+		}
+	}
+	return "", nil
+}
+
+// Claim is called by the Consumer when a Balancer has determined that a task
+// ID can be claimed. Claim returns false if another consumer has already
+// claimed the ID or the task doesn't exist.
+func (rc *RedisCoordinator) Claim(taskID string) bool {
+	_, ok := rc.FencedClaim(taskID)
+	return ok
+}
+
+// FencedClaim claims a task like Claim and returns the namespace's fence
+// counter -- incremented in the same script as the claim is acquired -- as its
+// token.
+func (rc *RedisCoordinator) FencedClaim(taskID string) (uint64, bool) {
+	conn := rc.Pool.Get()
+	defer conn.Close()
+
+	key := rc.keys.owner(taskID)
+	token, err := redis.Int64(claimScript.Do(conn, rc.keys.tasks(), key, rc.keys.fence(), taskID, rc.NodeID, ms(rc.ClaimTTL)))
+	if err != nil {
+		metafora.Errorf("Claim of %s failed with an unexpected error: %v", key, err)
+		return 0, false
+	}
+	switch token {
+	case -1:
+		metafora.Debugf("Claim of %s failed, task doesn't exist", taskID)
+		return 0, false
+	case 0:
+		metafora.Debugf("Claim of %s failed, already claimed", key)
+		return 0, false
+	}
+
+	metafora.Debugf("Claim successful: %s", key)
+	rc.taskL.Lock()
+	rc.tasks[taskID] = true
+	rc.taskL.Unlock()
+	return uint64(token), true
+}
+
+// Cluster returns a view of the cluster for Balancers.
+func (rc *RedisCoordinator) Cluster() (metafora.ClusterView, error) {
+	cs := redisClusterState{pool: rc.Pool, keys: rc.keys}
+	return cs.view(rc.NodeID)
+}
+
+// Release deletes the claim and notifies other nodes.
+func (rc *RedisCoordinator) Release(taskID string) {
+	if !rc.forget(taskID) {
+		metafora.Debugf("Cannot release task %s: not claimed.", taskID)
+		return
+	}
+
+	conn := rc.Pool.Get()
+	defer conn.Close()
+
+	key := rc.keys.owner(taskID)
+	n, err := redis.Int(releaseScript.Do(conn, key, rc.NodeID))
+	if err != nil {
+		metafora.Warnf("Error releasing task %s: %v", taskID, err)
+		return
+	}
+	if n == 0 {
+		metafora.Warnf("Not releasing task %s: no longer claimed by this node", taskID)
+		return
+	}
+	if _, err := conn.Do("PUBLISH", rc.keys.notify(), taskID); err != nil {
+		metafora.Warnf("Error notifying nodes of released task %s: %v", taskID, err)
+	}
+}
+
+// Done deletes the task if this node still holds its claim.
+func (rc *RedisCoordinator) Done(taskID string) {
+	if !rc.forget(taskID) {
+		metafora.Debugf("Cannot mark task %s done: not claimed.", taskID)
+		return
+	}
+
+	conn := rc.Pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(doneScript.Do(conn, rc.keys.owner(taskID), rc.keys.tasks(), rc.NodeID, taskID))
+	if err != nil {
+		metafora.Errorf("Error deleting task %s: %v", taskID, err)
+		return
+	}
+	if n == 0 {
+		metafora.Warnf("Not deleting task %s: no longer claimed by this node", taskID)
+	}
+}
+
+// Command blocks until a command for this node is received from the broker
+// by the coordinator.
+func (rc *RedisCoordinator) Command() (metafora.Command, error) {
+	conn := rc.Pool.Get()
+	defer conn.Close()
+
+	key := rc.keys.commands(rc.NodeID)
+	timeout := int64(DefaultCommandPoll / time.Second)
+	if timeout < 1 {
+		timeout = 1
+	}
+	for {
+		if rc.closed() {
+			return nil, nil
+		}
+
+		// Block for a short period so Close is noticed
+		reply, err := redis.Strings(conn.Do("BLPOP", key, timeout))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			if rc.closed() {
+				return nil, nil
+			}
+			metafora.Errorf("%s Error getting commands: %v", key, err)
+			return nil, err
+		}
+
+		cmd, err := metafora.UnmarshalCommand([]byte(reply[1]))
+		if err != nil {
+			metafora.Errorf("Invalid command %s: %v", reply[1], err)
+			continue
+		}
+		return cmd, nil
+	}
+}
+
+// Close stops the coordinator and causes blocking Watch and Command methods to
+// return zero values.
+func (rc *RedisCoordinator) Close() {
+	rc.stopL.Lock()
+	defer rc.stopL.Unlock()
+	if rc.closed() {
+		return
+	}
+	close(rc.stop)
+
+	// Unsubscribing causes the subscriber to exit
+	if err := rc.sub.Unsubscribe(); err != nil {
+		metafora.Warnf("Error unsubscribing from task notifications: %v", err)
+	}
+	rc.wg.Wait()
+	rc.sub.Close()
+
+	conn := rc.Pool.Get()
+	defer conn.Close()
+
+	// Finally remove the node entry; pending commands are lost on shutdown
+	if _, err := conn.Do("DEL", rc.keys.node(rc.NodeID), rc.keys.commands(rc.NodeID)); err != nil {
+		metafora.Errorf("Error deleting node key %s: %v", rc.keys.node(rc.NodeID), err)
+	}
+	if _, err := conn.Do("SREM", rc.keys.nodes(), rc.NodeID); err != nil {
+		metafora.Errorf("Error removing node %s: %v", rc.NodeID, err)
+	}
+}
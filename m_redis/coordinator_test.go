@@ -0,0 +1,321 @@
+package m_redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lytics/metafora"
+	"github.com/lytics/metafora/internal/coordtest"
+)
+
+const (
+	namespace = "metaforatests"
+	nodeID    = "node1"
+)
+
+// newCoord creates and initializes a coordinator with short TTLs.
+func newCoord(t *testing.T, s *fakeRedis, node string) (*RedisCoordinator, *coordtest.Ctx) {
+	c := NewRedisCoordinator(node, namespace, s.Pool()).(*RedisCoordinator)
+	c.ClaimTTL = time.Second
+	c.NodeTTL = time.Second
+	c.WatchPoll = 100 * time.Millisecond
+	return c, coordtest.Init(t, c)
+}
+
+// Ensure Watch returns new tasks, claims are exclusive, and released tasks
+// are picked up by other nodes.
+func TestWatchClaimRelease(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+
+	coord1, _ := newCoord(t, s, nodeID)
+	defer coord1.Close()
+	coord2, _ := newCoord(t, s, "node2")
+	defer coord2.Close()
+
+	// Ensure notifications are delivered instead of relying on polling
+	coord1.WatchPoll = time.Hour
+	coord2.WatchPoll = time.Hour
+
+	res := coordtest.Watch(t, coord1)
+	time.Sleep(50 * time.Millisecond)
+	if err := NewClient(namespace, s.Pool()).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	coordtest.RecvTask(t, res, "task1")
+
+	token1, ok := coord1.FencedClaim("task1")
+	if !ok {
+		t.Fatal("coord1 unable to claim task1")
+	}
+	if coord2.Claim("task1") {
+		t.Fatal("coord2 claimed a task already claimed by coord1")
+	}
+
+	res = coordtest.Watch(t, coord2)
+	select {
+	case task := <-res:
+		t.Fatalf("Watch returned claimed task %q", task)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	coord1.Release("task1")
+	coordtest.RecvTask(t, res, "task1")
+	token2, ok := coord2.FencedClaim("task1")
+	if !ok {
+		t.Fatal("coord2 unable to claim released task1")
+	}
+	if token2 <= token1 {
+		t.Fatalf("Expected fencing token > %d but received %d", token1, token2)
+	}
+}
+
+// Ensure claims are kept alive past their TTL and released on Done.
+func TestRefreshAndDone(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+
+	coord1, ctx := newCoord(t, s, nodeID)
+	defer coord1.Close()
+	coord2, _ := newCoord(t, s, "node2")
+	defer coord2.Close()
+
+	if err := NewClient(namespace, s.Pool()).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord1.Claim("task1") {
+		t.Fatal("Unable to claim task1")
+	}
+
+	time.Sleep(2 * coord1.ClaimTTL)
+	if coord2.Claim("task1") {
+		t.Fatal("Claim expired despite being refreshed")
+	}
+	if len(ctx.LostTasks) > 0 {
+		t.Fatalf("Unexpectedly lost task %s", <-ctx.LostTasks)
+	}
+
+	coord1.Done("task1")
+	if coord2.Claim("task1") {
+		t.Fatal("Claimed a done task")
+	}
+}
+
+// Ensure claims of hung tasks aren't refreshed.
+func TestHung(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+
+	coord1, ctx := newCoord(t, s, nodeID)
+	defer coord1.Close()
+	coord2, _ := newCoord(t, s, "node2")
+	defer coord2.Close()
+
+	if err := NewClient(namespace, s.Pool()).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord1.Claim("task1") {
+		t.Fatal("Unable to claim task1")
+	}
+	coord1.Hung("task1")
+
+	time.Sleep(2 * coord1.ClaimTTL)
+	if !coord2.Claim("task1") {
+		t.Fatal("Claim of hung task was refreshed")
+	}
+	if len(ctx.LostTasks) > 0 {
+		t.Fatalf("Unexpectedly lost task %s", <-ctx.LostTasks)
+	}
+
+	// Releasing the abandoned task mustn't release the new owner's claim
+	coord1.Release("task1")
+	if coord1.Claim("task1") {
+		t.Fatal("Released another node's claim")
+	}
+}
+
+// Ensure claims of hung tasks expire within HungGrace when ClaimTTL is
+// longer.
+func TestHungExpiresClaim(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+
+	coord := NewRedisCoordinator(nodeID, namespace, s.Pool()).(*RedisCoordinator)
+	coord.ClaimTTL = time.Hour
+	coord.NodeTTL = time.Second
+	coordtest.Init(t, coord)
+	defer coord.Close()
+
+	if err := NewClient(namespace, s.Pool()).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord.Claim("task1") {
+		t.Fatal("Unable to claim task1")
+	}
+	coord.Hung("task1")
+
+	s.mu.Lock()
+	expires := s.expires[coord.keys.owner("task1")]
+	s.mu.Unlock()
+	if limit := time.Now().Add(metafora.HungGrace); expires.After(limit) {
+		t.Fatalf("Expected hung claim to expire by %s but expires at %s", limit, expires)
+	}
+}
+
+// Ensure Done doesn't delete a task claimed by another node.
+func TestDoneNotOwner(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+
+	coord1, _ := newCoord(t, s, nodeID)
+	defer coord1.Close()
+	coord2, _ := newCoord(t, s, "node2")
+	defer coord2.Close()
+
+	if err := NewClient(namespace, s.Pool()).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord1.Claim("task1") {
+		t.Fatal("Unable to claim task1")
+	}
+	coord1.Hung("task1")
+
+	time.Sleep(2 * coord1.ClaimTTL)
+	if !coord2.Claim("task1") {
+		t.Fatal("Claim of hung task was refreshed")
+	}
+
+	coord1.Done("task1")
+	conn := s.Pool().Get()
+	defer conn.Close()
+	owner, _ := redis.String(conn.Do("GET", coord1.keys.owner("task1")))
+	if owner != "node2" {
+		t.Fatalf("Expected task1 to be owned by node2 but found %q", owner)
+	}
+	if exists, _ := redis.Bool(conn.Do("SISMEMBER", coord1.keys.tasks(), "task1")); !exists {
+		t.Fatal("Done deleted another node's task")
+	}
+}
+
+// Ensure stolen claims are lost.
+func TestLost(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+
+	coord, ctx := newCoord(t, s, nodeID)
+	defer coord.Close()
+
+	if err := NewClient(namespace, s.Pool()).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	if !coord.Claim("task1") {
+		t.Fatal("Unable to claim task1")
+	}
+
+	conn := s.Pool().Get()
+	defer conn.Close()
+	if _, err := conn.Do("SET", coord.keys.owner("task1"), "thief"); err != nil {
+		t.Fatalf("Error stealing claim: %v", err)
+	}
+
+	select {
+	case task := <-ctx.LostTasks:
+		if task != "task1" {
+			t.Fatalf("Lost unexpected task: %s", task)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Stolen task wasn't lost")
+	}
+}
+
+// Ensure the Consumer is notified when nodes join or leave.
+func TestNodesChanged(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+
+	coord1, ctx := newCoord(t, s, "node1")
+	defer coord1.Close()
+
+	coord2, _ := newCoord(t, s, "node2")
+	select {
+	case <-ctx.Changes:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Node joining wasn't noticed")
+	}
+
+	coord2.Close()
+	select {
+	case <-ctx.Changes:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Node leaving wasn't noticed")
+	}
+}
+
+// Ensure commands are received by their node and Command exits on Close.
+func TestCommand(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+
+	coord, _ := newCoord(t, s, nodeID)
+
+	if err := NewClient(namespace, s.Pool()).SubmitCommand(nodeID, metafora.CommandFreeze()); err != nil {
+		t.Fatalf("Error submitting command: %v", err)
+	}
+	cmd, err := coord.Command()
+	if err != nil {
+		t.Fatalf("Error receiving command: %v", err)
+	}
+	if cmd.Name() != metafora.CommandFreeze().Name() {
+		t.Fatalf("Expected freeze command but received: %s", cmd.Name())
+	}
+
+	cmds := make(chan metafora.Command, 1)
+	go func() {
+		cmd, _ := coord.Command()
+		cmds <- cmd
+	}()
+	coord.Close()
+	select {
+	case cmd := <-cmds:
+		if cmd != nil {
+			t.Fatalf("Expected nil command after Close but received: %s", cmd.Name())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Command didn't exit after Close")
+	}
+	coordtest.RecvTask(t, coordtest.Watch(t, coord), "")
+}
+
+// Ensure the consumer runs tasks end to end.
+func TestConsumer(t *testing.T) {
+	t.Parallel()
+	s := newFakeRedis(t)
+	defer s.Close()
+
+	ran := make(chan string, 1)
+	h := metafora.SimpleHandler(func(task string, stop <-chan bool) bool {
+		ran <- task
+		return true
+	})
+	coord := NewRedisCoordinator(nodeID, namespace, s.Pool())
+	con, err := metafora.NewConsumer(coord, h, NewFairBalancer(nodeID, namespace, s.Pool()))
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	go con.Run()
+	defer con.Shutdown()
+
+	if err := NewClient(namespace, s.Pool()).SubmitTask("task1"); err != nil {
+		t.Fatalf("Error submitting task: %v", err)
+	}
+	coordtest.RecvTask(t, ran, "task1")
+}
@@ -0,0 +1,28 @@
+package m_redis
+
+import "strings"
+
+// keys builds the Redis keys used by Metafora for a namespace:
+//
+//	<ns>:tasks                  Set of task IDs
+//	<ns>:tasks:notify           Pub/sub channel of new and released task IDs
+//	<ns>:task:<id>:owner        Claim; node ID set with NX and PX
+//	<ns>:fence                  Counter incremented on every claim
+//	<ns>:nodes                  Set of registered node IDs
+//	<ns>:node:<id>              Node liveness key; set with PX
+//	<ns>:node:<id>:commands     List of pending commands
+type keys struct {
+	ns string
+}
+
+func newKeys(namespace string) keys {
+	return keys{ns: strings.Trim(namespace, ": ")}
+}
+
+func (k keys) tasks() string                 { return k.ns + ":tasks" }
+func (k keys) notify() string                { return k.ns + ":tasks:notify" }
+func (k keys) owner(taskID string) string    { return k.ns + ":task:" + taskID + ":owner" }
+func (k keys) fence() string                 { return k.ns + ":fence" }
+func (k keys) nodes() string                 { return k.ns + ":nodes" }
+func (k keys) node(nodeID string) string     { return k.ns + ":node:" + nodeID }
+func (k keys) commands(nodeID string) string { return k.node(nodeID) + ":commands" }
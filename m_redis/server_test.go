@@ -0,0 +1,456 @@
+package m_redis
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeRedis is an in-process stand-in for Redis which implements just enough
+// of the protocol and commands for the coordinator, client, and cluster state
+// to be tested.
+type fakeRedis struct {
+	l net.Listener
+
+	mu      sync.Mutex
+	strs    map[string]string
+	expires map[string]time.Time
+	sets    map[string]map[string]bool
+	lists   map[string][]string
+	subs    map[string]map[*fakeConn]bool
+}
+
+type fakeConn struct {
+	mu sync.Mutex // serializes writes from publishers and the conn's reader
+	w  *bufio.Writer
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake redis: %v", err)
+	}
+	s := &fakeRedis{
+		l:       l,
+		strs:    map[string]string{},
+		expires: map[string]time.Time{},
+		sets:    map[string]map[string]bool{},
+		lists:   map[string][]string{},
+		subs:    map[string]map[*fakeConn]bool{},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedis) Close() { s.l.Close() }
+
+// Pool returns a redigo pool connected to the fake server.
+func (s *fakeRedis) Pool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle: 10,
+		Dial:    func() (redis.Conn, error) { return redis.Dial("tcp", s.l.Addr().String()) },
+	}
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *fakeRedis) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	fc := &fakeConn{w: bufio.NewWriter(c)}
+	defer s.unsubscribe(fc, nil)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		reply := s.exec(fc, args)
+		fc.mu.Lock()
+		writeReply(fc.w, reply)
+		fc.w.Flush()
+		fc.mu.Unlock()
+	}
+}
+
+// multiReply is written as consecutive replies rather than an array
+type multiReply []interface{}
+
+// status is written as a simple string reply
+type status string
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimRight(line, "\r\n")[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case error:
+		fmt.Fprintf(w, "-ERR %s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		if v == nil {
+			w.WriteString("*-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	case multiReply:
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	default:
+		panic(fmt.Sprintf("unknown reply type %T", reply))
+	}
+}
+
+// expire lazily removes an expired key. Must be called with mu held.
+func (s *fakeRedis) expire(key string) {
+	if exp, ok := s.expires[key]; ok && !time.Now().Before(exp) {
+		delete(s.strs, key)
+		delete(s.expires, key)
+	}
+}
+
+func (s *fakeRedis) get(key string) interface{} {
+	s.expire(key)
+	if v, ok := s.strs[key]; ok {
+		return v
+	}
+	return nil
+}
+
+func (s *fakeRedis) exec(fc *fakeConn, args []string) interface{} {
+	if len(args) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	cmd, args := strings.ToUpper(args[0]), args[1:]
+
+	// Pub/sub commands manage their own locking
+	switch cmd {
+	case "SUBSCRIBE":
+		return s.subscribe(fc, args)
+	case "UNSUBSCRIBE":
+		return s.unsubscribe(fc, args)
+	case "PUNSUBSCRIBE":
+		return []interface{}{"punsubscribe", nil, 0}
+	case "PUBLISH":
+		return s.publish(args[0], args[1])
+	case "BLPOP":
+		return s.blpop(args)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd {
+	case "PING":
+		return status("PONG")
+	case "ECHO":
+		return args[0]
+	case "GET":
+		return s.get(args[0])
+	case "MGET":
+		vals := make([]interface{}, len(args))
+		for i, key := range args {
+			vals[i] = s.get(key)
+		}
+		return vals
+	case "SET":
+		key, val := args[0], args[1]
+		var nx, xx bool
+		var px time.Duration
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			case "PX":
+				i++
+				n, _ := strconv.Atoi(args[i])
+				px = time.Duration(n) * time.Millisecond
+			}
+		}
+		exists := s.get(key) != nil
+		if (nx && exists) || (xx && !exists) {
+			return nil
+		}
+		s.strs[key] = val
+		delete(s.expires, key)
+		if px > 0 {
+			s.expires[key] = time.Now().Add(px)
+		}
+		return status("OK")
+	case "PEXPIRE":
+		if s.get(args[0]) == nil {
+			return 0
+		}
+		n, _ := strconv.Atoi(args[1])
+		s.expires[args[0]] = time.Now().Add(time.Duration(n) * time.Millisecond)
+		return 1
+	case "INCR":
+		n, _ := strconv.Atoi(fmt.Sprint(s.get(args[0])))
+		n++
+		s.strs[args[0]] = strconv.Itoa(n)
+		return n
+	case "EXISTS":
+		n := 0
+		for _, key := range args {
+			if s.get(key) != nil || s.sets[key] != nil || s.lists[key] != nil {
+				n++
+			}
+		}
+		return n
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if s.get(key) != nil || s.sets[key] != nil || s.lists[key] != nil {
+				n++
+			}
+			delete(s.strs, key)
+			delete(s.expires, key)
+			delete(s.sets, key)
+			delete(s.lists, key)
+		}
+		return n
+	case "SADD":
+		set := s.sets[args[0]]
+		if set == nil {
+			set = map[string]bool{}
+			s.sets[args[0]] = set
+		}
+		n := 0
+		for _, m := range args[1:] {
+			if !set[m] {
+				set[m] = true
+				n++
+			}
+		}
+		return n
+	case "SREM":
+		set := s.sets[args[0]]
+		n := 0
+		for _, m := range args[1:] {
+			if set[m] {
+				delete(set, m)
+				n++
+			}
+		}
+		if set != nil && len(set) == 0 {
+			delete(s.sets, args[0])
+		}
+		return n
+	case "SISMEMBER":
+		if s.sets[args[0]][args[1]] {
+			return 1
+		}
+		return 0
+	case "SMEMBERS":
+		members := []interface{}{}
+		for m := range s.sets[args[0]] {
+			members = append(members, m)
+		}
+		return members
+	case "RPUSH":
+		s.lists[args[0]] = append(s.lists[args[0]], args[1:]...)
+		return len(s.lists[args[0]])
+	case "EVAL", "EVALSHA":
+		return s.eval(cmd == "EVALSHA", args)
+	}
+	return fmt.Errorf("unknown command '%s'", cmd)
+}
+
+// eval runs the Go equivalent of one of the coordinator's scripts. Must be
+// called with mu held.
+func (s *fakeRedis) eval(sha bool, args []string) interface{} {
+	src := args[0]
+	if sha {
+		for _, known := range []string{releaseSrc, doneSrc, claimSrc, expireSrc} {
+			if fmt.Sprintf("%x", sha1.Sum([]byte(known))) == src {
+				src = known
+			}
+		}
+	}
+	n, _ := strconv.Atoi(args[1])
+	keys, argv := args[2:2+n], args[2+n:]
+	switch src {
+	case releaseSrc:
+		if s.get(keys[0]) != argv[0] {
+			return 0
+		}
+		delete(s.strs, keys[0])
+		delete(s.expires, keys[0])
+		return 1
+	case doneSrc:
+		if s.get(keys[0]) != argv[0] {
+			return 0
+		}
+		delete(s.sets[keys[1]], argv[1])
+		delete(s.strs, keys[0])
+		delete(s.expires, keys[0])
+		return 1
+	case expireSrc:
+		if s.get(keys[0]) != argv[0] {
+			return 0
+		}
+		ttl, _ := strconv.Atoi(argv[1])
+		s.expires[keys[0]] = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		return 1
+	case claimSrc:
+		if !s.sets[keys[0]][argv[0]] {
+			return -1
+		}
+		if s.get(keys[1]) != nil {
+			return 0
+		}
+		ttl, _ := strconv.Atoi(argv[2])
+		s.strs[keys[1]] = argv[1]
+		s.expires[keys[1]] = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		n, _ := strconv.Atoi(fmt.Sprint(s.get(keys[2])))
+		n++
+		s.strs[keys[2]] = strconv.Itoa(n)
+		return n
+	}
+	return fmt.Errorf("unknown script")
+}
+
+func (s *fakeRedis) blpop(args []string) interface{} {
+	timeout, _ := strconv.Atoi(args[len(args)-1])
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		s.mu.Lock()
+		for _, key := range args[:len(args)-1] {
+			if l := s.lists[key]; len(l) > 0 {
+				s.lists[key] = l[1:]
+				if len(l) == 1 {
+					delete(s.lists, key)
+				}
+				s.mu.Unlock()
+				return []interface{}{key, l[0]}
+			}
+		}
+		s.mu.Unlock()
+		if timeout > 0 && time.Now().After(deadline) {
+			return []interface{}(nil)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fakeRedis) subscribe(fc *fakeConn, channels []string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies := multiReply{}
+	for _, ch := range channels {
+		if s.subs[ch] == nil {
+			s.subs[ch] = map[*fakeConn]bool{}
+		}
+		s.subs[ch][fc] = true
+		replies = append(replies, []interface{}{"subscribe", ch, s.count(fc)})
+	}
+	return replies
+}
+
+// unsubscribe fc from channels or all channels if none are specified.
+func (s *fakeRedis) unsubscribe(fc *fakeConn, channels []string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(channels) == 0 {
+		for ch, conns := range s.subs {
+			if conns[fc] {
+				channels = append(channels, ch)
+			}
+		}
+	}
+	if len(channels) == 0 {
+		return []interface{}{"unsubscribe", nil, 0}
+	}
+	replies := multiReply{}
+	for _, ch := range channels {
+		delete(s.subs[ch], fc)
+		replies = append(replies, []interface{}{"unsubscribe", ch, s.count(fc)})
+	}
+	return replies
+}
+
+// count returns the number of channels fc is subscribed to. Must be called
+// with mu held.
+func (s *fakeRedis) count(fc *fakeConn) int {
+	n := 0
+	for _, conns := range s.subs {
+		if conns[fc] {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *fakeRedis) publish(ch, msg string) interface{} {
+	s.mu.Lock()
+	conns := []*fakeConn{}
+	for fc := range s.subs[ch] {
+		conns = append(conns, fc)
+	}
+	s.mu.Unlock()
+
+	for _, fc := range conns {
+		fc.mu.Lock()
+		writeReply(fc.w, []interface{}{"message", ch, msg})
+		fc.w.Flush()
+		fc.mu.Unlock()
+	}
+	return len(conns)
+}
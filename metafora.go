@@ -15,6 +15,10 @@ var (
 
 	//FIXME should probably be improved, see usage in Run()
 	consumerRetryDelay = 10 * time.Second
+
+	// balancing is delayed until cluster membership hasn't changed for this
+	// long so a flurry of joins and leaves only causes a single balance
+	membershipDebounce = 5 * time.Second
 )
 
 // Consumer is the core Metafora task runner.
@@ -46,9 +50,24 @@ type Consumer struct {
 
 	watch chan string // channel for watcher to send tasks to main loop
 
+	// signaled by the coordinator when nodes join or leave the cluster
+	nodesChanged chan struct{}
+
 	// Set by command handler, read anywhere via Consumer.frozen()
 	freezeL sync.Mutex
 	freeze  bool
+
+	// Set by SetBalanceDryRun, read by balance
+	balanceL    sync.Mutex
+	dryRun      bool
+	lastBalance BalanceReport
+
+	// admission predicates, their decision counts, and when denied or
+	// deferred tasks may be admitted again
+	admitL     sync.Mutex
+	preds      []Predicate
+	admitStats []PredicateStats
+	admitAfter map[string]time.Time
 }
 
 // NewConsumer returns a new consumer and calls Init on the Balancer and Coordinator.
@@ -62,6 +81,8 @@ func NewConsumer(coord Coordinator, h HandlerFunc, b Balancer) (*Consumer, error
 		stop:     make(chan struct{}),
 		tick:     make(chan int),
 		watch:    make(chan string),
+
+		nodesChanged: make(chan struct{}, 1),
 	}
 
 	// initialize balancer with the consumer and a prefixed logger
@@ -91,6 +112,7 @@ func (c *Consumer) Run() {
 	cmdChan := make(chan Command)
 
 	// Balance is called by the main loop when the balance channel is ticked
+	// either periodically or after cluster membership changes.
 	go func() {
 		randInt := rand.New(rand.NewSource(time.Now().UnixNano())).Int63n
 		for {
@@ -100,13 +122,18 @@ func (c *Consumer) Run() {
 				return
 			case <-time.After(c.balEvery + time.Duration(randInt(balanceJitterMax))):
 				Info("Balancing")
-				select {
-				case balance <- true:
-					// Ticked balance
-				case <-c.stop:
-					// Shutdown has been called.
+			case <-c.nodesChanged:
+				if !c.debounceNodes() {
 					return
 				}
+				Info("Balancing due to cluster membership change")
+			}
+			select {
+			case balance <- true:
+				// Ticked balance
+			case <-c.stop:
+				// Shutdown has been called.
+				return
 			}
 			// Wait for main loop to signal balancing is done
 			select {
@@ -192,15 +219,30 @@ func (c *Consumer) Run() {
 				Debug("Watch channel closed. Exiting main loop.")
 				return
 			}
+			if c.isRunning(task) {
+				// Abandoned hung tasks remain running locally after their claim is
+				// released, so Coordinators may offer them again. Claiming one would
+				// leave a claim no handler releases.
+				Infof("Rejected task %s whose handler is still running", task)
+				select {
+				case <-c.stop:
+				case <-time.After(RunningRejectDelay):
+				}
+				break
+			}
 			if !c.bal.CanClaim(task) {
 				Infof("Balancer rejected task %s", task)
 				break
 			}
-			if !c.coord.Claim(task) {
+			if !c.admit(task) {
+				break
+			}
+			token, ok := c.claim(task)
+			if !ok {
 				Debugf("Coordinator unable to claim task %s", task)
 				break
 			}
-			c.claimed(task)
+			c.claimed(task, token)
 		case cmd, ok := <-cmdChan:
 			if !ok {
 				Debug("Command channel closed. Exiting main loop.")
@@ -252,12 +294,73 @@ func (c *Consumer) watcher() {
 	}
 }
 
+// debounceNodes blocks until cluster membership hasn't changed for
+// membershipDebounce. Returns false if Shutdown is called first.
+func (c *Consumer) debounceNodes() bool {
+	settled := time.After(membershipDebounce)
+	for {
+		select {
+		case <-c.stop:
+			return false
+		case <-c.nodesChanged:
+			settled = time.After(membershipDebounce)
+		case <-settled:
+			return true
+		}
+	}
+}
+
+// BalanceReport is the result of the most recent balance.
+type BalanceReport struct {
+	Time time.Time `json:"time"`
+
+	// DryRun is true if Release was only reported and not released.
+	DryRun  bool     `json:"dry_run"`
+	Release []string `json:"release"`
+}
+
+// SetBalanceDryRun enables or disables dry run balancing. While enabled, the
+// tasks the Balancer would release are logged and reported by LastBalance
+// but not stopped. Note that Balancers are still called, so any state they
+// keep -- such as a ReleaseLimiter's permits -- is still updated.
+func (c *Consumer) SetBalanceDryRun(enabled bool) {
+	c.balanceL.Lock()
+	c.dryRun = enabled
+	c.balanceL.Unlock()
+}
+
+// LastBalance returns the result of the most recent balance.
+func (c *Consumer) LastBalance() BalanceReport {
+	c.balanceL.Lock()
+	defer c.balanceL.Unlock()
+	return c.lastBalance
+}
+
 func (c *Consumer) balance() {
 	tasks := c.bal.Balance()
+
+	c.balanceL.Lock()
+	dryRun := c.dryRun
+	c.lastBalance = BalanceReport{Time: time.Now(), DryRun: dryRun, Release: tasks}
+	c.balanceL.Unlock()
+
+	if dryRun {
+		if len(tasks) > 0 {
+			Infof("Dry run balancer would release: %v", tasks)
+		}
+		return
+	}
 	if len(tasks) > 0 {
 		Infof("Balancer releasing: %v", tasks)
 	}
 	for _, task := range tasks {
+		if target := c.handoff(task); target != "" {
+			c.runL.Lock()
+			if rt, ok := c.running[task]; ok {
+				rt.setHandoff(target)
+			}
+			c.runL.Unlock()
+		}
 		c.stopTask(task)
 	}
 }
@@ -327,30 +430,87 @@ func (c *Consumer) Tasks() []Task {
 	return t
 }
 
+// Cluster returns the Coordinator's ClusterView if it implements
+// ClusterCoordinator.
+func (c *Consumer) Cluster() (ClusterView, error) {
+	if cc, ok := c.coord.(ClusterCoordinator); ok {
+		return cc.Cluster()
+	}
+	return ClusterView{}, ErrNoClusterView
+}
+
+// Props returns the properties stored with a task if the Coordinator
+// implements PropsCoordinator.
+func (c *Consumer) Props(taskID string) TaskProps {
+	if pc, ok := c.coord.(PropsCoordinator); ok {
+		return pc.Props(taskID)
+	}
+	return TaskProps{}
+}
+
+// claim a task via the Coordinator. The claim's fencing token is returned if
+// the Coordinator implements FencingCoordinator.
+func (c *Consumer) claim(taskID string) (token uint64, ok bool) {
+	if fc, ok := c.coord.(FencingCoordinator); ok {
+		return fc.FencedClaim(taskID)
+	}
+	return 0, c.coord.Claim(taskID)
+}
+
+// isRunning returns true if the task has a handler running locally.
+func (c *Consumer) isRunning(taskID string) bool {
+	c.runL.Lock()
+	defer c.runL.Unlock()
+	_, ok := c.running[taskID]
+	return ok
+}
+
 // claimed starts a handler for a claimed task. It is the only method to
 // manipulate c.running and closes the task channel when a handler's Run
 // method exits.
-func (c *Consumer) claimed(taskID string) {
+func (c *Consumer) claimed(taskID string, token uint64) {
 	h := c.handler()
+	props := c.Props(taskID)
+	if _, ok := c.coord.(GroupCoordinator); !ok && props.Group != "" {
+		Errorf("Task %s belongs to group %s but the coordinator doesn't enforce group quotas", taskID, props.Group)
+	}
+	handoffToken := ""
+	if hc, ok := c.coord.(HandoffCoordinator); ok {
+		handoffToken = hc.HandoffToken(taskID)
+	}
 
 	Debugf("Attempting to start task " + taskID)
 	// Associate handler with taskID
 	// **This is the only place tasks should be added to c.running**
 	c.runL.Lock()
-	defer c.runL.Unlock()
 	select {
 	case <-c.stop:
-		// We're closing, don't bother starting this task
+		// We're closing, don't bother starting this task. Release it after
+		// unlocking so the Coordinator isn't called with runL held.
+		c.runL.Unlock()
+		c.coord.Release(taskID)
 		return
 	default:
 	}
+	defer c.runL.Unlock()
 	if _, ok := c.running[taskID]; ok {
-		// If a coordinator returns an already claimed task from Watch(), then it's
-		// a coordinator (or broker) bug.
-		Warnf("Attempted to claim already running task %s", taskID)
+		// Tasks running locally are skipped before claiming, so this is a bug.
+		// The claim belongs to the running task so it's left alone.
+		Errorf("Attempted to start already running task %s", taskID)
 		return
 	}
-	rt := newTask(taskID, h)
+	rt := newTask(taskID, token, props, h)
+	rt.handoffToken = handoffToken
+	if cc, ok := c.coord.(CheckpointCoordinator); ok {
+		rt.cp = &checkpointer{cc: cc, taskID: taskID, token: token}
+	}
+	if pc, ok := c.coord.(ProgressCoordinator); ok {
+		rt.progress.publish = func(p Progress) {
+			if err := pc.SetProgress(taskID, p); err != nil {
+				Warnf("Error storing progress of task %s: %v", taskID, err)
+			}
+		}
+	}
 	c.running[taskID] = rt
 
 	// This must be done in the runL lock after the stop chan check so Shutdown
@@ -364,14 +524,28 @@ func (c *Consumer) claimed(taskID string) {
 
 		// Run the task
 		Infof("Task %q started", taskID)
-		done := c.runTask(h.Run, taskID)
+		run := h.Run
+		if th, ok := h.(TaskHandler); ok {
+			// Init is called within runTask so panics are recovered
+			run = func(id string) bool {
+				th.Init(rt)
+				return th.Run(id)
+			}
+		}
+		var done bool
+		if props.MaxRunTime > 0 || props.HeartbeatTimeout > 0 {
+			done = c.runWatched(run, rt)
+		} else {
+			done = c.runTask(run, taskID)
+		}
+		rt.progress.stop()
 		var status string
 		if done {
 			status = "done"
 			c.coord.Done(taskID)
 		} else {
 			status = "released"
-			c.coord.Release(taskID)
+			c.release(rt)
 		}
 
 		stopped := rt.Stopped()
@@ -410,8 +584,8 @@ func (c *Consumer) runTask(run func(string) bool, task string) bool {
 }
 
 // stopTask asynchronously calls the task handlers' Stop method. While stopTask
-// calls don't block, calls to task handler's Stop method are serialized with a
-// lock.
+// calls don't block, calls to task handler's Stop method are serialized: Stop
+// isn't called again while a previous call hasn't returned.
 func (c *Consumer) stopTask(taskID string) {
 	c.runL.Lock()
 	task, ok := c.running[taskID]
@@ -27,8 +27,8 @@ type testHandler struct {
 }
 
 func (h *testHandler) Run(id string) bool {
-	h.tasksRun <- id
 	h.id = id
+	h.tasksRun <- id
 	h.t.Logf("Run(%s)", id)
 	<-h.stop
 	h.t.Logf("Stop received for %s", id)
@@ -200,11 +200,91 @@ func TestBalancer(t *testing.T) {
 	}
 }
 
+type chanBalancer struct {
+	DumbBalancer
+	balanced chan struct{}
+}
+
+func (b *chanBalancer) Balance() []string {
+	b.balanced <- struct{}{}
+	return nil
+}
+
+// TestNodesChanged ensures membership changes cause a single debounced balance.
+func TestNodesChanged(t *testing.T) {
+	defer func(d time.Duration) { membershipDebounce = d }(membershipDebounce)
+	membershipDebounce = 50 * time.Millisecond
+
+	tc := NewTestCoord()
+	b := &chanBalancer{balanced: make(chan struct{}, 10)}
+	c, _ := NewConsumer(tc, noopHandlerFunc, b)
+	c.balEvery = time.Hour
+	go c.Run()
+	defer c.Shutdown()
+
+	ctx := &coordinatorContext{c}
+	for i := 0; i < 5; i++ {
+		ctx.NodesChanged()
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-b.balanced:
+	case <-time.After(time.Second):
+		t.Fatal("Didn't balance after nodes changed")
+	}
+	select {
+	case <-b.balanced:
+		t.Fatal("Balanced more than once for a single burst of membership changes")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestBalanceDryRun ensures dry run balances report releases without
+// stopping tasks.
+func TestBalanceDryRun(t *testing.T) {
+	t.Parallel()
+
+	hf, tasksRun := newTestHandlerFunc(t)
+	tc := NewTestCoord()
+	c, _ := NewConsumer(tc, hf, &fakeBalancer{claim: true, release: []string{"t1"}})
+	c.balEvery = time.Hour
+	c.SetBalanceDryRun(true)
+	go c.Run()
+	defer c.Shutdown()
+
+	tc.Tasks <- "t1"
+	select {
+	case <-tasksRun:
+	case <-time.After(time.Second):
+		t.Fatal("Task didn't run in a timely fashion")
+	}
+
+	tc.Commands <- CommandBalance()
+	deadline := time.Now().Add(time.Second)
+	for c.LastBalance().Time.IsZero() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	report := c.LastBalance()
+	if !report.DryRun || len(report.Release) != 1 || report.Release[0] != "t1" {
+		t.Fatalf("Unexpected balance report: %+v", report)
+	}
+	select {
+	case task := <-tc.Releases:
+		t.Fatalf("Task %s released during dry run", task)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if tasks := c.Tasks(); len(tasks) != 1 {
+		t.Fatalf("Expected 1 running task but found %v", tasks)
+	}
+}
+
 type noopHandler struct{}
 
 func (noopHandler) Run(string) bool { return true }
 func (noopHandler) Stop()           {}
 
+func noopHandlerFunc() Handler { return noopHandler{} }
+
 // TestHandleTask ensures that tasks are marked as done once handled.
 func TestHandleTask(t *testing.T) {
 	hf := func() Handler { return noopHandler{} }
@@ -0,0 +1,119 @@
+package metafora
+
+import (
+	"sync"
+	"time"
+)
+
+// ProgressInterval is the minimum time between storing a task's progress in
+// the broker. Progress set more often is coalesced and only the latest is
+// stored.
+var ProgressInterval = 5 * time.Second
+
+// Progress is a short description of what a task is doing and how much of it
+// is complete. Handlers set whichever of Percent or Units and Total suit
+// their work.
+type Progress struct {
+	Status  string    `json:"status,omitempty"`
+	Percent float64   `json:"percent,omitempty"`
+	Units   uint64    `json:"units,omitempty"`
+	Total   uint64    `json:"total,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// ProgressTask is an optional interface Tasks may implement to let handlers
+// report their progress. The Consumer's Tasks implement it.
+type ProgressTask interface {
+	Task
+
+	// Progress is the last progress set by the task's handler.
+	Progress() Progress
+
+	// SetProgress replaces the task's progress. It's stored in the broker at
+	// most once per ProgressInterval if the Coordinator implements
+	// ProgressCoordinator.
+	SetProgress(Progress)
+}
+
+// ProgressCoordinator is an optional interface Coordinators may implement to
+// store the progress handlers set on their ProgressTask in the broker.
+type ProgressCoordinator interface {
+	Coordinator
+
+	// SetProgress stores a claimed task's progress with the task.
+	SetProgress(taskID string, p Progress) error
+}
+
+// ProgressClient is an optional interface Clients may implement to query the
+// progress stored with tasks.
+type ProgressClient interface {
+	Client
+
+	// Progress returns the last progress stored with a task or the zero value
+	// if none has been stored.
+	Progress(taskID string) (Progress, error)
+}
+
+// progress tracks a task's latest Progress and publishes it at most once per
+// ProgressInterval.
+type progress struct {
+	mu      sync.Mutex
+	p       Progress
+	publish func(Progress) // nil if progress isn't stored in the broker
+	last    time.Time      // when progress was last published
+	timer   *time.Timer    // pending publish of coalesced progress
+	stopped bool
+	flushes sync.WaitGroup // publishes in flight
+}
+
+func (pr *progress) get() Progress {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return pr.p
+}
+
+func (pr *progress) set(p Progress) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	p.Updated = time.Now()
+	pr.p = p
+	if pr.publish == nil || pr.stopped || pr.timer != nil {
+		// Pending publishes always publish the latest progress
+		return
+	}
+	wait := ProgressInterval - p.Updated.Sub(pr.last)
+	if wait < 0 {
+		wait = 0
+	}
+	pr.timer = time.AfterFunc(wait, pr.flush)
+}
+
+// flush publishes the latest progress.
+func (pr *progress) flush() {
+	pr.mu.Lock()
+	pr.timer = nil
+	if pr.stopped {
+		pr.mu.Unlock()
+		return
+	}
+	p := pr.p
+	pr.last = time.Now()
+	pr.flushes.Add(1)
+	pr.mu.Unlock()
+	defer pr.flushes.Done()
+	pr.publish(p)
+}
+
+// stop cancels any pending publish and waits for publishes in flight. It's
+// called when the task's handler exits so progress isn't stored after the
+// task is released.
+func (pr *progress) stop() {
+	pr.mu.Lock()
+	pr.stopped = true
+	if pr.timer != nil {
+		pr.timer.Stop()
+		pr.timer = nil
+	}
+	pr.mu.Unlock()
+	pr.flushes.Wait()
+}
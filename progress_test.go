@@ -0,0 +1,121 @@
+package metafora
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type progressCoord struct {
+	*TestCoord
+	progress chan Progress
+}
+
+func (c *progressCoord) SetProgress(taskID string, p Progress) error {
+	c.progress <- p
+	return nil
+}
+
+// TestProgress ensures progress is stored at most once per ProgressInterval
+// and that the latest progress is always stored.
+func TestProgress(t *testing.T) {
+	defer func(d time.Duration) { ProgressInterval = d }(ProgressInterval)
+	ProgressInterval = 200 * time.Millisecond
+
+	tc := &progressCoord{TestCoord: NewTestCoord(), progress: make(chan Progress, 10)}
+	tasks := make(chan Task, 1)
+	next := make(chan bool)
+	hf := SimpleTaskHandler(func(task Task, stop <-chan bool) bool {
+		task.(ProgressTask).SetProgress(Progress{Status: "starting"})
+		<-next
+		task.(ProgressTask).SetProgress(Progress{Status: "loading", Percent: 10})
+		task.(ProgressTask).SetProgress(Progress{Status: "processing", Units: 5, Total: 10})
+		tasks <- task
+		<-stop
+		return false
+	})
+	c, _ := NewConsumer(tc, hf, &DumbBalancer{})
+	go c.Run()
+	defer c.Shutdown()
+
+	tc.Tasks <- "t1"
+	start := time.Now()
+	for i, status := range []string{"starting", "processing"} {
+		select {
+		case p := <-tc.progress:
+			if p.Status != status {
+				t.Fatalf("Expected %q progress to be stored but found %q", status, p.Status)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Progress %q wasn't stored in a timely fashion", status)
+		}
+		if i == 0 {
+			// Set more progress immediately after the first is stored
+			next <- true
+		} else if elapsed := time.Since(start); elapsed < ProgressInterval/2 {
+			t.Errorf("Progress stored again after only %s", elapsed)
+		}
+	}
+
+	var task Task
+	select {
+	case task = <-tasks:
+	case <-time.After(time.Second):
+		t.Fatal("Handler didn't set progress in a timely fashion")
+	}
+	select {
+	case p := <-tc.progress:
+		t.Fatalf("Unexpected progress stored: %+v", p)
+	case <-time.After(2 * ProgressInterval):
+	}
+
+	p := task.(ProgressTask).Progress()
+	if p.Status != "processing" || p.Units != 5 || p.Total != 10 || p.Updated.IsZero() {
+		t.Errorf("Unexpected task progress: %+v", p)
+	}
+	buf, err := json.Marshal(task)
+	if err != nil {
+		t.Fatalf("Error marshalling task: %v", err)
+	}
+	js := struct{ Progress *Progress }{}
+	if err := json.Unmarshal(buf, &js); err != nil {
+		t.Fatalf("Error unmarshalling task: %v", err)
+	}
+	if js.Progress == nil || js.Progress.Status != "processing" {
+		t.Errorf("Expected progress in task JSON: %s", buf)
+	}
+}
+
+// TestProgressStopWaits ensures stopping progress waits for publishes in
+// flight so progress isn't stored after a task's handler exits.
+func TestProgressStopWaits(t *testing.T) {
+	publishing := make(chan bool)
+	unblock := make(chan bool)
+	pr := &progress{publish: func(Progress) {
+		publishing <- true
+		<-unblock
+	}}
+	pr.set(Progress{Status: "slow"})
+	select {
+	case <-publishing:
+	case <-time.After(time.Second):
+		t.Fatal("Progress wasn't published in a timely fashion")
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		pr.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop returned while a publish was in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(unblock)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop didn't return after the publish finished")
+	}
+}
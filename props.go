@@ -0,0 +1,75 @@
+package metafora
+
+import "time"
+
+// TaskProps are optional properties submitted and stored with a task in the
+// broker. Clients implementing PropsClient can submit them and Coordinators
+// implementing PropsCoordinator provide them to the Consumer when a task is
+// claimed.
+type TaskProps struct {
+	// Weight of the task relative to other tasks. Zero is treated as 1.
+	Weight float64 `json:"weight,omitempty"`
+
+	// Priority of the task. Coordinators offer unclaimed tasks with higher
+	// priorities first and PreemptiveBalancer may release lower priority tasks
+	// to make room for them.
+	Priority int `json:"priority,omitempty"`
+
+	// Group (or tenant) the task belongs to. Coordinators which implement
+	// GroupCoordinator enforce the group's GroupQuota when claiming the task.
+	Group string `json:"group,omitempty"`
+
+	// Constraints on which nodes may run the task.
+	Constraints Constraints `json:"constraints"`
+
+	// MaxRunTime is how long the task's handler may run before it's considered
+	// hung. Zero is unlimited. Encoded in JSON as nanoseconds.
+	MaxRunTime time.Duration `json:"max_run_time,omitempty"`
+
+	// HeartbeatTimeout is how long the task's handler may go without calling
+	// HeartbeatTask.Heartbeat before it's considered hung. Zero disables
+	// heartbeats. Encoded in JSON as nanoseconds.
+	HeartbeatTimeout time.Duration `json:"heartbeat_timeout,omitempty"`
+
+	// FailHung marks hung tasks done instead of releasing them if their
+	// handlers don't exit after being stopped.
+	FailHung bool `json:"fail_hung,omitempty"`
+}
+
+// Constraints restrict task placement by node labels. They're enforced by
+// AffinityBalancer.
+type Constraints struct {
+	// Required labels and values a node must have to run the task.
+	Required map[string]string `json:"required,omitempty"`
+
+	// Preferred labels and values. Nodes missing them delay claiming the task
+	// to give nodes with them a chance to claim it first.
+	Preferred map[string]string `json:"preferred,omitempty"`
+
+	// AntiAffinity group of the task. A node will only run one task per group.
+	AntiAffinity string `json:"anti_affinity,omitempty"`
+}
+
+// Satisfied returns true if labels contain all required labels.
+func (c Constraints) Satisfied(labels map[string]string) bool {
+	return missing(c.Required, labels) == 0
+}
+
+// missing returns the number of expected labels not present in labels.
+func missing(expected, labels map[string]string) int {
+	n := 0
+	for k, v := range expected {
+		if lv, ok := labels[k]; !ok || lv != v {
+			n++
+		}
+	}
+	return n
+}
+
+// TaskWeight returns the task's weight or 1 if no weight was set.
+func (p TaskProps) TaskWeight() float64 {
+	if p.Weight <= 0 {
+		return 1
+	}
+	return p.Weight
+}
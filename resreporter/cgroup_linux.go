@@ -0,0 +1,202 @@
+package resreporter
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lytics/metafora"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroup v1 reports unlimited memory as the max int64 rounded down to the page
+// size, so treat anything this large as unlimited.
+const cgroupUnlimited = 1 << 62
+
+// CgroupMemory reports memory used and the memory limit of this process's
+// cgroup, falling back to Memory when no limit is set.
+var CgroupMemory = NewCgroupMemory(cgroupRoot, Memory)
+
+// CgroupCPU reports CPU time used against the CPU quota of this process's
+// cgroup, falling back to CPU when no quota is set.
+var CgroupCPU = NewCgroupCPU(cgroupRoot, CPU)
+
+// NewCgroupMemory creates a memory reporter for the cgroup v1 or v2
+// filesystem mounted at root. Usage excludes inactive page cache like the
+// kubelet's working set. Values are in kB like Memory. When no limit is set
+// the fallback reporter is used.
+func NewCgroupMemory(root string, fallback metafora.ResourceReporter) metafora.ResourceReporter {
+	return &cgroupMemory{root: root, fallback: fallback}
+}
+
+type cgroupMemory struct {
+	root     string
+	fallback metafora.ResourceReporter
+}
+
+func (m *cgroupMemory) Used() (used uint64, total uint64) {
+	var limit, usage, inactive uint64
+	var err error
+	if cgroupV2(m.root) {
+		limit, err = readCgroupUint(filepath.Join(m.root, "memory.max"))
+		if err == nil {
+			usage, err = readCgroupUint(filepath.Join(m.root, "memory.current"))
+		}
+		if err == nil {
+			inactive, err = readCgroupStat(filepath.Join(m.root, "memory.stat"), "inactive_file")
+		}
+	} else {
+		dir := filepath.Join(m.root, "memory")
+		limit, err = readCgroupUint(filepath.Join(dir, "memory.limit_in_bytes"))
+		if err == nil {
+			usage, err = readCgroupUint(filepath.Join(dir, "memory.usage_in_bytes"))
+		}
+		if err == nil {
+			inactive, err = readCgroupStat(filepath.Join(dir, "memory.stat"), "total_inactive_file")
+		}
+	}
+	if err != nil {
+		metafora.Debugf("Unable to read cgroup memory via %s, falling back to %s reporter: %v", m.root, m.fallback, err)
+		return m.fallback.Used()
+	}
+	if limit >= cgroupUnlimited {
+		return m.fallback.Used()
+	}
+	if inactive < usage {
+		usage -= inactive
+	}
+	return usage / 1024, limit / 1024
+}
+
+func (*cgroupMemory) String() string { return "kB" }
+
+// NewCgroupCPU creates a CPU reporter for the cgroup v1 or v2 filesystem
+// mounted at root. It reports CPU time used in microseconds over the last
+// SampleInterval and the CPU time the quota allowed in that interval. When no
+// quota is set, or until the first interval has elapsed, the fallback reporter
+// is used.
+func NewCgroupCPU(root string, fallback metafora.ResourceReporter) metafora.ResourceReporter {
+	c := &cgroupCPU{root: root, fallback: fallback, now: time.Now}
+	c.sampler.read = c.readUsage
+	return c
+}
+
+type cgroupCPU struct {
+	root     string
+	fallback metafora.ResourceReporter
+	now      func() time.Time
+	sampler
+}
+
+func (c *cgroupCPU) Used() (used uint64, total uint64) {
+	quota, period, _, err := c.read()
+	if err != nil {
+		metafora.Debugf("Unable to read cgroup CPU via %s, falling back to %s reporter: %v", c.root, c.fallback, err)
+		return c.fallback.Used()
+	}
+	if quota == 0 {
+		return c.fallback.Used()
+	}
+	used, elapsed, err := c.get()
+	if err != nil {
+		metafora.Debugf("Unable to sample cgroup CPU via %s, falling back to %s reporter: %v", c.root, c.fallback, err)
+		return c.fallback.Used()
+	}
+	return used, elapsed * quota / period
+}
+
+// readUsage returns the CPU usage and the current time in microseconds.
+func (c *cgroupCPU) readUsage() (usage, now uint64, err error) {
+	_, _, usage, err = c.read()
+	return usage, uint64(c.now().UnixNano() / int64(time.Microsecond)), err
+}
+
+func (*cgroupCPU) String() string { return "usec" }
+
+// read returns the CPU quota and period, or a quota of 0 if unlimited, and
+// the total CPU usage in microseconds.
+func (c *cgroupCPU) read() (quota, period, usage uint64, err error) {
+	if cgroupV2(c.root) {
+		buf, err := ioutil.ReadFile(filepath.Join(c.root, "cpu.max"))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		fields := strings.Fields(string(buf))
+		if len(fields) != 2 {
+			return 0, 0, 0, fmt.Errorf("invalid cpu.max: %q", buf)
+		}
+		if fields[0] != "max" {
+			if quota, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+				return 0, 0, 0, err
+			}
+		}
+		if period, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return 0, 0, 0, err
+		}
+		usage, err = readCgroupStat(filepath.Join(c.root, "cpu.stat"), "usage_usec")
+		return quota, period, usage, err
+	}
+
+	// v1 reports an unlimited quota as -1
+	buf, err := ioutil.ReadFile(filepath.Join(c.root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if q := strings.TrimSpace(string(buf)); q != "-1" {
+		if quota, err = strconv.ParseUint(q, 10, 64); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	if period, err = readCgroupUint(filepath.Join(c.root, "cpu", "cpu.cfs_period_us")); err != nil {
+		return 0, 0, 0, err
+	}
+	ns, err := readCgroupUint(filepath.Join(c.root, "cpuacct", "cpuacct.usage"))
+	return quota, period, ns / 1000, err
+}
+
+// cgroupV2 returns true if root is a cgroup v2 (unified) filesystem.
+func cgroupV2(root string) bool {
+	_, err := os.Stat(filepath.Join(root, "cgroup.controllers"))
+	return err == nil
+}
+
+// readCgroupUint reads a file containing a single integer. "max" is treated
+// as unlimited.
+func readCgroupUint(path string) (uint64, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(buf))
+	if s == "max" {
+		return cgroupUnlimited, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// readCgroupStat reads a key from a flat keyed file like memory.stat.
+func readCgroupStat(path, key string) (uint64, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s not found in %s", key, path)
+}
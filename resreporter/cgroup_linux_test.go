@@ -0,0 +1,87 @@
+package resreporter
+
+import (
+	"testing"
+	"time"
+)
+
+type fallbackReporter struct{ calls int }
+
+func (f *fallbackReporter) Used() (uint64, uint64) {
+	f.calls++
+	return 1, 2
+}
+func (*fallbackReporter) String() string { return "fallback" }
+
+func TestCgroupMemory(t *testing.T) {
+	t.Parallel()
+	fb := &fallbackReporter{}
+
+	// 512MiB current - 100MiB inactive of 1GiB
+	if used, total := NewCgroupMemory("testdata/cgroup/v2", fb).Used(); used != 412*1024 || total != 1024*1024 {
+		t.Errorf("v2: expected %d of %d kB but found %d of %d", 412*1024, 1024*1024, used, total)
+	}
+
+	// 1GiB usage - 512MiB inactive of 2GiB
+	if used, total := NewCgroupMemory("testdata/cgroup/v1", fb).Used(); used != 512*1024 || total != 2048*1024 {
+		t.Errorf("v1: expected %d of %d kB but found %d of %d", 512*1024, 2048*1024, used, total)
+	}
+	if fb.calls != 0 {
+		t.Errorf("Fallback called %d times with limits set", fb.calls)
+	}
+
+	// No limit or no cgroupfs at all falls back
+	for _, root := range []string{"testdata/cgroup/v2-unlimited", "testdata/missing"} {
+		if used, total := NewCgroupMemory(root, fb).Used(); used != 1 || total != 2 {
+			t.Errorf("%s: expected fallback but found %d of %d", root, used, total)
+		}
+	}
+}
+
+func TestCgroupCPU(t *testing.T) {
+	defer func(d time.Duration) { SampleInterval = d }(SampleInterval)
+	SampleInterval = time.Hour // samples are taken manually
+
+	fb := &fallbackReporter{}
+	start := time.Now()
+
+	// v2 quota is 2 CPUs; 5s used
+	cpu := NewCgroupCPU("testdata/cgroup/v2", fb).(*cgroupCPU)
+	cpu.now = func() time.Time { return start }
+	if used, total := cpu.Used(); used != 1 || total != 2 {
+		t.Errorf("v2: expected fallback until an interval elapses but found %d of %d", used, total)
+	}
+	cpu.busy = 3000000 // pretend 2s were used in the last second
+	cpu.now = func() time.Time { return start.Add(time.Second) }
+	cpu.sample()
+	for i := 0; i < 2; i++ {
+		// Calling Used doesn't reset the interval
+		if used, total := cpu.Used(); used != 2000000 || total != 2000000 {
+			t.Errorf("v2: expected 2000000 of 2000000 usec but found %d of %d", used, total)
+		}
+	}
+
+	// Samples where no time elapsed keep the last interval
+	cpu.sample()
+	if used, total := cpu.Used(); used != 2000000 || total != 2000000 {
+		t.Errorf("v2: expected 2000000 of 2000000 usec after an empty sample but found %d of %d", used, total)
+	}
+
+	// v1 quota is half a CPU; 3s used
+	cpu = NewCgroupCPU("testdata/cgroup/v1", fb).(*cgroupCPU)
+	cpu.now = func() time.Time { return start }
+	cpu.Used()
+	cpu.busy = 2750000
+	cpu.now = func() time.Time { return start.Add(time.Second) }
+	cpu.sample()
+	if used, total := cpu.Used(); used != 250000 || total != 500000 {
+		t.Errorf("v1: expected 250000 of 500000 usec but found %d of %d", used, total)
+	}
+	if fb.calls != 2 {
+		t.Errorf("Expected fallback to be called only before intervals elapsed but found %d calls", fb.calls)
+	}
+
+	if used, total := NewCgroupCPU("testdata/cgroup/v2-unlimited", fb).Used(); used != 1 || total != 2 {
+		t.Errorf("Expected fallback without a quota but found %d of %d", used, total)
+	}
+}
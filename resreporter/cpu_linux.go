@@ -0,0 +1,77 @@
+package resreporter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/lytics/metafora"
+)
+
+const procStat = "/proc/stat"
+
+// CPU reports busy and total CPU time in jiffies across all CPUs over the
+// last SampleInterval, so the balancer sees current utilization instead of
+// utilization since boot.
+var CPU = NewCPU(procStat)
+
+// NewCPU creates a CPU utilization reporter which reads the stat file at
+// path. Sampling starts when Used is first called, which reports utilization
+// since boot until the first SampleInterval has elapsed.
+func NewCPU(path string) metafora.ResourceReporter {
+	c := &cpu{path: path}
+	c.read = c.readCPU
+	// Counters start at zero on boot
+	c.prev = true
+	return c
+}
+
+type cpu struct {
+	path string
+	sampler
+}
+
+func (c *cpu) Used() (used uint64, total uint64) {
+	used, total, err := c.get()
+	if err != nil {
+		metafora.Errorf("Error reading CPU utilization via %s: %v", c.path, err)
+
+		// Effectively disable the balancer since an error happened
+		return 0, 100
+	}
+	return used, total
+}
+
+// readCPU returns the busy and total jiffies from the stat file.
+func (c *cpu) readCPU() (busy, total uint64, err error) {
+	busy, idle, err := readCPU(c.path)
+	return busy, busy + idle, err
+}
+
+func (*cpu) String() string { return "jiffies" }
+
+// readCPU returns the busy and idle jiffies from the aggregate cpu line of a
+// stat file.
+func readCPU(path string) (busy, idle uint64, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fd.Close()
+
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		var user, nice, system, idleT, iowait, irq, softirq, steal uint64
+		n, _ := fmt.Sscanf(s.Text(), "cpu %d %d %d %d %d %d %d %d",
+			&user, &nice, &system, &idleT, &iowait, &irq, &softirq, &steal)
+		if n < 4 {
+			continue
+		}
+		// Guest time is already included in user time
+		return user + nice + system + irq + softirq + steal, idleT + iowait, nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("no cpu line found")
+}
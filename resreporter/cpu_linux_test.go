@@ -0,0 +1,56 @@
+package resreporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCPUFixture(t *testing.T) {
+	defer func(d time.Duration) { SampleInterval = d }(SampleInterval)
+	SampleInterval = time.Hour // samples are taken manually
+
+	dir, err := ioutil.TempDir("", "metafora-cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stat := filepath.Join(dir, "stat")
+	cp := func(src string) {
+		buf, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(stat, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Utilization since boot is reported until an interval elapses
+	cp("testdata/stat1")
+	cpu := NewCPU(stat).(*cpu)
+	if used, total := cpu.Used(); used != 200 || total != 1000 {
+		t.Errorf("Expected 200 of 1000 jiffies since boot but found %d of %d", used, total)
+	}
+
+	cp("testdata/stat2")
+	cpu.sample()
+	for i := 0; i < 2; i++ {
+		// Calling Used doesn't reset the interval
+		if used, total := cpu.Used(); used != 300 || total != 700 {
+			t.Errorf("Expected 300 of 700 jiffies but found %d of %d", used, total)
+		}
+	}
+
+	// Samples where no time elapsed keep the last interval
+	cpu.sample()
+	if used, total := cpu.Used(); used != 300 || total != 700 {
+		t.Errorf("Expected 300 of 700 jiffies after an empty sample but found %d of %d", used, total)
+	}
+
+	if used, total := NewCPU("testdata/missing").Used(); used != 0 || total != 100 {
+		t.Errorf("Expected 0 of 100 on error but found %d of %d", used, total)
+	}
+}
@@ -0,0 +1,36 @@
+package resreporter
+
+import (
+	"syscall"
+
+	"github.com/lytics/metafora"
+)
+
+// statfs is overridden by tests.
+var statfs = syscall.Statfs
+
+// NewDisk creates a disk space reporter for the filesystem mounted at path.
+// Space reserved for root is counted as used.
+func NewDisk(path string) metafora.ResourceReporter {
+	return disk{path: path}
+}
+
+type disk struct {
+	path string
+}
+
+func (d disk) Used() (used uint64, total uint64) {
+	st := syscall.Statfs_t{}
+	if err := statfs(d.path, &st); err != nil {
+		metafora.Errorf("Error reading disk usage of %s: %v", d.path, err)
+
+		// Effectively disable the balancer since an error happened
+		return 0, 100
+	}
+	bsize := uint64(st.Bsize)
+	total = uint64(st.Blocks) * bsize
+	used = total - uint64(st.Bavail)*bsize
+	return used, total
+}
+
+func (disk) String() string { return "bytes" }
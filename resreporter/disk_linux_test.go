@@ -0,0 +1,27 @@
+package resreporter
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestDiskFixture(t *testing.T) {
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		if path != "/data" {
+			return syscall.ENOENT
+		}
+		st.Bsize = 4096
+		st.Blocks = 1000
+		st.Bfree = 300
+		st.Bavail = 250
+		return nil
+	}
+	defer func() { statfs = syscall.Statfs }()
+
+	if used, total := NewDisk("/data").Used(); used != 750*4096 || total != 1000*4096 {
+		t.Errorf("Expected %d of %d bytes used but found %d of %d", 750*4096, 1000*4096, used, total)
+	}
+	if used, total := NewDisk("/missing").Used(); used != 0 || total != 100 {
+		t.Errorf("Expected 0 of 100 on error but found %d of %d", used, total)
+	}
+}
@@ -0,0 +1,50 @@
+package resreporter
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/lytics/metafora"
+)
+
+const procSelfFD = "/proc/self/fd"
+
+// getrlimit is overridden by tests.
+var getrlimit = syscall.Getrlimit
+
+// FDs reports this process's open file descriptors and its soft limit.
+var FDs = NewFDs(procSelfFD)
+
+// NewFDs creates a file descriptor reporter which counts the entries in the
+// fd directory at path.
+func NewFDs(path string) metafora.ResourceReporter {
+	return fds{path: path}
+}
+
+type fds struct {
+	path string
+}
+
+func (f fds) Used() (used uint64, total uint64) {
+	lim := syscall.Rlimit{}
+	if err := getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		metafora.Errorf("Error reading file descriptor limit: %v", err)
+
+		// Effectively disable the balancer since an error happened
+		return 0, 100
+	}
+	dir, err := os.Open(f.path)
+	if err != nil {
+		metafora.Errorf("Error reading open file descriptors via %s: %v", f.path, err)
+		return 0, 100
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		metafora.Errorf("Error reading open file descriptors via %s: %v", f.path, err)
+		return 0, 100
+	}
+	return uint64(len(names)), lim.Cur
+}
+
+func (fds) String() string { return "fds" }
@@ -0,0 +1,19 @@
+package resreporter
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestFDsFixture(t *testing.T) {
+	getrlimit = func(resource int, lim *syscall.Rlimit) error {
+		lim.Cur = 1024
+		lim.Max = 4096
+		return nil
+	}
+	defer func() { getrlimit = syscall.Getrlimit }()
+
+	if used, total := NewFDs("testdata/fd").Used(); used != 3 || total != 1024 {
+		t.Errorf("Expected 3 of 1024 fds but found %d of %d", used, total)
+	}
+}
@@ -0,0 +1,52 @@
+package resreporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+
+	"github.com/lytics/metafora"
+)
+
+const procLoadavg = "/proc/loadavg"
+
+// LoadAvg reports the 1 minute load average normalized by the number of CPUs.
+// Both values are multiplied by 100, so a load of 1.5 on 2 CPUs is reported
+// as 150 of 200.
+var LoadAvg = NewLoadAvg(procLoadavg, runtime.NumCPU())
+
+// NewLoadAvg creates a load average reporter which reads the loadavg file at
+// path and normalizes it by cpus.
+func NewLoadAvg(path string, cpus int) metafora.ResourceReporter {
+	return loadavg{path: path, cpus: cpus}
+}
+
+type loadavg struct {
+	path string
+	cpus int
+}
+
+func (l loadavg) Used() (used uint64, total uint64) {
+	buf, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		metafora.Errorf("Error reading load average via %s: %v", l.path, err)
+
+		// Effectively disable the balancer since an error happened
+		return 0, 100
+	}
+	var load float64
+	if _, err := fmt.Sscanf(string(buf), "%f", &load); err != nil {
+		metafora.Errorf("Error parsing load average from %s: %v", l.path, err)
+		return 0, 100
+	}
+
+	total = uint64(l.cpus) * 100
+	used = uint64(load * 100)
+	if used > total {
+		// Overloaded; report 100% so percentages stay meaningful
+		used = total
+	}
+	return used, total
+}
+
+func (loadavg) String() string { return "load" }
@@ -0,0 +1,18 @@
+package resreporter_test
+
+import (
+	"testing"
+
+	"github.com/lytics/metafora/resreporter"
+)
+
+func TestLoadAvgFixture(t *testing.T) {
+	if used, total := resreporter.NewLoadAvg("testdata/loadavg", 2).Used(); used != 150 || total != 200 {
+		t.Errorf("Expected load of 150 of 200 but found %d of %d", used, total)
+	}
+
+	// Load over the number of CPUs is capped
+	if used, total := resreporter.NewLoadAvg("testdata/loadavg", 1).Used(); used != 100 || total != 100 {
+		t.Errorf("Expected load of 100 of 100 but found %d of %d", used, total)
+	}
+}
@@ -10,14 +10,23 @@ import (
 
 const meminfo = "/proc/meminfo"
 
-var Memory = memory{}
+// Memory reports memory used (excluding buffers and cache) and total memory
+// from /proc/meminfo.
+var Memory = memory{path: meminfo}
 
-type memory struct{}
+// NewMemory creates a memory reporter which reads the meminfo file at path.
+func NewMemory(path string) metafora.ResourceReporter {
+	return memory{path: path}
+}
+
+type memory struct {
+	path string
+}
 
-func (memory) Used() (used uint64, total uint64) {
-	fd, err := os.Open(meminfo)
+func (m memory) Used() (used uint64, total uint64) {
+	fd, err := os.Open(m.path)
 	if err != nil {
-		metafora.Errorf("Error reading free memory via "+meminfo+": %v", err)
+		metafora.Errorf("Error reading free memory via %s: %v", m.path, err)
 
 		// Effectively disable the balancer since an error happened
 		return 0, 100
@@ -38,8 +47,9 @@ func (memory) Used() (used uint64, total uint64) {
 				continue
 			}
 		}
-		if foundFree {
+		if !foundFree {
 			if n, _ := fmt.Sscanf(s.Text(), "MemFree:%d", &free); n == 1 {
+				foundFree = true
 				continue
 			}
 		}
@@ -57,7 +67,7 @@ func (memory) Used() (used uint64, total uint64) {
 		}
 	}
 	if err := s.Err(); err != nil {
-		metafora.Errorf("Error reading free memory via "+meminfo+": %v", err)
+		metafora.Errorf("Error reading free memory via %s: %v", m.path, err)
 
 		// Effectively disable the balancer since an error happened
 		return 0, 100
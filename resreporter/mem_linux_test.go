@@ -17,3 +17,10 @@ func TestMemReporter(t *testing.T) {
 		t.Fatal("More memory used than available?!")
 	}
 }
+
+func TestMemFixture(t *testing.T) {
+	used, total := resreporter.NewMemory("testdata/meminfo").Used()
+	if used != 600000 || total != 1000000 {
+		t.Fatalf("Expected 600000 of 1000000 kB used but found %d of %d", used, total)
+	}
+}
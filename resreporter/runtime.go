@@ -0,0 +1,68 @@
+package resreporter
+
+import (
+	"math"
+	"runtime"
+
+	"github.com/lytics/metafora"
+)
+
+// readMemStats is overridden by tests.
+var readMemStats = runtime.ReadMemStats
+
+// NewHeap creates a reporter of the bytes of Go heap in use against a budget
+// in bytes. Since handlers run in-process this protects the process itself
+// rather than the machine. A budget of 0 is unlimited.
+func NewHeap(budget uint64) metafora.ResourceReporter {
+	if budget == 0 {
+		budget = math.MaxUint64
+	}
+	return heap{budget: budget}
+}
+
+type heap struct {
+	budget uint64
+}
+
+func (h heap) Used() (used uint64, total uint64) {
+	ms := runtime.MemStats{}
+	readMemStats(&ms)
+	return ms.HeapInuse, h.budget
+}
+
+func (heap) String() string { return "heap bytes" }
+
+// NewGoroutines creates a reporter of the number of goroutines against a
+// budget. A budget of 0 or less is unlimited.
+func NewGoroutines(budget int) metafora.ResourceReporter {
+	if budget <= 0 {
+		return goroutines{budget: math.MaxUint64}
+	}
+	return goroutines{budget: uint64(budget)}
+}
+
+type goroutines struct {
+	budget uint64
+}
+
+func (g goroutines) Used() (used uint64, total uint64) {
+	return uint64(runtime.NumGoroutine()), g.budget
+}
+
+func (goroutines) String() string { return "goroutines" }
+
+// GCPressure reports the fraction of CPU time used by the garbage collector
+// in hundredths of a percent. It's runtime.MemStats.GCCPUFraction, which is a
+// lifetime figure averaged since the process started rather than current GC
+// pressure, so it's slow to react in long running processes.
+var GCPressure metafora.ResourceReporter = gcPressure{}
+
+type gcPressure struct{}
+
+func (gcPressure) Used() (used uint64, total uint64) {
+	ms := runtime.MemStats{}
+	readMemStats(&ms)
+	return uint64(ms.GCCPUFraction * 10000), 10000
+}
+
+func (gcPressure) String() string { return "GC CPU (0.01%)" }
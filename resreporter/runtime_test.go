@@ -0,0 +1,35 @@
+package resreporter
+
+import (
+	"math"
+	"runtime"
+	"testing"
+)
+
+func TestRuntimeReporters(t *testing.T) {
+	readMemStats = func(ms *runtime.MemStats) {
+		ms.HeapInuse = 300
+		ms.GCCPUFraction = 0.025
+	}
+	defer func() { readMemStats = runtime.ReadMemStats }()
+
+	if used, total := NewHeap(1000).Used(); used != 300 || total != 1000 {
+		t.Errorf("Expected 300 of 1000 heap bytes but found %d of %d", used, total)
+	}
+	if used, total := GCPressure.Used(); used != 250 || total != 10000 {
+		t.Errorf("Expected 250 of 10000 GC CPU but found %d of %d", used, total)
+	}
+
+	// Zero budgets are unlimited
+	if _, total := NewHeap(0).Used(); total != math.MaxUint64 {
+		t.Errorf("Expected unlimited heap budget but found %d", total)
+	}
+	if _, total := NewGoroutines(0).Used(); total != math.MaxUint64 {
+		t.Errorf("Expected unlimited goroutine budget but found %d", total)
+	}
+
+	used, total := NewGoroutines(1000000).Used()
+	if used == 0 || used > total || total != 1000000 {
+		t.Errorf("Unexpected goroutines: %d of %d", used, total)
+	}
+}
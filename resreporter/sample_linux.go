@@ -0,0 +1,74 @@
+package resreporter
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// SampleInterval is how often the CPU reporters sample CPU time. Used reports
+// utilization over the last complete interval regardless of how often it's
+// called. Changing it only affects reporters which haven't been used yet.
+var SampleInterval = 5 * time.Second
+
+// errNoSample is returned by sampler.get until an interval has completed.
+var errNoSample = errors.New("no complete sample interval")
+
+// sampler samples a pair of increasing counters -- time busy and time elapsed
+// -- every SampleInterval once first used, and reports how much they changed
+// over the last complete interval.
+type sampler struct {
+	read func() (busy, elapsed uint64, err error)
+
+	once sync.Once
+	mu   sync.Mutex
+
+	// whether busy and elapsed hold a previous sample; set initially by
+	// reporters whose counters start at zero
+	prev          bool
+	busy, elapsed uint64
+
+	// change over the last complete interval and the last read error
+	dbusy, delapsed uint64
+	err             error
+}
+
+// get starts sampling on first use and returns the last complete sample.
+func (s *sampler) get() (busy, elapsed uint64, err error) {
+	s.once.Do(func() {
+		s.sample()
+		tick := time.Tick(SampleInterval)
+		go func() {
+			for range tick {
+				s.sample()
+			}
+		}()
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, 0, s.err
+	}
+	if s.delapsed == 0 {
+		return 0, 0, errNoSample
+	}
+	return s.dbusy, s.delapsed, nil
+}
+
+// sample reads the counters. Samples where no time elapsed -- such as within
+// a single jiffy -- are ignored so the last complete interval is kept.
+func (s *sampler) sample() {
+	busy, elapsed, err := s.read()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	if err != nil {
+		return
+	}
+	if s.prev && elapsed > s.elapsed && busy >= s.busy {
+		s.dbusy, s.delapsed = busy-s.busy, elapsed-s.elapsed
+	}
+	if !s.prev || elapsed > s.elapsed {
+		s.prev, s.busy, s.elapsed = true, busy, elapsed
+	}
+}
@@ -0,0 +1,300 @@
+// Package sim replays a recorded cluster snapshot through Balancers offline to
+// show how tasks would be distributed over many rounds of balancing.
+//
+// Each round every node's Balancer is asked which tasks to release. Released
+// and unclaimed tasks are then offered to every node's CanClaim and the node
+// that accepts after the shortest delay claims the task, mimicking the claim
+// race between real nodes. Delays advance a virtual clock via
+// metafora.SleepContext instead of sleeping, so simulations are fast and
+// reproducible apart from any randomness in the Balancers themselves. Ties go
+// to the first node in ID order.
+package sim
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lytics/metafora"
+)
+
+// Snapshot is a recorded state of a cluster.
+type Snapshot struct {
+	Nodes     []Node `json:"nodes"`
+	Unclaimed []Task `json:"unclaimed,omitempty"`
+}
+
+// Node is a node and the tasks it has claimed.
+type Node struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Tasks  []Task            `json:"tasks"`
+}
+
+// Task is a recorded task.
+type Task struct {
+	ID      string             `json:"id"`
+	Props   metafora.TaskProps `json:"props"`
+	Usage   map[string]uint64  `json:"usage,omitempty"`
+	Started time.Time          `json:"started"`
+}
+
+// BalancerFunc creates the Balancer for a simulated node. The Cluster
+// implements metafora.WeightedClusterState and metafora.NodeLister, and
+// Cluster.Affinity provides a node's metafora.AffinityState.
+type BalancerFunc func(nodeID string, c *Cluster) metafora.Balancer
+
+// Round is the distribution of tasks after a round of balancing.
+type Round struct {
+	// Released tasks by the node which released them.
+	Released map[string][]string `json:"released"`
+
+	// NodeTasks is the number of tasks claimed by each node.
+	NodeTasks map[string]int `json:"node_tasks"`
+
+	// NodeWeight is the summed weight of tasks claimed by each node.
+	NodeWeight map[string]float64 `json:"node_weight"`
+
+	// Unclaimed tasks no node would claim.
+	Unclaimed []string `json:"unclaimed"`
+}
+
+// Simulate replays the snapshot through the Balancers created by newBalancer
+// for the given number of rounds and returns the distribution after each.
+func Simulate(snap Snapshot, newBalancer BalancerFunc, rounds int) []Round {
+	c := newCluster(snap)
+	bals := make(map[string]metafora.Balancer, len(c.order))
+	ctxs := make(map[string]*nodeCtx, len(c.order))
+	for _, id := range c.order {
+		ctxs[id] = &nodeCtx{c: c, id: id}
+		bals[id] = newBalancer(id, c)
+		bals[id].Init(ctxs[id])
+	}
+
+	results := make([]Round, 0, rounds)
+	for i := 0; i < rounds; i++ {
+		released := map[string][]string{}
+		for _, id := range c.order {
+			for _, taskID := range bals[id].Balance() {
+				if t, ok := c.release(id, taskID); ok {
+					released[id] = append(released[id], t.ID)
+				}
+			}
+		}
+
+		c.mu.RLock()
+		pending := append([]Task(nil), c.unclaimed...)
+		c.mu.RUnlock()
+		for _, t := range pending {
+			if id := race(c.order, bals, ctxs, t.ID); id != "" {
+				c.claim(id, t.ID)
+			}
+		}
+		results = append(results, c.round(released))
+	}
+	return results
+}
+
+// race offers a task to every node's CanClaim and returns the node that
+// accepted it after the shortest delay or "" if none did.
+func race(order []string, bals map[string]metafora.Balancer, ctxs map[string]*nodeCtx, taskID string) string {
+	winner, best := "", time.Duration(0)
+	for _, id := range order {
+		ctxs[id].slept = 0
+		if !bals[id].CanClaim(taskID) {
+			continue
+		}
+		if winner == "" || ctxs[id].slept < best {
+			winner, best = id, ctxs[id].slept
+		}
+	}
+	return winner
+}
+
+// Cluster is the simulated state of a cluster.
+type Cluster struct {
+	mu        sync.RWMutex
+	order     []string
+	nodes     map[string]*Node
+	unclaimed []Task
+}
+
+func newCluster(snap Snapshot) *Cluster {
+	c := &Cluster{
+		nodes:     make(map[string]*Node, len(snap.Nodes)),
+		unclaimed: append([]Task(nil), snap.Unclaimed...),
+	}
+	for _, n := range snap.Nodes {
+		n := n
+		n.Tasks = append([]Task(nil), n.Tasks...)
+		c.order = append(c.order, n.ID)
+		c.nodes[n.ID] = &n
+	}
+	sort.Strings(c.order)
+	return c
+}
+
+// claim moves an unclaimed task to node.
+func (c *Cluster) claim(node, taskID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, t := range c.unclaimed {
+		if t.ID == taskID {
+			c.unclaimed = append(c.unclaimed[:i], c.unclaimed[i+1:]...)
+			c.nodes[node].Tasks = append(c.nodes[node].Tasks, t)
+			return
+		}
+	}
+}
+
+// release moves a task claimed by node to the unclaimed list.
+func (c *Cluster) release(node, taskID string) (Task, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.nodes[node]
+	for i, t := range n.Tasks {
+		if t.ID == taskID {
+			n.Tasks = append(n.Tasks[:i], n.Tasks[i+1:]...)
+			c.unclaimed = append(c.unclaimed, t)
+			return t, true
+		}
+	}
+	return Task{}, false
+}
+
+// round returns the current distribution of tasks.
+func (c *Cluster) round(released map[string][]string) Round {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	r := Round{
+		Released:   released,
+		NodeTasks:  make(map[string]int, len(c.nodes)),
+		NodeWeight: make(map[string]float64, len(c.nodes)),
+		Unclaimed:  []string{},
+	}
+	for id, n := range c.nodes {
+		r.NodeTasks[id] = len(n.Tasks)
+		for _, t := range n.Tasks {
+			r.NodeWeight[id] += t.Props.TaskWeight()
+		}
+	}
+	for _, t := range c.unclaimed {
+		r.Unclaimed = append(r.Unclaimed, t.ID)
+	}
+	return r
+}
+
+// NodeTaskCount returns the number of tasks claimed by each node.
+func (c *Cluster) NodeTaskCount() (map[string]int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	counts := make(map[string]int, len(c.nodes))
+	for id, n := range c.nodes {
+		counts[id] = len(n.Tasks)
+	}
+	return counts, nil
+}
+
+// NodeTaskWeight returns the summed weight of tasks claimed by each node.
+func (c *Cluster) NodeTaskWeight() (map[string]float64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	weights := make(map[string]float64, len(c.nodes))
+	for id, n := range c.nodes {
+		weights[id] = 0
+		for _, t := range n.Tasks {
+			weights[id] += t.Props.TaskWeight()
+		}
+	}
+	return weights, nil
+}
+
+// Nodes returns the IDs of every node.
+func (c *Cluster) Nodes() ([]string, error) {
+	return append([]string(nil), c.order...), nil
+}
+
+// Affinity returns the metafora.AffinityState of a node.
+func (c *Cluster) Affinity(nodeID string) metafora.AffinityState {
+	return &nodeCtx{c: c, id: nodeID}
+}
+
+// props returns the properties of any task in the cluster.
+func (c *Cluster) props(taskID string) metafora.TaskProps {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, n := range c.nodes {
+		for _, t := range n.Tasks {
+			if t.ID == taskID {
+				return t.Props
+			}
+		}
+	}
+	for _, t := range c.unclaimed {
+		if t.ID == taskID {
+			return t.Props
+		}
+	}
+	return metafora.TaskProps{}
+}
+
+// nodeCtx is the metafora.BalancerContext and metafora.AffinityState of a
+// simulated node.
+type nodeCtx struct {
+	c  *Cluster
+	id string
+
+	// virtual time the node's Balancer delayed the current claim
+	slept time.Duration
+}
+
+func (n *nodeCtx) Tasks() []metafora.Task {
+	n.c.mu.RLock()
+	defer n.c.mu.RUnlock()
+	tasks := make([]metafora.Task, len(n.c.nodes[n.id].Tasks))
+	for i, t := range n.c.nodes[n.id].Tasks {
+		tasks[i] = simTask{t}
+	}
+	return tasks
+}
+
+func (n *nodeCtx) Cluster() (metafora.ClusterView, error) {
+	counts, _ := n.c.NodeTaskCount()
+	nodes, _ := n.c.Nodes()
+	view := metafora.ClusterView{NodeID: n.id, Nodes: nodes, NodeTasks: counts}
+	n.c.mu.RLock()
+	defer n.c.mu.RUnlock()
+	for _, t := range n.c.unclaimed {
+		if view.Backlog == 0 || t.Props.Priority > view.BacklogPriority {
+			view.BacklogPriority = t.Props.Priority
+		}
+		view.Backlog++
+	}
+	return view, nil
+}
+
+func (*nodeCtx) Frozen() bool { return false }
+
+func (n *nodeCtx) Sleep(d time.Duration) { n.slept += d }
+
+func (n *nodeCtx) Labels() map[string]string {
+	return n.c.nodes[n.id].Labels
+}
+
+func (n *nodeCtx) Props(taskID string) metafora.TaskProps {
+	return n.c.props(taskID)
+}
+
+// simTask implements metafora.PropsTask and metafora.UsageTask for a recorded
+// task.
+type simTask struct {
+	t Task
+}
+
+func (t simTask) ID() string                   { return t.t.ID }
+func (t simTask) Started() time.Time           { return t.t.Started }
+func (simTask) Stopped() time.Time             { return time.Time{} }
+func (t simTask) Props() metafora.TaskProps    { return t.t.Props }
+func (t simTask) Usage() map[string]uint64     { return t.t.Usage }
+func (t simTask) MarshalJSON() ([]byte, error) { return json.Marshal(t.t) }
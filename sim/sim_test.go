@@ -0,0 +1,39 @@
+package sim_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lytics/metafora"
+	"github.com/lytics/metafora/sim"
+)
+
+func TestSimulate(t *testing.T) {
+	t.Parallel()
+
+	snap := sim.Snapshot{
+		Nodes:     []sim.Node{{ID: "node1"}, {ID: "node2"}},
+		Unclaimed: []sim.Task{{ID: "new"}},
+	}
+	for i := 0; i < 10; i++ {
+		snap.Nodes[0].Tasks = append(snap.Nodes[0].Tasks, sim.Task{ID: fmt.Sprintf("task%d", i)})
+	}
+
+	rounds := sim.Simulate(snap, func(id string, c *sim.Cluster) metafora.Balancer {
+		return metafora.NewDefaultFairBalancer(id, c)
+	}, 1)
+	if len(rounds) != 1 {
+		t.Fatalf("Expected 1 round but found %d", len(rounds))
+	}
+	r := rounds[0]
+	if len(r.Released["node1"]) == 0 || len(r.Released["node2"]) != 0 {
+		t.Fatalf("Expected only node1 to release tasks: %v", r.Released)
+	}
+	if r.NodeTasks["node1"]+r.NodeTasks["node2"] != 11 || len(r.Unclaimed) != 0 {
+		t.Fatalf("Expected all 11 tasks to be claimed: %+v", r)
+	}
+	// node1 delays claiming the tasks it released, and ties go to node1
+	if r.NodeTasks["node2"] != len(r.Released["node1"]) {
+		t.Fatalf("Expected only released tasks to move to node2: %+v", r)
+	}
+}
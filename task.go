@@ -2,6 +2,7 @@ package metafora
 
 import (
 	"encoding/json"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -13,6 +14,54 @@ type Task interface {
 	json.Marshaler
 }
 
+// FencedTask is an optional interface Tasks may implement to expose the
+// fencing token of their claim. The Consumer's Tasks implement it.
+type FencedTask interface {
+	Task
+
+	// Token is the fencing token of the task's claim or 0 if the Coordinator
+	// doesn't implement FencingCoordinator.
+	Token() uint64
+}
+
+// PropsTask is an optional interface Tasks may implement to expose the
+// properties stored with them. The Consumer's Tasks implement it.
+type PropsTask interface {
+	Task
+
+	// Props are the properties stored with the task or the zero value if the
+	// Coordinator doesn't implement PropsCoordinator.
+	Props() TaskProps
+}
+
+// UsageTask is an optional interface Tasks may implement to expose the
+// resources they use. The Consumer's Tasks implement it.
+type UsageTask interface {
+	Task
+
+	// Usage returns the resources used by the task or nil if the task's
+	// Handler doesn't implement UsageHandler.
+	Usage() map[string]uint64
+}
+
+// taskProps returns the task's properties or the zero value if it doesn't
+// implement PropsTask.
+func taskProps(t Task) TaskProps {
+	if pt, ok := t.(PropsTask); ok {
+		return pt.Props()
+	}
+	return TaskProps{}
+}
+
+// taskUsage returns the task's resource usage or nil if it doesn't implement
+// UsageTask.
+func taskUsage(t Task) map[string]uint64 {
+	if ut, ok := t.(UsageTask); ok {
+		return ut.Usage()
+	}
+	return nil
+}
+
 // task is the per-task state Metafora tracks internally.
 type task struct {
 	// handler on which Run and Stop are called
@@ -21,30 +70,126 @@ type task struct {
 	// id of task to satisfy Task interface
 	id string
 
-	// stopL serializes calls to task.h.Stop() to make handler implementations
-	// easier/safer as well as guard stopped
+	// fencing token of the claim
+	token uint64
+
+	// properties stored with the task
+	props TaskProps
+
+	// token passed by the previous owner if the task was handed off
+	handoffToken string
+
+	// checkpointer bound to this claim or nil if unsupported
+	cp Checkpointer
+
+	// latest progress set by the handler
+	progress progress
+
+	// stopL guards stopped, stopping, and handoff. It's never held while
+	// calling task.h.Stop() as Stop may block in hung handlers.
 	stopL sync.Mutex
 
 	// when task was started and when Stop was first called
 	started time.Time
 	stopped time.Time
+
+	// true while task.h.Stop() is being called to serialize calls to it,
+	// making handler implementations easier/safer
+	stopping bool
+
+	// node nominated by the balancer to claim the task once released
+	handoff string
+
+	// beatL guards when the handler last heartbeat and when it was found hung
+	// separately from stopL as Stop may block in hung handlers
+	beatL sync.Mutex
+	beat  time.Time
+	hung  time.Time
 }
 
-func newTask(id string, h Handler) *task {
-	return &task{id: id, h: h, started: time.Now()}
+func newTask(id string, token uint64, props TaskProps, h Handler) *task {
+	now := time.Now()
+	return &task{id: id, token: token, props: props, h: h, started: now, beat: now}
 }
 
 func (t *task) stop() {
 	t.stopL.Lock()
-	defer t.stopL.Unlock()
 	if t.stopped.IsZero() {
 		t.stopped = time.Now()
 	}
+	if t.stopping {
+		// Don't pile up calls behind a Stop which may be blocked
+		t.stopL.Unlock()
+		Warnf("Handler %s still stopping; not calling Stop again", t.id)
+		return
+	}
+	t.stopping = true
+	t.stopL.Unlock()
+
+	defer func() {
+		t.stopL.Lock()
+		t.stopping = false
+		t.stopL.Unlock()
+	}()
 	t.h.Stop()
 }
 
 func (t *task) ID() string         { return t.id }
 func (t *task) Started() time.Time { return t.started }
+func (t *task) Token() uint64      { return t.token }
+func (t *task) Props() TaskProps   { return t.props }
+func (t *task) HandoffToken() string {
+	return t.handoffToken
+}
+func (t *task) Checkpointer() Checkpointer { return t.cp }
+func (t *task) Progress() Progress         { return t.progress.get() }
+func (t *task) SetProgress(p Progress) {
+	t.progress.set(p)
+	t.Heartbeat()
+}
+func (t *task) Heartbeat() {
+	t.beatL.Lock()
+	t.beat = time.Now()
+	t.beatL.Unlock()
+}
+func (t *task) setHung() {
+	t.beatL.Lock()
+	t.hung = time.Now()
+	t.beatL.Unlock()
+}
+func (t *task) hungSince() time.Time {
+	t.beatL.Lock()
+	defer t.beatL.Unlock()
+	return t.hung
+}
+func (t *task) Usage() (usage map[string]uint64) {
+	uh, ok := t.h.(UsageHandler)
+	if !ok {
+		return nil
+	}
+
+	// all handler methods must be wrapped in a recover to prevent a misbehaving
+	// handler from crashing the entire consumer
+	defer func() {
+		if err := recover(); err != nil {
+			stack := make([]byte, 50*1024)
+			sz := runtime.Stack(stack, false)
+			Errorf("Handler %s panic()'d on Usage: %v\n%s", t.id, err, stack[:sz])
+			usage = nil
+		}
+	}()
+	return uh.Usage()
+}
+func (t *task) setHandoff(node string) {
+	t.stopL.Lock()
+	t.handoff = node
+	t.stopL.Unlock()
+}
+func (t *task) handoffTarget() string {
+	t.stopL.Lock()
+	defer t.stopL.Unlock()
+	return t.handoff
+}
 func (t *task) Stopped() time.Time {
 	t.stopL.Lock()
 	defer t.stopL.Unlock()
@@ -53,15 +198,30 @@ func (t *task) Stopped() time.Time {
 
 func (t *task) MarshalJSON() ([]byte, error) {
 	js := struct {
-		ID      string     `json:"id"`
-		Started time.Time  `json:"started"`
-		Stopped *time.Time `json:"stopped,omitempty"`
-	}{ID: t.id, Started: t.started}
+		ID       string            `json:"id"`
+		Started  time.Time         `json:"started"`
+		Stopped  *time.Time        `json:"stopped,omitempty"`
+		Token    uint64            `json:"token,omitempty"`
+		Props    TaskProps         `json:"props"`
+		Usage    map[string]uint64 `json:"usage,omitempty"`
+		Progress *Progress         `json:"progress,omitempty"`
+		Hung     *time.Time        `json:"hung,omitempty"`
+	}{ID: t.id, Started: t.started, Token: t.token, Props: t.props, Usage: t.Usage()}
 
 	// Only set stopped if it's non-zero
 	if s := t.Stopped(); !s.IsZero() {
 		js.Stopped = &s
 	}
 
+	// Only set progress if the handler has set it
+	if p := t.Progress(); !p.Updated.IsZero() {
+		js.Progress = &p
+	}
+
+	// Only set hung if the handler missed a deadline
+	if h := t.hungSince(); !h.IsZero() {
+		js.Hung = &h
+	}
+
 	return json.Marshal(&js)
 }